@@ -1,8 +1,14 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
 	"time"
 
 	"github.com/Financial-Times/elasticsearch-reindexer/service"
@@ -65,12 +71,216 @@ func main() {
 		Desc:   "An optional filter query to apply to the alias",
 		EnvVar: "ALIAS_FILTER_FILE",
 	})
+	settingsFile := app.String(cli.StringOpt{
+		Name:   "settings-file",
+		Value:  "",
+		Desc:   "An optional file of index settings, such as shards, replicas and analysis, merged into the settings of the mapping file",
+		EnvVar: "SETTINGS_FILE",
+	})
 	aliasForAllConcepts := app.String(cli.StringOpt{
 		Name:   "alias-for-all-concepts",
 		Value:  "all-concepts",
 		Desc:   "The name of the index alias which won't have any filters",
 		EnvVar: "ALIAS_FOR_ALL_CONCEPTS",
 	})
+	inPlaceMappingUpdates := app.Bool(cli.BoolOpt{
+		Name:   "in-place-mapping-updates",
+		Value:  true,
+		Desc:   "Whether to apply mapping changes which only add fields to the current index, instead of reindexing",
+		EnvVar: "IN_PLACE_MAPPING_UPDATES",
+	})
+	inPlaceSettingsUpdates := app.Bool(cli.BoolOpt{
+		Name:   "in-place-settings-updates",
+		Value:  true,
+		Desc:   "Whether to apply settings changes to the current index, closing it for static settings, instead of reindexing",
+		EnvVar: "IN_PLACE_SETTINGS_UPDATES",
+	})
+	zeroDowntime := app.Bool(cli.BoolOpt{
+		Name:   "zero-downtime",
+		Value:  false,
+		Desc:   "Whether to keep the current index writable while reindexing, and only block writes for a final catch-up pass",
+		EnvVar: "ZERO_DOWNTIME",
+	})
+	deltaField := app.String(cli.StringOpt{
+		Name:   "delta-field",
+		Value:  "_seq_no",
+		Desc:   "The field used to find documents written during a zero-downtime migration: a timestamp field, or _seq_no",
+		EnvVar: "DELTA_FIELD",
+	})
+	maxDeltaPasses := app.Int(cli.IntOpt{
+		Name:   "max-delta-passes",
+		Value:  5,
+		Desc:   "The number of catch-up passes of a zero-downtime migration run while the current index is writable",
+		EnvVar: "MAX_DELTA_PASSES",
+	})
+	finalPassThreshold := app.Int(cli.IntOpt{
+		Name:   "final-pass-threshold",
+		Value:  1000,
+		Desc:   "The number of outstanding documents below which the final, write-blocked catch-up pass is started",
+		EnvVar: "FINAL_PASS_THRESHOLD",
+	})
+	reindexSlices := app.String(cli.StringOpt{
+		Name:   "reindex-slices",
+		Value:  "1",
+		Desc:   "The number of slices each reindex runs in parallel, or auto for one slice per shard",
+		EnvVar: "REINDEX_SLICES",
+	})
+	reindexBatchSize := app.Int(cli.IntOpt{
+		Name:   "reindex-batch-size",
+		Value:  1000,
+		Desc:   "The number of documents read from the source index per scroll request",
+		EnvVar: "REINDEX_BATCH_SIZE",
+	})
+	reindexRequestsPerSecond := app.Int(cli.IntOpt{
+		Name:   "reindex-requests-per-second",
+		Value:  0,
+		Desc:   "Throttle for reindexing, in documents per second, or 0 for no throttling. It can be changed while a reindex runs with POST /reindex/rethrottle",
+		EnvVar: "REINDEX_REQUESTS_PER_SECOND",
+	})
+	transformFile := app.String(cli.StringOpt{
+		Name:   "transform-file",
+		Value:  "",
+		Desc:   "An optional script or ingest pipeline to apply to the documents while reindexing",
+		EnvVar: "TRANSFORM_FILE",
+	})
+	sourceEsEndpoint := app.String(cli.StringOpt{
+		Name:   "source-elasticsearch-endpoint",
+		Value:  "",
+		Desc:   "An optional ES endpoint of another cluster to copy the index behind the alias from",
+		EnvVar: "SOURCE_ELASTICSEARCH_ENDPOINT",
+	})
+	sourceEsRegion := app.String(cli.StringOpt{
+		Name:   "source-elasticsearch-region",
+		Value:  "eu-west-1",
+		Desc:   "Source ES region",
+		EnvVar: "SOURCE_ELASTICSEARCH_REGION",
+	})
+	sourceEsAuth := app.String(cli.StringOpt{
+		Name:   "source-auth",
+		Value:  "none",
+		Desc:   "Authentication method for the source ES cluster (aws, local or basic)",
+		EnvVar: "SOURCE_AUTH",
+	})
+	sourceEsUsername := app.String(cli.StringOpt{
+		Name:   "source-elasticsearch-username",
+		Value:  "",
+		Desc:   "Username for the source ES cluster with basic authentication",
+		EnvVar: "SOURCE_ELASTICSEARCH_USERNAME",
+	})
+	sourceEsPassword := app.String(cli.StringOpt{
+		Name:   "source-elasticsearch-password",
+		Value:  "",
+		Desc:   "Password for the source ES cluster with basic authentication",
+		EnvVar: "SOURCE_ELASTICSEARCH_PASSWORD",
+	})
+	remoteReindex := app.String(cli.StringOpt{
+		Name:   "remote-reindex",
+		Value:  service.RemoteReindexAuto,
+		Desc:   "How documents are copied from the source cluster: remote (reindex from remote), client (scroll and bulk index through the reindexer), or auto to fall back to client",
+		EnvVar: "REMOTE_REINDEX",
+	})
+	retentionKeepVersions := app.Int(cli.IntOpt{
+		Name:   "retention-keep-versions",
+		Value:  0,
+		Desc:   "The number of previous index versions to keep after a migration, or 0 for no limit on the number",
+		EnvVar: "RETENTION_KEEP_VERSIONS",
+	})
+	retentionMaxAge := app.String(cli.StringOpt{
+		Name:   "retention-max-age",
+		Value:  "",
+		Desc:   "Previous index versions younger than this duration (e.g. 720h) are kept after a migration",
+		EnvVar: "RETENTION_MAX_AGE",
+	})
+	retentionDelete := app.Bool(cli.BoolOpt{
+		Name:   "retention-delete",
+		Value:  false,
+		Desc:   "Whether previous index versions which are not kept are deleted, instead of closed",
+		EnvVar: "RETENTION_DELETE",
+	})
+	snapshotRepository := app.String(cli.StringOpt{
+		Name:   "snapshot-repository",
+		Value:  "",
+		Desc:   "An optional snapshot repository to snapshot the current index into before a migration blocks writes to it",
+		EnvVar: "SNAPSHOT_REPOSITORY",
+	})
+	snapshotLocation := app.String(cli.StringOpt{
+		Name:   "snapshot-location",
+		Value:  "",
+		Desc:   "A path listed in the cluster's path.repo setting, to register the snapshot repository as a shared file system repository",
+		EnvVar: "SNAPSHOT_LOCATION",
+	})
+	verify := app.Bool(cli.BoolOpt{
+		Name:   "verify",
+		Value:  false,
+		Desc:   "Whether to compare the document counts and a random sample of documents of the new and current indices before moving the aliases",
+		EnvVar: "VERIFY",
+	})
+	verifySampleSize := app.Int(cli.IntOpt{
+		Name:   "verify-sample-size",
+		Value:  100,
+		Desc:   "The number of documents the verification compares by their _source",
+		EnvVar: "VERIFY_SAMPLE_SIZE",
+	})
+	verifyMaxMismatchRate := app.String(cli.StringOpt{
+		Name:   "verify-max-mismatch-rate",
+		Value:  "0",
+		Desc:   "The rate of sampled documents (between 0 and 1) which may differ without failing the migration",
+		EnvVar: "VERIFY_MAX_MISMATCH_RATE",
+	})
+	smokeQueriesDir := app.String(cli.StringOpt{
+		Name:   "smoke-queries-dir",
+		Value:  "",
+		Desc:   "An optional directory of searches, with their expected hits, which must succeed against the new index before the aliases are moved",
+		EnvVar: "SMOKE_QUERIES_DIR",
+	})
+	canaryAliasSuffix := app.String(cli.StringOpt{
+		Name:   "canary-alias-suffix",
+		Value:  "",
+		Desc:   "An optional suffix (e.g. -next) of an alias pointed at the new index, which then waits to be promoted before the aliases are moved",
+		EnvVar: "CANARY_ALIAS_SUFFIX",
+	})
+	promotionTimeout := app.String(cli.StringOpt{
+		Name:   "promotion-timeout",
+		Value:  "24h",
+		Desc:   "How long a migration with a canary alias waits to be promoted",
+		EnvVar: "PROMOTION_TIMEOUT",
+	})
+	promoteOnTimeout := app.Bool(cli.BoolOpt{
+		Name:   "promote-on-timeout",
+		Value:  false,
+		Desc:   "Whether a migration which is not promoted before the promotion timeout is promoted, instead of failing",
+		EnvVar: "PROMOTE_ON_TIMEOUT",
+	})
+	lockOwner := app.String(cli.StringOpt{
+		Name:   "lock-owner",
+		Value:  "",
+		Desc:   "How this instance is named in the migration lock, which only lets one instance migrate an index at a time. Defaults to the host name and process ID",
+		EnvVar: "LOCK_OWNER",
+	})
+	lockTTL := app.String(cli.StringOpt{
+		Name:   "lock-ttl",
+		Value:  "1m",
+		Desc:   "How long the migration lock of an instance which stopped sending heartbeats is held before another instance may take it over",
+		EnvVar: "LOCK_TTL",
+	})
+	cancelDeletesTarget := app.Bool(cli.BoolOpt{
+		Name:   "cancel-deletes-target",
+		Value:  false,
+		Desc:   "Whether a migration cancelled on SIGTERM deletes its partly built index, instead of keeping it to resume from",
+		EnvVar: "CANCEL_DELETES_TARGET",
+	})
+	shutdownTimeout := app.String(cli.StringOpt{
+		Name:   "shutdown-timeout",
+		Value:  "2m",
+		Desc:   "How long to wait on SIGTERM for the cancelled migrations to stop and restore the indices before exiting",
+		EnvVar: "SHUTDOWN_TIMEOUT",
+	})
+	manifestFile := app.String(cli.StringOpt{
+		Name:   "manifest-file",
+		Value:  "",
+		Desc:   "An optional manifest listing several indices to manage, each with its alias, version, mapping file, alias filter and extra aliases. It replaces the single index options",
+		EnvVar: "MANIFEST_FILE",
+	})
 	esTraceLogging := app.Bool(cli.BoolOpt{
 		Name:   "elasticsearch-trace",
 		Value:  false,
@@ -92,19 +302,77 @@ func main() {
 
 	log.InitDefaultLogger("elasticsearch-reindexer")
 
-	app.Action = func() {
-		logStartupConfig(port, esEndpoint, esAuth, esIndex, esRegion)
+	migrationOptions := func() service.MigrationOptions {
+		var sourceCluster *service.EsAccessConfig
+		if *sourceEsEndpoint != "" {
+			config := newAccessConfig(*sourceEsRegion, *sourceEsEndpoint, *sourceEsAuth, *esTraceLogging).WithBasicAuth(*sourceEsUsername, *sourceEsPassword)
+			sourceCluster = &config
+		}
+
+		var maxAge time.Duration
+		if *retentionMaxAge != "" {
+			var err error
+			maxAge, err = time.ParseDuration(*retentionMaxAge)
+			if err != nil {
+				log.WithError(err).Fatal("invalid retention max age")
+			}
+		}
 
-		awsSession, err := session.NewSession()
+		var timeout time.Duration
+		if *promotionTimeout != "" {
+			var err error
+			timeout, err = time.ParseDuration(*promotionTimeout)
+			if err != nil {
+				log.WithError(err).Fatal("invalid promotion timeout")
+			}
+		}
+
+		ttl, err := time.ParseDuration(*lockTTL)
 		if err != nil {
-			log.WithError(err).Fatal("Failed to initialize AWS session")
+			log.WithError(err).Fatal("invalid migration lock TTL")
 		}
-		credValues, err := awsSession.Config.Credentials.Get()
+
+		maxMismatchRate, err := strconv.ParseFloat(*verifyMaxMismatchRate, 64)
 		if err != nil {
-			log.WithError(err).Fatal("Failed to obtain AWS credentials values")
+			log.WithError(err).Fatal("invalid verification maximum mismatch rate")
 		}
-		log.Infof("Obtaining AWS credentials by using [%s] as provider", credValues.ProviderName)
-		accessConfig := service.NewAccessConfig(awsSession.Config.Credentials, *esRegion, *esEndpoint, *esAuth, *esTraceLogging)
+
+		return service.MigrationOptions{
+			InPlaceMappingUpdates:  *inPlaceMappingUpdates,
+			InPlaceSettingsUpdates: *inPlaceSettingsUpdates,
+			ZeroDowntime:           *zeroDowntime,
+			DeltaField:             *deltaField,
+			MaxDeltaPasses:         *maxDeltaPasses,
+			FinalPassThreshold:     *finalPassThreshold,
+			ReindexSlices:          *reindexSlices,
+			ReindexBatchSize:       *reindexBatchSize,
+			RequestsPerSecond:      *reindexRequestsPerSecond,
+			TransformFile:          *transformFile,
+			SourceCluster:          sourceCluster,
+			RemoteReindex:          *remoteReindex,
+			Retention: service.RetentionPolicy{
+				KeepVersions: *retentionKeepVersions,
+				MaxAge:       maxAge,
+				Delete:       *retentionDelete,
+			},
+			SnapshotRepository:    *snapshotRepository,
+			SnapshotLocation:      *snapshotLocation,
+			Verify:                *verify,
+			VerifySampleSize:      *verifySampleSize,
+			VerifyMaxMismatchRate: maxMismatchRate,
+			SmokeQueriesDir:       *smokeQueriesDir,
+			CanaryAliasSuffix:     *canaryAliasSuffix,
+			PromotionTimeout:      timeout,
+			PromoteOnTimeout:      *promoteOnTimeout,
+			LockOwner:             *lockOwner,
+			LockTTL:               ttl,
+		}
+	}
+
+	app.Action = func() {
+		logStartupConfig(port, esEndpoint, esAuth, esIndex, esRegion)
+
+		accessConfig := newAccessConfig(*esRegion, *esEndpoint, *esAuth, *esTraceLogging)
 
 		// It seems that once we have a connection, we can lose and reconnect to Elastic OK
 		// so just keep going until successful
@@ -124,10 +392,120 @@ func main() {
 			}
 		}()
 
-		esService := service.NewEsService(ecc, *esIndex, *mappingFile, *aliasFilterFile, *mappingVersion, *panicGuideUrl, *aliasForAllConcepts)
-		routeRequest(port, esService, *systemCode)
+		if *manifestFile != "" {
+			manifest, err := service.LoadManifest(*manifestFile)
+			if err != nil {
+				log.WithError(err).Fatal("unable to load the index manifest")
+			}
+
+			managedIndices := service.NewManagedIndices(ecc, manifest, *panicGuideUrl, migrationOptions())
+			adminServices := managedIndices.AdminServices()
+			var cancelServices []service.EsAdminService
+			for _, adminService := range adminServices {
+				cancelServices = append(cancelServices, adminService)
+			}
+			go cancelOnSignal(*cancelDeletesTarget, parseShutdownTimeout(*shutdownTimeout), cancelServices...)
+			routeRequest(port, managedIndices, service.NewManagedAdminHandler(adminServices), *systemCode)
+			return
+		}
+
+		esService := service.NewEsService(ecc, *esIndex, *mappingFile, *aliasFilterFile, *settingsFile, *mappingVersion, *panicGuideUrl, *aliasForAllConcepts, migrationOptions())
+		go cancelOnSignal(*cancelDeletesTarget, parseShutdownTimeout(*shutdownTimeout), esService)
+		routeRequest(port, esService, service.NewAdminHandler(esService), *systemCode)
+	}
+
+	// commands connect once and run against the cluster without starting a migration.
+	// With a manifest, they run against the index of the manifest behind the index alias option.
+	commandService := func() service.EsAdminService {
+		logStartupConfig(port, esEndpoint, esAuth, esIndex, esRegion)
+
+		ec, err := service.NewElasticClient(newAccessConfig(*esRegion, *esEndpoint, *esAuth, *esTraceLogging))
+		if err != nil {
+			log.WithError(err).Fatal("could not connect to ElasticSearch")
+		}
+
+		if *manifestFile != "" {
+			manifest, err := service.LoadManifest(*manifestFile)
+			if err != nil {
+				log.WithError(err).Fatal("unable to load the index manifest")
+			}
+			index, err := manifest.Index(*esIndex)
+			if err != nil {
+				log.WithError(err).Fatal("unable to find the index in the manifest")
+			}
+			return service.NewManagedCommandService(ec, index, migrationOptions())
+		}
+
+		return service.NewEsCommandService(ec, *esIndex, *mappingFile, *aliasFilterFile, *settingsFile, *mappingVersion, *aliasForAllConcepts, migrationOptions())
 	}
 
+	app.Command("plan", "Show what the index migration would do, without changing anything", func(cmd *cli.Cmd) {
+		asJSON := cmd.Bool(cli.BoolOpt{
+			Name:  "json",
+			Value: false,
+			Desc:  "Output the plan as JSON",
+		})
+
+		cmd.Action = func() {
+			plan, err := commandService().PlanMigration()
+			if err != nil {
+				log.WithError(err).Fatal("unable to plan index migration")
+			}
+
+			if *asJSON {
+				enc := json.NewEncoder(os.Stdout)
+				enc.SetIndent("", "  ")
+				if err := enc.Encode(plan); err != nil {
+					log.WithError(err).Fatal("unable to write plan")
+				}
+				return
+			}
+			fmt.Print(plan.String())
+		}
+	})
+
+	app.Command("rollback", "Re-point the index aliases to the previous index version", func(cmd *cli.Cmd) {
+		cmd.Action = func() {
+			result, err := commandService().RollbackIndex()
+			if err != nil {
+				log.WithError(err).Fatal("index rollback failed")
+			}
+			log.Infof("index aliases rolled back from %s to %s", result.From, result.To)
+		}
+	})
+
+	app.Command("restore", "Restore the index of a snapshot taken before a migration, and re-point the index aliases to it", func(cmd *cli.Cmd) {
+		snapshot := cmd.String(cli.StringOpt{
+			Name:  "snapshot",
+			Value: "",
+			Desc:  "The snapshot to restore, by default the one taken by the migration to the current index",
+		})
+
+		cmd.Action = func() {
+			result, err := commandService().RestoreSnapshot(*snapshot)
+			if err != nil {
+				log.WithError(err).Fatal("snapshot restore failed")
+			}
+			log.Infof("index %s restored from snapshot %s, index aliases moved from %s", result.To, result.Snapshot, result.From)
+		}
+	})
+
+	app.Command("cleanup", "Close or delete the previous index versions which the retention policy does not keep", func(cmd *cli.Cmd) {
+		dryRun := cmd.Bool(cli.BoolOpt{
+			Name:  "dry-run",
+			Value: false,
+			Desc:  "List what would be closed or deleted, without changing anything",
+		})
+
+		cmd.Action = func() {
+			result, err := commandService().ApplyRetention(*dryRun)
+			if err != nil {
+				log.WithError(err).Fatal("unable to apply index retention policy")
+			}
+			fmt.Print(result.String())
+		}
+	})
+
 	err := app.Run(os.Args)
 	if err != nil {
 		log.Errorf("App could not start, error=[%s]\n", err)
@@ -135,6 +513,66 @@ func main() {
 	}
 }
 
+func newAccessConfig(esRegion, esEndpoint, esAuth string, esTraceLogging bool) service.EsAccessConfig {
+	awsSession, err := session.NewSession()
+	if err != nil {
+		log.WithError(err).Fatal("Failed to initialize AWS session")
+	}
+	credValues, err := awsSession.Config.Credentials.Get()
+	if err != nil {
+		log.WithError(err).Fatal("Failed to obtain AWS credentials values")
+	}
+	log.Infof("Obtaining AWS credentials by using [%s] as provider", credValues.ProviderName)
+	return service.NewAccessConfig(awsSession.Config.Credentials, esRegion, esEndpoint, esAuth, esTraceLogging)
+}
+
+func parseShutdownTimeout(timeout string) time.Duration {
+	d, err := time.ParseDuration(timeout)
+	if err != nil {
+		log.WithError(err).Fatal("invalid shutdown timeout")
+	}
+	return d
+}
+
+// cancelOnSignal cancels the running migrations on SIGTERM, and exits once they have stopped and restored the indices,
+// or once the timeout has run out
+func cancelOnSignal(deleteTarget bool, timeout time.Duration, adminServices ...service.EsAdminService) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM)
+	<-signals
+
+	var cancelled []service.EsAdminService
+	for _, adminService := range adminServices {
+		if _, err := adminService.CancelMigration(deleteTarget); !errors.Is(err, service.ErrNoMigrationRunning) {
+			cancelled = append(cancelled, adminService)
+		}
+	}
+
+	if len(cancelled) > 0 {
+		log.WithField("timeout", timeout.String()).Info("waiting for the index migrations to stop")
+		deadline := time.Now().Add(timeout)
+		for anyMigrationRunning(cancelled) {
+			if time.Now().After(deadline) {
+				log.Warn("index migrations did not stop before the shutdown timeout")
+				break
+			}
+			time.Sleep(time.Second)
+		}
+	}
+
+	os.Exit(0)
+}
+
+func anyMigrationRunning(adminServices []service.EsAdminService) bool {
+	for _, adminService := range adminServices {
+		migration, err := adminService.CurrentMigration()
+		if err == nil && migration.Running() {
+			return true
+		}
+	}
+	return false
+}
+
 func logStartupConfig(port, esEndpoint, esAuth, esIndex, esRegion *string) {
 	log.Info("ElasticSearch reindexer uses the following configuration:")
 	log.Infof("port: %v", *port)
@@ -144,19 +582,26 @@ func logStartupConfig(port, esEndpoint, esAuth, esIndex, esRegion *string) {
 	log.Infof("elasticsearch-region: %v", *esRegion)
 }
 
-func routeRequest(port *string, healthService service.EsHealthService, systemCode string) {
+func routeRequest(port *string, healthService service.EsHealthService, adminHandler *service.AdminHandler, systemCode string) {
 	servicesRouter := vestigo.NewRouter()
+	servicesRouter.Get("/plan", adminHandler.Plan)
+	servicesRouter.Get("/mapping/diff", adminHandler.MappingDiff)
+	servicesRouter.Post("/rollback", adminHandler.Rollback)
+	servicesRouter.Post("/snapshot/restore", adminHandler.RestoreSnapshot)
+	servicesRouter.Post("/reindex/rethrottle", adminHandler.Rethrottle)
+	servicesRouter.Post("/migrations", adminHandler.StartMigration)
+	servicesRouter.Get("/migrations", adminHandler.ListMigrations)
+	servicesRouter.Get("/migrations/current", adminHandler.CurrentMigration)
+	servicesRouter.Post("/migrations/current/cancel", adminHandler.CancelMigration)
+	servicesRouter.Post("/migrations/current/promote", adminHandler.PromoteMigration)
+	servicesRouter.Get("/migrations/:id", adminHandler.GetMigration)
 
 	healthCheck := fthealth.TimedHealthCheck{
 		HealthCheck: fthealth.HealthCheck{
 			SystemCode:  systemCode,
 			Name:        "Elasticsearch Service Healthcheck",
 			Description: "Checks for ES",
-			Checks: []fthealth.Check{
-				healthService.ConnectivityHealthyCheck(),
-				healthService.ClusterIsHealthyCheck(),
-				healthService.IndexMappingsCheck(),
-			},
+			Checks:      healthService.HealthChecks(),
 		},
 		Timeout: 10 * time.Second,
 	}
@@ -164,6 +609,7 @@ func routeRequest(port *string, healthService service.EsHealthService, systemCod
 
 	http.HandleFunc(status.GTGPath, status.NewGoodToGoHandler(healthService.GTG))
 	http.HandleFunc(status.BuildInfoPath, status.BuildInfoHandler)
+	http.Handle("/metrics", healthService.MetricsHandler())
 
 	http.Handle("/", servicesRouter)
 
@@ -0,0 +1,176 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	log "github.com/Financial-Times/go-logger"
+	"github.com/olivere/elastic/v7"
+)
+
+var (
+	ErrMigrationCancelled = errors.New("Migration was cancelled")
+	ErrNoMigrationRunning = errors.New("No migration is running")
+	ErrMigrationAliasing  = errors.New("Migration is already moving the aliases to the new index")
+)
+
+type EsCancelService interface {
+	CancelMigration(deleteTarget bool) (*Migration, error)
+}
+
+// CancelMigration asks the running migration to stop before it moves the aliases, and to restore the state from before it began:
+// its reindex task is cancelled, the write block it put on the source index is removed and, if deleteTarget is set,
+// the new index is deleted. Otherwise the new index is kept until a later migration builds it again.
+func (es *esService) CancelMigration(deleteTarget bool) (*Migration, error) {
+	es.Lock()
+	defer es.Unlock()
+
+	migration := es.currentMigration
+	if migration == nil || !migration.Running() {
+		return nil, ErrNoMigrationRunning
+	}
+	if migration.Phase == PhaseAliasing {
+		return nil, ErrMigrationAliasing
+	}
+
+	select {
+	case <-migration.cancel:
+	default:
+		log.WithFields(map[string]interface{}{"migration": migration.ID, "deleteTarget": deleteTarget}).Info("cancelling index migration")
+		close(migration.cancel)
+	}
+	migration.deleteTarget = migration.deleteTarget || deleteTarget
+
+	result := *migration
+	return &result, nil
+}
+
+// cancelSignal returns a channel which is closed when the running migration is cancelled,
+// or nil if MigrateIndex was not started as a migration
+func (es *esService) cancelSignal() <-chan struct{} {
+	es.RLock()
+	defer es.RUnlock()
+
+	if es.currentMigration == nil || !es.currentMigration.Running() {
+		return nil
+	}
+	return es.currentMigration.cancel
+}
+
+// checkCancelled returns ErrMigrationCancelled once the running migration has been cancelled
+func (es *esService) checkCancelled() error {
+	select {
+	case <-es.cancelSignal():
+		return ErrMigrationCancelled
+	default:
+		return nil
+	}
+}
+
+// startAliasing moves the running migration to the aliasing phase unless it has been cancelled, after which it can no longer be
+func (es *esService) startAliasing() error {
+	es.Lock()
+	defer es.Unlock()
+
+	migration := es.currentMigration
+	if migration == nil || !migration.Running() {
+		return nil
+	}
+
+	select {
+	case <-migration.cancel:
+		return ErrMigrationCancelled
+	default:
+		es.enterPhase(migration, PhaseAliasing)
+		return nil
+	}
+}
+
+func (es *esService) cancelDeletesTarget() bool {
+	es.RLock()
+	defer es.RUnlock()
+	return es.currentMigration != nil && es.currentMigration.deleteTarget
+}
+
+// undoMigration puts back the write block state the source index had before the migration began, removes the canary alias,
+// and deletes the new index if asked to. The aliases are only moved by the last step of a migration, so they are still on the current index.
+// A new index which is kept is marked stale once the source index is writable again, so that a later migration copies it again
+// rather than resuming a copy which misses the writes made in the meantime.
+func (es *esService) undoMigration(client *elastic.Client, plan *MigrationPlan, state *migrationState, deleteTarget bool) {
+	if plan.ReindexRequired && !state.SourceReadOnly {
+		source, err := es.sourceEsClient(client)
+		if err == nil {
+			err = es.setWritable(source, plan.SourceIndex)
+		}
+		if err != nil {
+			log.WithError(err).WithField("index", plan.SourceIndex).Error("unable to remove write block after stopping migration")
+		}
+
+		if !deleteTarget {
+			state.Stale = true
+			err = es.saveMigrationState(client, plan.NewIndex, state)
+			if err != nil {
+				log.WithError(err).WithField("index", plan.NewIndex).Error("unable to mark index of stopped migration as stale")
+			}
+		}
+	}
+
+	if canary := es.canaryAlias(); len(canary) > 0 {
+		_, err := client.Alias().Remove(plan.NewIndex, canary).Do(context.Background())
+		if err != nil && !elastic.IsNotFound(err) {
+			log.WithError(err).WithField("alias", canary).Error("unable to remove canary alias after stopping migration")
+		}
+	}
+
+	if deleteTarget {
+		log.WithField("index", plan.NewIndex).Info("deleting index of cancelled migration")
+		_, err := client.DeleteIndex(plan.NewIndex).Do(context.Background())
+		if err != nil && !elastic.IsNotFound(err) {
+			log.WithError(err).WithField("index", plan.NewIndex).Error("unable to delete index of cancelled migration")
+		}
+	}
+}
+
+// cancelTask cancels a reindex task and waits for it to stop writing to the new index
+func (es *esService) cancelTask(client *elastic.Client, taskID string) error {
+	log.WithField("task", taskID).Info("cancelling reindex task")
+
+	_, err := client.PerformRequest(context.Background(), elastic.PerformRequestOptions{
+		Method: "POST",
+		Path:   fmt.Sprintf("/_tasks/%s/_cancel", taskID),
+	})
+	if err != nil {
+		return err
+	}
+
+	for i := 0; i < 30; i++ {
+		task, err := es.getReindexTask(client, taskID)
+		if err != nil {
+			return err
+		}
+		if task.Completed {
+			return nil
+		}
+		time.Sleep(time.Second)
+	}
+	return fmt.Errorf("reindex task %s did not stop after being cancelled", taskID)
+}
+
+// isReadOnly reports whether writes to the index are blocked
+func (es *esService) isReadOnly(client *elastic.Client, indexName string) (bool, error) {
+	settings, err := client.IndexGetSettings(indexName).FlatSettings(true).Do(context.Background())
+	if err != nil {
+		return false, err
+	}
+
+	index, found := settings[indexName]
+	if !found {
+		return false, nil
+	}
+	value, _ := index.Settings["index.blocks.write"].(string)
+	readOnly, _ := strconv.ParseBool(value)
+	return readOnly, nil
+}
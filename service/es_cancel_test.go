@@ -0,0 +1,51 @@
+package service
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCancelMigration(t *testing.T) {
+	es := &esService{}
+	es.newMigration("1.0.0", "")
+
+	assert.NoError(t, es.checkCancelled(), "expected no error before cancelling")
+
+	migration, err := es.CancelMigration(false)
+	require.NoError(t, err, "expected no error for cancelling migration")
+	assert.True(t, migration.Running(), "expected migration to run until it has stopped")
+	assert.ErrorIs(t, es.checkCancelled(), ErrMigrationCancelled, "expected cancelled migration to stop")
+	assert.False(t, es.cancelDeletesTarget(), "delete target")
+
+	_, err = es.CancelMigration(true)
+	assert.NoError(t, err, "expected no error for cancelling migration again")
+	assert.True(t, es.cancelDeletesTarget(), "delete target")
+
+	assert.ErrorIs(t, es.startAliasing(), ErrMigrationCancelled, "expected cancelled migration not to move the aliases")
+}
+
+func TestCancelMigrationNotRunning(t *testing.T) {
+	es := &esService{}
+
+	_, err := es.CancelMigration(false)
+	assert.ErrorIs(t, err, ErrNoMigrationRunning, "expected error without a migration")
+	assert.NoError(t, es.checkCancelled(), "expected no cancellation without a migration")
+
+	migration := es.newMigration("1.0.0", "")
+	migration.Phase = PhaseDone
+
+	_, err = es.CancelMigration(false)
+	assert.ErrorIs(t, err, ErrNoMigrationRunning, "expected error for a finished migration")
+}
+
+func TestCancelMigrationWhileAliasing(t *testing.T) {
+	es := &esService{}
+	es.newMigration("1.0.0", "")
+
+	require.NoError(t, es.startAliasing(), "expected no error for moving the aliases")
+
+	_, err := es.CancelMigration(false)
+	assert.ErrorIs(t, err, ErrMigrationAliasing, "expected error for cancelling while the aliases are moved")
+}
@@ -17,6 +17,8 @@ type EsAccessConfig struct {
 	endpoint     string
 	region       string
 	authType     string
+	username     string
+	password     string
 	traceLogging bool
 	awsCreds     *credentials.Credentials
 }
@@ -31,6 +33,19 @@ func NewAccessConfig(awsCreds *credentials.Credentials, region, endpoint, authTy
 	}
 }
 
+// WithBasicAuth sets the credentials for the basic auth type
+func (c EsAccessConfig) WithBasicAuth(username, password string) EsAccessConfig {
+	c.username = username
+	c.password = password
+	return c
+}
+
+// signsRequests reports whether requests to the cluster are signed with AWS credentials,
+// which a remote reindex from the cluster cannot do
+func (c EsAccessConfig) signsRequests() bool {
+	return c.authType != "local" && c.authType != "basic"
+}
+
 type awsSigningTransport struct {
 	httpClient  *http.Client
 	credentials *credentials.Credentials
@@ -92,10 +107,19 @@ func newClient(endpoint string, traceLogging bool, options ...elastic.ClientOpti
 	return elastic.NewClient(optionFuncs...)
 }
 
+func newBasicAuthClient(config EsAccessConfig) (*elastic.Client, error) {
+	return newClient(config.endpoint, config.traceLogging,
+		elastic.SetBasicAuth(config.username, config.password),
+	)
+}
+
 func NewElasticClient(config EsAccessConfig) (*elastic.Client, error) {
-	if config.authType == "local" {
+	switch config.authType {
+	case "local":
 		return newSimpleClient(config)
-	} else {
+	case "basic":
+		return newBasicAuthClient(config)
+	default:
 		return newAmazonClient(config)
 	}
 }
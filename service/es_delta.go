@@ -0,0 +1,242 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	log "github.com/Financial-Times/go-logger"
+	"github.com/olivere/elastic/v7"
+)
+
+const seqNoField = "_seq_no"
+
+// maxAggregationResponse is the subset of a search response with a max aggregation named checkpoint
+type maxAggregationResponse struct {
+	Shards struct {
+		Total int `json:"total"`
+	} `json:"_shards"`
+	Aggregations struct {
+		Checkpoint struct {
+			Value         *float64 `json:"value"`
+			ValueAsString string   `json:"value_as_string"`
+		} `json:"checkpoint"`
+	} `json:"aggregations"`
+}
+
+// reindexWithCatchUp copies the documents while the current index stays writable, then copies the documents written
+// in the meantime in catch-up passes, leaving the final pass to finishCatchUp.
+// Documents deleted from the current index while the migration runs are not deleted from the new index.
+func (es *esService) reindexWithCatchUp(client *elastic.Client, fromIndex string, toIndex string, state *migrationState, transform *reindexTransform) error {
+	if len(state.Task) == 0 {
+		checkpoint, err := es.deltaCheckpoint(client, fromIndex)
+		if err != nil {
+			log.WithError(err).Error("unable to read reindex checkpoint")
+			return err
+		}
+		state.Checkpoint = checkpoint
+	}
+
+	taskID, completeCount, err := es.startOrResumeReindex(client, fromIndex, toIndex, state, transform)
+	if err != nil {
+		log.WithError(err).Error("failed to begin reindex")
+		return err
+	}
+
+	err = es.waitForReindex(client, taskID, "initial copy", completeCount)
+	if err != nil {
+		return err
+	}
+
+	for pass := 1; pass <= es.options.MaxDeltaPasses; pass++ {
+		if err := es.checkCancelled(); err != nil {
+			return err
+		}
+
+		outstanding, err := es.countDelta(client, fromIndex, state.Checkpoint)
+		if err != nil {
+			log.WithError(err).Error("unable to count documents for catch-up pass")
+			return err
+		}
+		if outstanding <= int64(es.options.FinalPassThreshold) {
+			break
+		}
+
+		next, err := es.deltaCheckpoint(client, fromIndex)
+		if err != nil {
+			log.WithError(err).Error("unable to read reindex checkpoint")
+			return err
+		}
+
+		err = es.reindexDelta(client, fromIndex, toIndex, state.Checkpoint, transform, fmt.Sprintf("catch-up pass %d", pass))
+		if err != nil {
+			return err
+		}
+
+		state.Checkpoint = next
+		err = es.saveMigrationState(client, toIndex, state)
+		if err != nil {
+			log.WithError(err).Error("unable to record reindex checkpoint")
+			return err
+		}
+	}
+	return nil
+}
+
+// finishCatchUp blocks writes to the source index, and copies the documents written since the last checkpoint in a final pass
+func (es *esService) finishCatchUp(client *elastic.Client, fromIndex string, toIndex string, state *migrationState, transform *reindexTransform) error {
+	if err := es.checkCancelled(); err != nil {
+		return err
+	}
+
+	es.setPhase(PhaseBlocking)
+	err := es.setReadOnly(client, fromIndex)
+	if err != nil {
+		log.WithError(err).Error("unable to set index read-only")
+		return err
+	}
+
+	return es.reindexDelta(client, fromIndex, toIndex, state.Checkpoint, transform, "final catch-up pass")
+}
+
+// reindexDelta copies the documents written to the source index since the checkpoint, overwriting older copies in the destination
+func (es *esService) reindexDelta(client *elastic.Client, fromIndex string, toIndex string, checkpoint json.RawMessage, transform *reindexTransform, stage string) error {
+	count, err := es.countDelta(client, fromIndex, checkpoint)
+	if err != nil {
+		log.WithError(err).Error(fmt.Sprintf("unable to count documents for %s", stage))
+		return err
+	}
+
+	log.WithFields(map[string]interface{}{"from": fromIndex, "to": toIndex, "checkpoint": string(checkpoint), "documents": count}).Info(stage)
+	if count == 0 {
+		return nil
+	}
+
+	reindexService, err := es.newReindexService(client)
+	if err != nil {
+		return err
+	}
+
+	destination := elastic.NewReindexDestination().Index(toIndex)
+	transform.apply(reindexService, destination)
+
+	task, err := reindexService.
+		Source(es.newReindexSource(fromIndex).Query(es.deltaQuery(checkpoint))).
+		Destination(destination).
+		DoAsync(context.Background())
+	if err != nil {
+		log.WithError(err).Error(fmt.Sprintf("failed to begin %s", stage))
+		return err
+	}
+
+	return es.waitForReindex(client, task.TaskId, stage, int(count))
+}
+
+func (es *esService) countDelta(client *elastic.Client, indexName string, checkpoint json.RawMessage) (int64, error) {
+	_, err := client.Refresh(indexName).Do(context.Background())
+	if err != nil {
+		return 0, err
+	}
+
+	return elastic.NewCountService(client).Index(indexName).Query(es.deltaQuery(checkpoint)).Do(context.Background())
+}
+
+// deltaQuery matches the documents written since the checkpoint, or all documents if there is no checkpoint
+func (es *esService) deltaQuery(checkpoint json.RawMessage) elastic.Query {
+	if len(checkpoint) == 0 {
+		return elastic.NewMatchAllQuery()
+	}
+
+	field := es.deltaField()
+	if field == seqNoField {
+		return elastic.NewRangeQuery(field).Gt(checkpoint)
+	}
+	// several documents may share the checkpoint's timestamp, so they are copied again
+	return elastic.NewRangeQuery(field).Gte(checkpoint)
+}
+
+// deltaCheckpoint returns the highest value of the delta field in the index, or nil if the index has no documents with that field
+func (es *esService) deltaCheckpoint(client *elastic.Client, indexName string) (json.RawMessage, error) {
+	_, err := client.Refresh(indexName).Do(context.Background())
+	if err != nil {
+		return nil, err
+	}
+
+	field := es.deltaField()
+	result, err := es.maxFieldValue(client, indexName, field, "")
+	if err != nil || field != seqNoField {
+		return checkpointValue(result), err
+	}
+
+	// sequence numbers are assigned per shard, so the checkpoint is the lowest of the shards' highest sequence numbers
+	var lowest *float64
+	for shard := 0; shard < result.Shards.Total; shard++ {
+		shardResult, err := es.maxFieldValue(client, indexName, field, fmt.Sprintf("_shards:%d", shard))
+		if err != nil {
+			return nil, err
+		}
+
+		value := shardResult.Aggregations.Checkpoint.Value
+		if value == nil {
+			return nil, nil
+		}
+		if lowest == nil || *value < *lowest {
+			lowest = value
+		}
+	}
+
+	if lowest == nil {
+		return nil, nil
+	}
+	return json.RawMessage(strconv.FormatFloat(*lowest, 'f', -1, 64)), nil
+}
+
+func (es *esService) maxFieldValue(client *elastic.Client, indexName string, field string, preference string) (*maxAggregationResponse, error) {
+	params := map[string][]string{}
+	if len(preference) > 0 {
+		params["preference"] = []string{preference}
+	}
+
+	resp, err := client.PerformRequest(context.Background(), elastic.PerformRequestOptions{
+		Method: "POST",
+		Path:   fmt.Sprintf("/%s/_search", indexName),
+		Params: params,
+		Body: map[string]interface{}{
+			"size": 0,
+			"aggs": map[string]interface{}{
+				"checkpoint": map[string]interface{}{"max": map[string]interface{}{"field": field}},
+			},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	result := &maxAggregationResponse{}
+	if err := json.Unmarshal(resp.Body, result); err != nil {
+		return nil, fmt.Errorf("decoding highest %s of index %s: %w", field, indexName, err)
+	}
+	return result, nil
+}
+
+// checkpointValue prefers the formatted value, which a range query on a date field accepts whatever the field's format
+func checkpointValue(result *maxAggregationResponse) json.RawMessage {
+	if result == nil || result.Aggregations.Checkpoint.Value == nil {
+		return nil
+	}
+
+	checkpoint := result.Aggregations.Checkpoint
+	if len(checkpoint.ValueAsString) > 0 {
+		b, _ := json.Marshal(checkpoint.ValueAsString)
+		return b
+	}
+	return json.RawMessage(strconv.FormatFloat(*checkpoint.Value, 'f', -1, 64))
+}
+
+func (es *esService) deltaField() string {
+	if len(es.options.DeltaField) == 0 {
+		return seqNoField
+	}
+	return es.options.DeltaField
+}
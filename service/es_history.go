@@ -0,0 +1,302 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	log "github.com/Financial-Times/go-logger"
+	"github.com/olivere/elastic/v7"
+)
+
+// migrationsIndex records every migration attempt of every index managed by the reindexer, by migration ID.
+// It must not match <alias>-* so that it is never taken for a version of an index.
+const migrationsIndex = "elasticsearch-reindexer-migrations"
+
+// defaultMigrationsListSize is the number of migrations listed when no size is asked for
+const defaultMigrationsListSize = 20
+
+// errInterrupted is recorded as the error of a migration which stopped without finishing, when a later one resumes it
+const errInterrupted = "Migration was interrupted before it finished"
+
+// migrationsIndexBody only indexes the fields migrations are looked up by, the rest of each record is kept in its _source
+var migrationsIndexBody = map[string]interface{}{
+	"settings": map[string]interface{}{
+		"index.number_of_shards":     1,
+		"index.auto_expand_replicas": "0-1",
+		"index.hidden":               true,
+	},
+	"mappings": map[string]interface{}{
+		"dynamic": false,
+		"properties": map[string]interface{}{
+			"id":          map[string]interface{}{"type": "keyword"},
+			"alias":       map[string]interface{}{"type": "keyword"},
+			"version":     map[string]interface{}{"type": "keyword"},
+			"phase":       map[string]interface{}{"type": "keyword"},
+			"sourceIndex": map[string]interface{}{"type": "keyword"},
+			"targetIndex": map[string]interface{}{"type": "keyword"},
+			"startTime":   map[string]interface{}{"type": "date"},
+			"endTime":     map[string]interface{}{"type": "date"},
+		},
+	},
+}
+
+// ensureMigrationsIndex creates the migrations index unless it exists
+func (es *esService) ensureMigrationsIndex(client *elastic.Client) error {
+	es.RLock()
+	ready := es.historyIndexReady
+	es.RUnlock()
+	if ready {
+		return nil
+	}
+
+	if err := createSystemIndex(client, migrationsIndex, migrationsIndexBody); err != nil {
+		return err
+	}
+
+	es.Lock()
+	es.historyIndexReady = true
+	es.Unlock()
+	return nil
+}
+
+// createSystemIndex creates one of the reindexer's own indices unless it exists, which another reindexer may have just done
+func createSystemIndex(client *elastic.Client, indexName string, body map[string]interface{}) error {
+	exists, err := client.IndexExists(indexName).Do(context.Background())
+	if err != nil || exists {
+		return err
+	}
+
+	_, err = client.PerformRequest(context.Background(), elastic.PerformRequestOptions{
+		Method: "PUT",
+		Path:   "/" + indexName,
+		Body:   body,
+	})
+	var esErr *elastic.Error
+	if errors.As(err, &esErr) && esErr.Details != nil && esErr.Details.Type == "resource_already_exists_exception" {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("creating %s index: %w", indexName, err)
+	}
+	return nil
+}
+
+// recordMigration saves the running migration in the migrations index
+func (es *esService) recordMigration() {
+	es.RLock()
+	migration := es.currentMigration
+	running := migration != nil && migration.Running()
+	es.RUnlock()
+
+	if running {
+		es.recordMigrationOutcome(migration)
+	}
+}
+
+// recordMigrationOutcome saves a migration as it is now in the migrations index. The history is kept on a best-effort basis,
+// so a migration does not fail because it cannot be recorded.
+func (es *esService) recordMigrationOutcome(migration *Migration) {
+	es.RLock()
+	client := es.elasticClient
+	record := *migration
+	es.RUnlock()
+	if client == nil {
+		return
+	}
+
+	err := es.saveMigrationRecord(client, &record)
+	if err != nil {
+		log.WithError(err).WithFields(map[string]interface{}{"migration": record.ID, "phase": record.Phase}).Warn("unable to record migration history")
+	}
+}
+
+func (es *esService) saveMigrationRecord(client *elastic.Client, record *Migration) error {
+	if err := es.ensureMigrationsIndex(client); err != nil {
+		return err
+	}
+
+	_, err := client.Index().Index(migrationsIndex).Id(record.ID).BodyJson(record).Refresh("wait_for").Do(context.Background())
+	return err
+}
+
+// ListMigrations returns the most recent migration attempts of the index, most recent first, with the running one as it is now
+func (es *esService) ListMigrations(size int) ([]*Migration, error) {
+	client := es.esClient()
+	if client == nil {
+		return nil, ErrNoElasticClient
+	}
+	if size <= 0 {
+		size = defaultMigrationsListSize
+	}
+
+	migrations, err := es.searchMigrations(client, map[string]interface{}{"term": map[string]interface{}{"alias": es.aliasName}}, size)
+	if err != nil {
+		return nil, err
+	}
+
+	es.RLock()
+	defer es.RUnlock()
+	for i, migration := range migrations {
+		if running, found := es.migrations[migration.ID]; found {
+			current := *running
+			migrations[i] = &current
+		}
+	}
+	return migrations, nil
+}
+
+// searchMigrations returns the migrations of the migrations index matching the query, most recent first,
+// or none if no migration has been recorded yet
+func (es *esService) searchMigrations(client *elastic.Client, query map[string]interface{}, size int) ([]*Migration, error) {
+	resp, err := client.PerformRequest(context.Background(), elastic.PerformRequestOptions{
+		Method: "POST",
+		Path:   fmt.Sprintf("/%s/_search", migrationsIndex),
+		Body: map[string]interface{}{
+			"size":  size,
+			"query": query,
+			"sort":  []interface{}{map[string]interface{}{"startTime": "desc"}},
+		},
+	})
+	if elastic.IsNotFound(err) {
+		return []*Migration{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var result struct {
+		Hits struct {
+			Hits []struct {
+				Source json.RawMessage `json:"_source"`
+			} `json:"hits"`
+		} `json:"hits"`
+	}
+	if err := json.Unmarshal(resp.Body, &result); err != nil {
+		return nil, fmt.Errorf("decoding migrations: %w", err)
+	}
+
+	migrations := make([]*Migration, 0, len(result.Hits.Hits))
+	for _, hit := range result.Hits.Hits {
+		migration := &Migration{}
+		if err := json.Unmarshal(hit.Source, migration); err != nil {
+			return nil, fmt.Errorf("decoding migration: %w", err)
+		}
+		migrations = append(migrations, migration)
+	}
+	return migrations, nil
+}
+
+// getMigrationRecord returns a migration recorded in the migrations index, for migrations started before the service started
+func (es *esService) getMigrationRecord(client *elastic.Client, id string) (*Migration, error) {
+	migrations, err := es.searchMigrations(client, map[string]interface{}{
+		"bool": map[string]interface{}{
+			"filter": []interface{}{
+				map[string]interface{}{"term": map[string]interface{}{"id": id}},
+				map[string]interface{}{"term": map[string]interface{}{"alias": es.aliasName}},
+			},
+		},
+	}, 1)
+	if err != nil {
+		return nil, err
+	}
+	if len(migrations) == 0 {
+		return nil, ErrMigrationNotFound
+	}
+	return migrations[0], nil
+}
+
+// resumeMigrationHistory links the running migration to the unfinished attempts at building the index it resumes,
+// and records those as interrupted, since no other migration of the index can be running
+func (es *esService) resumeMigrationHistory(client *elastic.Client, targetIndex string) {
+	query := map[string]interface{}{
+		"bool": map[string]interface{}{
+			"filter": []interface{}{
+				map[string]interface{}{"term": map[string]interface{}{"alias": es.aliasName}},
+				map[string]interface{}{"term": map[string]interface{}{"targetIndex": targetIndex}},
+			},
+			"must_not": []interface{}{
+				map[string]interface{}{"terms": map[string]interface{}{"phase": []string{PhaseDone, PhaseFailed, PhaseCancelled}}},
+			},
+		},
+	}
+	interrupted, err := es.searchMigrations(client, query, defaultMigrationsListSize)
+	if err != nil {
+		log.WithError(err).WithField("index", targetIndex).Warn("unable to read migration history of resumed index")
+		return
+	}
+
+	current, _ := es.CurrentMigration()
+	for _, migration := range interrupted {
+		if current != nil && migration.ID == current.ID {
+			continue
+		}
+
+		log.WithFields(map[string]interface{}{"migration": migration.ID, "index": targetIndex}).Info("resuming interrupted migration")
+		end := time.Now().UTC()
+		migration.Phase = PhaseFailed
+		migration.EndTime = &end
+		migration.LastError = errInterrupted
+		if err := es.saveMigrationRecord(client, migration); err != nil {
+			log.WithError(err).WithField("migration", migration.ID).Warn("unable to record migration history")
+		}
+
+		es.updateMigration(func(m *Migration) {
+			if len(m.ResumedFrom) == 0 {
+				m.ResumedFrom = migration.ID
+			}
+		})
+	}
+}
+
+// lastMigrationTo returns the most recent successful migration which moved the aliases to the index from another one, if any
+func (es *esService) lastMigrationTo(client *elastic.Client, aliasName string, indexName string) (*Migration, error) {
+	migrations, err := es.searchMigrations(client, map[string]interface{}{
+		"bool": map[string]interface{}{
+			"filter": []interface{}{
+				map[string]interface{}{"term": map[string]interface{}{"alias": aliasName}},
+				map[string]interface{}{"term": map[string]interface{}{"targetIndex": indexName}},
+				map[string]interface{}{"term": map[string]interface{}{"phase": PhaseDone}},
+				map[string]interface{}{"exists": map[string]interface{}{"field": "sourceIndex"}},
+			},
+			// an in-place update keeps the aliases on the same index
+			"must_not": []interface{}{
+				map[string]interface{}{"term": map[string]interface{}{"sourceIndex": indexName}},
+			},
+		},
+	}, 1)
+	if err != nil || len(migrations) == 0 {
+		return nil, err
+	}
+	return migrations[0], nil
+}
+
+// stoppedMigrationTo returns the most recent earlier migration to the index if it failed or was cancelled, rather than being interrupted,
+// which means that the source index was made writable again after the migration began copying it
+func (es *esService) stoppedMigrationTo(client *elastic.Client, indexName string) (*Migration, error) {
+	mustNot := []interface{}{}
+	if current, _ := es.CurrentMigration(); current != nil {
+		mustNot = append(mustNot, map[string]interface{}{"term": map[string]interface{}{"id": current.ID}})
+	}
+
+	migrations, err := es.searchMigrations(client, map[string]interface{}{
+		"bool": map[string]interface{}{
+			"filter": []interface{}{
+				map[string]interface{}{"term": map[string]interface{}{"alias": es.aliasName}},
+				map[string]interface{}{"term": map[string]interface{}{"targetIndex": indexName}},
+			},
+			"must_not": mustNot,
+		},
+	}, 1)
+	if err != nil || len(migrations) == 0 {
+		return nil, err
+	}
+
+	migration := migrations[0]
+	if (migration.Phase != PhaseFailed && migration.Phase != PhaseCancelled) || migration.LastError == errInterrupted {
+		return nil, nil
+	}
+	return migration, nil
+}
@@ -0,0 +1,50 @@
+package service
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMigrationRecordsPlan(t *testing.T) {
+	es := &esService{aliasName: "concepts"}
+	migration := es.newMigration("1.0.0", "")
+	assert.Equal(t, "concepts", migration.Alias, "alias")
+
+	plan := &MigrationPlan{Alias: "concepts", CurrentIndex: "concepts-0.9.0", NewIndex: "concepts-1.0.0", InPlace: true}
+	es.setMigrationPlan(plan)
+	plan.InPlace = false
+
+	current, err := es.CurrentMigration()
+	require.NoError(t, err, "expected no error for getting current migration")
+	require.NotNil(t, current.Plan, "plan")
+	assert.True(t, current.Plan.InPlace, "the migration keeps its own copy of the plan")
+	assert.Equal(t, "concepts-1.0.0", current.Plan.NewIndex, "new index")
+}
+
+func TestGetMigrationNotRecorded(t *testing.T) {
+	es := &esService{aliasName: "concepts"}
+	es.newMigration("1.0.0", "")
+
+	_, err := es.GetMigration("unknown")
+	assert.ErrorIs(t, err, ErrMigrationNotFound, "expected error for a migration which is neither running nor recorded")
+}
+
+func TestListMigrationsHandler(t *testing.T) {
+	handler := NewAdminHandler(&esService{aliasName: "concepts"})
+
+	statuses := map[string]int{
+		"/migrations":         http.StatusServiceUnavailable,
+		"/migrations?size=5":  http.StatusServiceUnavailable,
+		"/migrations?size=0":  http.StatusBadRequest,
+		"/migrations?size=ab": http.StatusBadRequest,
+	}
+	for url, expected := range statuses {
+		w := httptest.NewRecorder()
+		handler.ListMigrations(w, httptest.NewRequest(http.MethodGet, url, nil))
+		assert.Equal(t, expected, w.Code, "status for %s", url)
+	}
+}
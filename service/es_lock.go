@@ -0,0 +1,307 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	log "github.com/Financial-Times/go-logger"
+	"github.com/olivere/elastic/v7"
+)
+
+var (
+	ErrMigrationLockLost = errors.New("Migration lock was lost to another instance")
+	ErrMigrationLocked   = errors.New("Index is being migrated by another instance")
+)
+
+// locksIndex holds the migration lock of each index managed by the reindexer, by alias
+const locksIndex = "elasticsearch-reindexer-locks"
+
+const defaultLockTTL = time.Minute
+
+var locksIndexBody = map[string]interface{}{
+	"settings": map[string]interface{}{
+		"index.number_of_shards":     1,
+		"index.auto_expand_replicas": "0-1",
+		"index.hidden":               true,
+	},
+	"mappings": map[string]interface{}{
+		"dynamic": false,
+		"properties": map[string]interface{}{
+			"owner":   map[string]interface{}{"type": "keyword"},
+			"alias":   map[string]interface{}{"type": "keyword"},
+			"expires": map[string]interface{}{"type": "date"},
+		},
+	},
+}
+
+// migrationLock is the lock document, which the instance migrating an index keeps extending until it has finished
+type migrationLock struct {
+	Owner     string    `json:"owner"`
+	Alias     string    `json:"alias"`
+	Migration string    `json:"migration,omitempty"`
+	Acquired  time.Time `json:"acquired"`
+	Expires   time.Time `json:"expires"`
+}
+
+// migrationLease is a migration lock held by this instance, at the version of the lock document it last wrote
+type migrationLease struct {
+	lock        migrationLock
+	seqNo       int64
+	primaryTerm int64
+	lost        chan struct{}
+	stop        chan struct{}
+	done        chan struct{}
+}
+
+// check returns ErrMigrationLockLost once another instance may have taken the lock over
+func (l *migrationLease) check() error {
+	select {
+	case <-l.lost:
+		return ErrMigrationLockLost
+	default:
+		return nil
+	}
+}
+
+func (es *esService) lockOwner() string {
+	if len(es.options.LockOwner) > 0 {
+		return es.options.LockOwner
+	}
+
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	return fmt.Sprintf("%s-%d", host, os.Getpid())
+}
+
+func (es *esService) lockTTL() time.Duration {
+	if es.options.LockTTL > 0 {
+		return es.options.LockTTL
+	}
+	return defaultLockTTL
+}
+
+// lockRenewInterval leaves time for two more heartbeats to fail before the lock expires
+func (es *esService) lockRenewInterval() time.Duration {
+	return es.lockTTL() / 3
+}
+
+// acquireMigrationLock waits until this instance holds the migration lock of the index, reporting the instance which holds it
+// in the migration health check meanwhile, and keeps the lock alive until it is released
+func (es *esService) acquireMigrationLock(client *elastic.Client) (*migrationLease, error) {
+	lastOwner := ""
+	for {
+		lease, owner, err := es.tryMigrationLock(client)
+		if err != nil {
+			log.WithError(err).Error("unable to acquire migration lock")
+			return nil, err
+		}
+		if lease != nil {
+			es.setMigrationLockedBy("")
+			es.holdMigrationLock(client, lease)
+			return lease, nil
+		}
+		// the lock was released between the attempts to create and to read it
+		if len(owner) == 0 {
+			continue
+		}
+
+		if owner != lastOwner {
+			log.WithFields(map[string]interface{}{"alias": es.aliasName, "owner": owner}).Info("waiting for migration owned by another instance")
+			lastOwner = owner
+		}
+		es.setProgress(fmt.Sprintf("migration owned by %s", owner))
+		es.setMigrationLockedBy(owner)
+
+		select {
+		case <-es.cancelSignal():
+			return nil, ErrMigrationCancelled
+		case <-time.After(es.lockRenewInterval()):
+		}
+	}
+}
+
+// lockIndexChange takes the migration lock for a change to the indices outside of a migration, such as a rollback,
+// failing rather than waiting if another instance holds it
+func (es *esService) lockIndexChange(client *elastic.Client) (*migrationLease, error) {
+	lease, owner, err := es.tryMigrationLock(client)
+	if err != nil {
+		log.WithError(err).Error("unable to acquire migration lock")
+		return nil, err
+	}
+	if lease == nil {
+		return nil, fmt.Errorf("%w: %s", ErrMigrationLocked, owner)
+	}
+	es.holdMigrationLock(client, lease)
+	return lease, nil
+}
+
+// holdMigrationLock keeps a lock which has just been acquired alive until it is released
+func (es *esService) holdMigrationLock(client *elastic.Client, lease *migrationLease) {
+	es.Lock()
+	es.lease = lease
+	es.Unlock()
+	go es.keepMigrationLock(client, lease)
+}
+
+// tryMigrationLock creates the lock, or takes it over if it has expired or was held by this instance before it restarted.
+// It returns the owner of the lock if another instance holds it.
+func (es *esService) tryMigrationLock(client *elastic.Client) (*migrationLease, string, error) {
+	es.RLock()
+	ready := es.locksIndexReady
+	es.RUnlock()
+	if !ready {
+		if err := createSystemIndex(client, locksIndex, locksIndexBody); err != nil {
+			return nil, "", err
+		}
+		es.Lock()
+		es.locksIndexReady = true
+		es.Unlock()
+	}
+
+	now := time.Now().UTC()
+	lock := migrationLock{Owner: es.lockOwner(), Alias: es.aliasName, Acquired: now, Expires: now.Add(es.lockTTL())}
+	if migration, err := es.CurrentMigration(); err == nil && migration.Running() {
+		lock.Migration = migration.ID
+	}
+
+	resp, err := client.Index().Index(locksIndex).Id(es.aliasName).OpType("create").BodyJson(lock).Do(context.Background())
+	if err == nil {
+		return newMigrationLease(lock, resp), "", nil
+	}
+	if !elastic.IsConflict(err) {
+		return nil, "", err
+	}
+
+	current, err := client.Get().Index(locksIndex).Id(es.aliasName).Do(context.Background())
+	if elastic.IsNotFound(err) {
+		return nil, "", nil
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	var held migrationLock
+	if err := json.Unmarshal(current.Source, &held); err != nil {
+		return nil, "", fmt.Errorf("decoding migration lock: %w", err)
+	}
+	if held.Owner != lock.Owner && now.Before(held.Expires) {
+		return nil, held.Owner, nil
+	}
+
+	log.WithFields(map[string]interface{}{"alias": es.aliasName, "owner": held.Owner, "expires": held.Expires}).Warn("taking over migration lock")
+	resp, err = client.Index().Index(locksIndex).Id(es.aliasName).IfSeqNo(*current.SeqNo).IfPrimaryTerm(*current.PrimaryTerm).BodyJson(lock).Do(context.Background())
+	// another instance took it over first
+	if elastic.IsConflict(err) {
+		return nil, held.Owner, nil
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	return newMigrationLease(lock, resp), "", nil
+}
+
+func newMigrationLease(lock migrationLock, resp *elastic.IndexResponse) *migrationLease {
+	return &migrationLease{
+		lock:        lock,
+		seqNo:       resp.SeqNo,
+		primaryTerm: resp.PrimaryTerm,
+		lost:        make(chan struct{}),
+		stop:        make(chan struct{}),
+		done:        make(chan struct{}),
+	}
+}
+
+// keepMigrationLock extends the lock until it is released. The lock is lost if another instance has changed it,
+// or if it could not be extended before it expired.
+func (es *esService) keepMigrationLock(client *elastic.Client, lease *migrationLease) {
+	defer close(lease.done)
+	ticker := time.NewTicker(es.lockRenewInterval())
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-lease.stop:
+			return
+		case <-ticker.C:
+		}
+
+		lock := lease.lock
+		lock.Expires = time.Now().UTC().Add(es.lockTTL())
+		resp, err := client.Index().Index(locksIndex).Id(es.aliasName).IfSeqNo(lease.seqNo).IfPrimaryTerm(lease.primaryTerm).BodyJson(lock).Do(context.Background())
+		if err == nil {
+			lease.lock = lock
+			lease.seqNo = resp.SeqNo
+			lease.primaryTerm = resp.PrimaryTerm
+			continue
+		}
+
+		if elastic.IsConflict(err) || elastic.IsNotFound(err) || time.Now().After(lease.lock.Expires) {
+			log.WithError(err).WithField("alias", es.aliasName).Error("migration lock was lost")
+			close(lease.lost)
+			return
+		}
+		log.WithError(err).WithField("alias", es.aliasName).Warn("unable to extend migration lock")
+	}
+}
+
+// releaseMigrationLock stops the heartbeat and deletes the lock, unless it has been lost
+func (es *esService) releaseMigrationLock(client *elastic.Client, lease *migrationLease) {
+	close(lease.stop)
+	<-lease.done
+	es.Lock()
+	es.lease = nil
+	es.Unlock()
+	if lease.check() != nil {
+		return
+	}
+
+	_, err := client.Delete().Index(locksIndex).Id(es.aliasName).IfSeqNo(lease.seqNo).IfPrimaryTerm(lease.primaryTerm).Do(context.Background())
+	if err != nil && !elastic.IsNotFound(err) && !elastic.IsConflict(err) {
+		log.WithError(err).WithField("alias", es.aliasName).Warn("unable to release migration lock, it will expire")
+	}
+}
+
+// lockLostSignal returns a channel which is closed when the migration lock held by this instance is lost,
+// or nil if it does not hold the lock
+func (es *esService) lockLostSignal() <-chan struct{} {
+	es.RLock()
+	defer es.RUnlock()
+
+	if es.lease == nil {
+		return nil
+	}
+	return es.lease.lost
+}
+
+// lockTakenOver reports whether another instance holds the lock this instance has lost. The lock is also lost when it could not be
+// extended before it expired, in which case no other instance may have taken it over and this one still has to clean up after itself.
+// The lock is taken to be held by another instance if it cannot be read.
+func (es *esService) lockTakenOver(client *elastic.Client, lease *migrationLease) bool {
+	current, err := client.Get().Index(locksIndex).Id(es.aliasName).Do(context.Background())
+	if elastic.IsNotFound(err) {
+		return false
+	}
+	if err != nil {
+		log.WithError(err).WithField("alias", es.aliasName).Error("unable to read migration lock")
+		return true
+	}
+
+	var held migrationLock
+	if err := json.Unmarshal(current.Source, &held); err != nil {
+		log.WithError(err).WithField("alias", es.aliasName).Error("unable to decode migration lock")
+		return true
+	}
+	return held.Owner != lease.lock.Owner && time.Now().Before(held.Expires)
+}
+
+// setMigrationLockedBy records the instance the running migration is waiting for, if any
+func (es *esService) setMigrationLockedBy(owner string) {
+	es.updateMigration(func(migration *Migration) {
+		migration.LockedBy = owner
+	})
+}
@@ -0,0 +1,65 @@
+package service
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/olivere/elastic/v7"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLockOwner(t *testing.T) {
+	es := &esService{options: MigrationOptions{LockOwner: "reindexer-1"}}
+	assert.Equal(t, "reindexer-1", es.lockOwner(), "configured lock owner")
+
+	host, _ := os.Hostname()
+	es = &esService{}
+	assert.Contains(t, es.lockOwner(), host, "default lock owner")
+	assert.Equal(t, es.lockOwner(), es.lockOwner(), "the default lock owner is the same for the life of the process")
+}
+
+func TestLockTTL(t *testing.T) {
+	es := &esService{}
+	assert.Equal(t, defaultLockTTL, es.lockTTL(), "default lock TTL")
+
+	es = &esService{options: MigrationOptions{LockTTL: 30 * time.Second}}
+	assert.Equal(t, 30*time.Second, es.lockTTL(), "configured lock TTL")
+	assert.Equal(t, 10*time.Second, es.lockRenewInterval(), "heartbeat interval")
+}
+
+func TestMigrationLeaseLost(t *testing.T) {
+	lease := newMigrationLease(migrationLock{Owner: "reindexer-1"}, &elastic.IndexResponse{SeqNo: 3, PrimaryTerm: 1})
+	assert.Equal(t, int64(3), lease.seqNo, "version of the lock document")
+	assert.NoError(t, lease.check(), "expected no error for a held lock")
+
+	close(lease.lost)
+	assert.ErrorIs(t, lease.check(), ErrMigrationLockLost, "expected error for a lost lock")
+}
+
+func TestMigrationLockedBy(t *testing.T) {
+	es := &esService{}
+	es.newMigration("1.0.0", "")
+
+	es.setMigrationLockedBy("reindexer-2")
+	current, _ := es.CurrentMigration()
+	assert.Equal(t, "reindexer-2", current.LockedBy, "instance the migration waits for")
+
+	es.setMigrationLockedBy("")
+	current, _ = es.CurrentMigration()
+	assert.Empty(t, current.LockedBy, "instance the migration waits for once it holds the lock")
+}
+
+func TestLockLostSignal(t *testing.T) {
+	es := &esService{}
+	assert.Nil(t, es.lockLostSignal(), "expected no signal without a lock")
+
+	lease := newMigrationLease(migrationLock{Owner: "reindexer-1"}, &elastic.IndexResponse{SeqNo: 3, PrimaryTerm: 1})
+	es.lease = lease
+	close(lease.lost)
+	select {
+	case <-es.lockLostSignal():
+	default:
+		assert.Fail(t, "expected signal once the lock is lost")
+	}
+}
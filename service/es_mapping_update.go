@@ -0,0 +1,201 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	log "github.com/Financial-Times/go-logger"
+	"github.com/google/uuid"
+	"github.com/olivere/elastic/v7"
+)
+
+// copiedSettings are the settings of the current index which its mappings can depend on, copied to the index an in-place update is checked on
+var copiedSettings = []string{"index.analysis.", "index.similarity.", "index.mapping."}
+
+// inPlaceMappingBody returns the mappings section of an index creation body, if it can be sent to the put-mapping API
+func inPlaceMappingBody(mapping string) (map[string]interface{}, bool) {
+	var index struct {
+		Mappings map[string]interface{} `json:"mappings"`
+	}
+	if err := json.Unmarshal([]byte(mapping), &index); err != nil {
+		return nil, false
+	}
+
+	if _, found := index.Mappings["properties"]; !found {
+		return nil, false
+	}
+	return index.Mappings, true
+}
+
+// updateMappingInPlace applies the settings changes and an additive mapping change to the current index, the mapping
+// with the put-mapping API, registering the new version in the same request, and points the aliases at it with the new alias filter.
+// The update is checked on a copy of the current index first, and only a rejection there makes the migration fall back to a reindex,
+// as the current index is then left as it was.
+func (es *esService) updateMappingInPlace(client *elastic.Client, plan *MigrationPlan) error {
+	log.WithFields(map[string]interface{}{"index": plan.CurrentIndex, "version": plan.IndexVersion}).Info("Updating index mapping in place")
+
+	body, previousVersion, err := es.inPlaceMappingUpdate(client, plan)
+	if err != nil {
+		return err
+	}
+
+	err = es.checkInPlaceUpdate(client, plan, body)
+	if err != nil {
+		return err
+	}
+
+	// settings go first, as the new fields may use new analysis components. They are put back if the update fails before the mapping is changed.
+	var previousSettings *SettingsUpdate
+	if plan.SettingsUpdate != nil {
+		previousSettings, err = es.previousSettings(client, plan.CurrentIndex, plan.SettingsUpdate)
+		if err != nil {
+			return err
+		}
+		err = es.updateSettingsInPlace(client, plan.CurrentIndex, plan.SettingsUpdate)
+		if err != nil {
+			es.restoreSettings(client, plan.CurrentIndex, previousSettings)
+			return fmt.Errorf("updating settings of %s after they were accepted on a copy of it: %v", plan.CurrentIndex, err)
+		}
+	}
+
+	_, err = client.PutMapping().Index(plan.CurrentIndex).BodyString(body).Do(context.Background())
+	if err != nil {
+		if previousSettings != nil {
+			es.restoreSettings(client, plan.CurrentIndex, previousSettings)
+		}
+		return fmt.Errorf("updating mapping of %s after it was accepted on a copy of it: %v", plan.CurrentIndex, err)
+	}
+
+	es.setPhase(PhaseAliasing)
+	// the aliases are updated in a single request, so that they either all have the new filter or are left as they were
+	aliasService := es.aliasActions(elastic.NewAliasService(client), es.aliasName, plan.aliasFilter, "", plan.CurrentIndex)
+	for _, alias := range es.unfilteredAliases() {
+		aliasService = es.aliasActions(aliasService, alias, "", "", plan.CurrentIndex)
+	}
+	_, err = aliasService.Do(context.Background())
+	if err != nil {
+		es.restoreIndexVersion(client, plan.CurrentIndex, previousVersion)
+		return err
+	}
+	return nil
+}
+
+// inPlaceMappingUpdate returns the put-mapping body of an in-place update, which registers the new version in the reindexer's
+// _meta entry, and the version registered on the current index before it
+func (es *esService) inPlaceMappingUpdate(client *elastic.Client, plan *MigrationPlan) (string, string, error) {
+	mappings, _ := inPlaceMappingBody(plan.mapping)
+
+	// a _meta object in the mapping file replaces the current one, so the reindexer's entry has to be carried over
+	meta, _ := mappings["_meta"].(map[string]interface{})
+	if meta == nil {
+		existing, err := es.indexMeta(client, plan.CurrentIndex)
+		if err != nil {
+			return "", "", err
+		}
+		meta = existing
+	}
+	reindexerMeta, err := es.reindexerMeta(client, plan.CurrentIndex)
+	if err != nil {
+		return "", "", err
+	}
+	previousVersion, _ := reindexerMeta["version"].(string)
+	reindexerMeta["version"] = plan.IndexVersion
+	meta[reindexerMetaKey] = reindexerMeta
+	mappings["_meta"] = meta
+
+	body, err := json.Marshal(mappings)
+	if err != nil {
+		return "", "", err
+	}
+	return string(body), previousVersion, nil
+}
+
+// checkInPlaceUpdate applies the settings changes and the mapping of an in-place update to a throwaway copy of the current index,
+// without its documents, so that an update the cluster rejects is found before the current index is changed
+func (es *esService) checkInPlaceUpdate(client *elastic.Client, plan *MigrationPlan, body string) error {
+	indexBody, err := es.copyIndexBody(client, plan.CurrentIndex)
+	if err != nil {
+		return err
+	}
+
+	indexName := validationIndexPrefix + uuid.NewString()
+	_, err = client.CreateIndex(indexName).BodyJson(indexBody).Do(context.Background())
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if _, err := client.DeleteIndex(indexName).Do(context.Background()); err != nil {
+			log.WithError(err).WithField("index", indexName).Warn("unable to delete in-place update validation index")
+		}
+	}()
+
+	if plan.SettingsUpdate != nil {
+		err = es.updateSettingsInPlace(client, indexName, plan.SettingsUpdate)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = client.PutMapping().Index(indexName).BodyString(body).Do(context.Background())
+	if elastic.IsStatusCode(err, http.StatusBadRequest) {
+		return fmt.Errorf("%w: %v", ErrMappingUpdateRejected, err)
+	}
+	return err
+}
+
+// copyIndexBody returns the index creation body of an empty copy of the index, with a single shard and no replicas
+func (es *esService) copyIndexBody(client *elastic.Client, indexName string) (map[string]interface{}, error) {
+	mappings, err := client.GetMapping().Index(indexName).Do(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	index, _ := mappings[indexName].(map[string]interface{})
+
+	settings, err := client.IndexGetSettings(indexName).FlatSettings(true).Do(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	copied := map[string]interface{}{"index.number_of_shards": 1, "index.number_of_replicas": 0}
+	if current, found := settings[indexName]; found {
+		for key, value := range current.Settings {
+			for _, prefix := range copiedSettings {
+				if strings.HasPrefix(key, prefix) {
+					copied[key] = value
+				}
+			}
+		}
+	}
+
+	return map[string]interface{}{"settings": copied, "mappings": index["mappings"]}, nil
+}
+
+// restoreIndexVersion puts back the version registered on the index before a failed in-place update,
+// so that the next migration does not take the index for up-to-date. The fields added by the update are kept, as they cannot be removed.
+func (es *esService) restoreIndexVersion(client *elastic.Client, indexName string, version string) {
+	reindexerMeta, err := es.reindexerMeta(client, indexName)
+	if err == nil {
+		if len(version) > 0 {
+			reindexerMeta["version"] = version
+		} else {
+			delete(reindexerMeta, "version")
+		}
+		err = es.putReindexerMeta(client, indexName, reindexerMeta)
+	}
+	if err != nil {
+		log.WithError(err).WithField("index", indexName).Error("unable to restore index version after failed in-place update")
+	}
+}
+
+// registeredIndexVersion returns the version recorded by an in-place mapping update, if there has been one
+func (es *esService) registeredIndexVersion(client *elastic.Client, indexName string) (string, error) {
+	meta, err := es.reindexerMeta(client, indexName)
+	if err != nil {
+		return "", err
+	}
+
+	version, _ := meta["version"].(string)
+	return version, nil
+}
@@ -0,0 +1,177 @@
+package service
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const metricsNamespace = "elasticsearch_reindexer"
+
+// migrationPhases are all the phases the phase gauge reports on, so that exactly one of them is set at a time
+var migrationPhases = []string{
+	PhasePlanning, PhaseCreating, PhaseSnapshotting, PhaseBlocking, PhaseReindexing, PhaseVerifying, PhaseReadyToPromote, PhaseAliasing, PhaseDone, PhaseFailed, PhaseCancelled,
+}
+
+// migrationMetrics are the Prometheus metrics of the migrations of an index, labelled with its alias.
+// All methods are safe to call on a nil value.
+type migrationMetrics struct {
+	registry      *prometheus.Registry
+	phase         *prometheus.GaugeVec
+	docsDone      prometheus.Gauge
+	docsTotal     prometheus.Gauge
+	docsPerSecond prometheus.Gauge
+	phaseDuration *prometheus.HistogramVec
+	failures      *prometheus.CounterVec
+}
+
+func newMigrationMetrics(aliasName string) *migrationMetrics {
+	labels := prometheus.Labels{"alias": aliasName}
+	m := &migrationMetrics{
+		registry: prometheus.NewRegistry(),
+		phase: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace:   metricsNamespace,
+			Name:        "migration_phase",
+			ConstLabels: labels,
+			Help:        "Phase of the running or last migration, 1 for the current phase and 0 for the others",
+		}, []string{"phase"}),
+		docsDone: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace:   metricsNamespace,
+			Name:        "migration_docs_reindexed",
+			ConstLabels: labels,
+			Help:        "Documents copied by the reindex in progress",
+		}),
+		docsTotal: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace:   metricsNamespace,
+			Name:        "migration_docs_total",
+			ConstLabels: labels,
+			Help:        "Documents to copy by the reindex in progress",
+		}),
+		docsPerSecond: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace:   metricsNamespace,
+			Name:        "migration_docs_per_second",
+			ConstLabels: labels,
+			Help:        "Rate of the reindex in progress",
+		}),
+		phaseDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace:   metricsNamespace,
+			Name:        "migration_phase_duration_seconds",
+			ConstLabels: labels,
+			Help:        "Time migrations spent in each phase",
+			Buckets:     prometheus.ExponentialBuckets(1, 4, 10),
+		}, []string{"phase"}),
+		failures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace:   metricsNamespace,
+			Name:        "migration_failures_total",
+			ConstLabels: labels,
+			Help:        "Migrations which failed, by the phase they failed in",
+		}, []string{"phase"}),
+	}
+
+	m.registry.MustRegister(m.phase, m.docsDone, m.docsTotal, m.docsPerSecond, m.phaseDuration, m.failures)
+	return m
+}
+
+// MetricsHandler serves the metrics in the Prometheus text format
+func (es *esService) MetricsHandler() http.Handler {
+	return metricsHandler(es, es)
+}
+
+// metricsHandler serves the metrics of the migrations of the indices, with the process metrics
+// and the results of the cluster checks of the service
+func metricsHandler(cluster *esService, indices ...*esService) http.Handler {
+	gatherers := prometheus.Gatherers{newClusterRegistry(cluster)}
+	for _, es := range indices {
+		gatherers = append(gatherers, es.metrics.registry)
+	}
+	return promhttp.HandlerFor(gatherers, promhttp.HandlerOpts{})
+}
+
+func newClusterRegistry(es *esService) *prometheus.Registry {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		&checksCollector{es: es},
+	)
+	return registry
+}
+
+// migrationStarted resets the metrics of the previous migration
+func (m *migrationMetrics) migrationStarted() {
+	if m == nil {
+		return
+	}
+	m.docsDone.Set(0)
+	m.docsTotal.Set(0)
+	m.docsPerSecond.Set(0)
+	m.setPhase(PhasePlanning)
+}
+
+// phaseFinished records how long a migration spent in a phase, and moves the phase gauge to the next one
+func (m *migrationMetrics) phaseFinished(phase string, duration time.Duration, next string) {
+	if m == nil {
+		return
+	}
+	m.phaseDuration.WithLabelValues(phase).Observe(duration.Seconds())
+	m.setPhase(next)
+}
+
+func (m *migrationMetrics) setPhase(phase string) {
+	for _, p := range migrationPhases {
+		value := 0.0
+		if p == phase {
+			value = 1
+		}
+		m.phase.WithLabelValues(p).Set(value)
+	}
+}
+
+func (m *migrationMetrics) migrationFailed(phase string) {
+	if m == nil {
+		return
+	}
+	m.failures.WithLabelValues(phase).Inc()
+}
+
+func (m *migrationMetrics) reindexProgress(done int, total int, docsPerSecond float64) {
+	if m == nil {
+		return
+	}
+	m.docsDone.Set(float64(done))
+	m.docsTotal.Set(float64(total))
+	m.docsPerSecond.Set(docsPerSecond)
+}
+
+// checksCollector reports the results of the cluster health and connectivity checks when the metrics are scraped
+type checksCollector struct {
+	es *esService
+}
+
+var checkUpDesc = prometheus.NewDesc(
+	prometheus.BuildFQName(metricsNamespace, "", "check_up"),
+	"Result of a health check, 1 if it passes and 0 if it fails",
+	[]string{"check"}, nil,
+)
+
+func (c *checksCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- checkUpDesc
+}
+
+func (c *checksCollector) Collect(ch chan<- prometheus.Metric) {
+	checks := map[string]func() (string, error){
+		"cluster_health": c.es.healthChecker,
+		"connectivity":   c.es.connectivityChecker,
+	}
+
+	for name, checker := range checks {
+		value := 1.0
+		if _, err := checker(); err != nil {
+			value = 0
+		}
+		ch <- prometheus.MustNewConstMetric(checkUpDesc, prometheus.GaugeValue, value, name)
+	}
+}
@@ -0,0 +1,110 @@
+package service
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMigrationMetrics(t *testing.T) {
+	es := newEsService("concepts", "", "", "", "1.0.0", "", "", MigrationOptions{})
+	es.Lock()
+	migration := es.newMigration("1.0.0", "")
+	es.Unlock()
+
+	es.setPhase(PhaseCreating)
+	es.startReindexProgress(1000)
+	es.reindexProgress(250)
+
+	metrics := gatherMetrics(t, es.metrics.registry)
+	assert.Equal(t, 1.0, phaseValue(metrics, PhaseReindexing), "reindexing phase")
+	assert.Equal(t, 0.0, phaseValue(metrics, PhaseCreating), "creating phase")
+	assert.Equal(t, 250.0, metrics["elasticsearch_reindexer_migration_docs_reindexed"].Metric[0].GetGauge().GetValue(), "documents reindexed")
+	assert.Equal(t, 1000.0, metrics["elasticsearch_reindexer_migration_docs_total"].Metric[0].GetGauge().GetValue(), "documents total")
+	assert.Equal(t, uint64(1), histogramCount(metrics, PhasePlanning), "planning phase durations")
+	assert.Equal(t, uint64(1), histogramCount(metrics, PhaseCreating), "creating phase durations")
+
+	es.Lock()
+	es.metrics.migrationFailed(migration.Phase)
+	es.enterPhase(migration, PhaseFailed)
+	es.Unlock()
+
+	metrics = gatherMetrics(t, es.metrics.registry)
+	assert.Equal(t, 1.0, phaseValue(metrics, PhaseFailed), "failed phase")
+	failures := metrics["elasticsearch_reindexer_migration_failures_total"]
+	require.NotNil(t, failures, "failures")
+	require.Len(t, failures.Metric, 1, "failures")
+	assert.Equal(t, "concepts", labelValue(failures.Metric[0], "alias"), "alias")
+	assert.Equal(t, PhaseReindexing, labelValue(failures.Metric[0], "phase"), "failed phase")
+	assert.Equal(t, 1.0, failures.Metric[0].GetCounter().GetValue(), "failures")
+}
+
+func TestMigrationMetricsChecks(t *testing.T) {
+	es := newEsService("concepts", "", "", "", "1.0.0", "", "", MigrationOptions{})
+
+	metrics := gatherMetrics(t, newClusterRegistry(es))
+	checks := metrics["elasticsearch_reindexer_check_up"]
+	require.NotNil(t, checks, "checks")
+	assert.Len(t, checks.Metric, 2, "checks")
+	for _, m := range checks.Metric {
+		assert.Equal(t, 0.0, m.GetGauge().GetValue(), "expected check %s to fail without a client", labelValue(m, "check"))
+	}
+}
+
+func TestMigrationMetricsNil(t *testing.T) {
+	es := &esService{}
+	migration := es.newMigration("1.0.0", "")
+
+	es.setPhase(PhaseCreating)
+	es.startReindexProgress(10)
+	es.reindexProgress(5)
+	es.recordMigrationError(errors.New("recovered"))
+
+	assert.Equal(t, PhaseReindexing, migration.Phase, "phase")
+}
+
+func gatherMetrics(t *testing.T, gatherer prometheus.Gatherer) map[string]*dto.MetricFamily {
+	families, err := gatherer.Gather()
+	require.NoError(t, err, "expected no error for gathering metrics")
+
+	metrics := map[string]*dto.MetricFamily{}
+	for _, family := range families {
+		metrics[family.GetName()] = family
+	}
+	return metrics
+}
+
+func phaseValue(metrics map[string]*dto.MetricFamily, phase string) float64 {
+	for _, m := range metrics["elasticsearch_reindexer_migration_phase"].Metric {
+		if labelValue(m, "phase") == phase {
+			return m.GetGauge().GetValue()
+		}
+	}
+	return -1
+}
+
+func histogramCount(metrics map[string]*dto.MetricFamily, phase string) uint64 {
+	family, found := metrics["elasticsearch_reindexer_migration_phase_duration_seconds"]
+	if !found {
+		return 0
+	}
+	for _, m := range family.Metric {
+		if labelValue(m, "phase") == phase {
+			return m.GetHistogram().GetSampleCount()
+		}
+	}
+	return 0
+}
+
+func labelValue(m *dto.Metric, name string) string {
+	for _, label := range m.Label {
+		if label.GetName() == name {
+			return label.GetValue()
+		}
+	}
+	return ""
+}
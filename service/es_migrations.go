@@ -0,0 +1,385 @@
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"time"
+
+	log "github.com/Financial-Times/go-logger"
+	"github.com/google/uuid"
+)
+
+var (
+	ErrMigrationNotFound = errors.New("Migration not found")
+	ErrInvalidMapping    = errors.New("Mapping is not valid JSON")
+	ErrInvalidVersion    = errors.New("Index version may only contain lowercase letters, digits, '.', '_', '+' and '-'")
+)
+
+// versionPattern is what an index version may contain, as it is part of the index name and of the uploaded mapping file name
+var versionPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9._+-]*$`)
+
+// migration phases
+const (
+	PhasePlanning       = "planning"
+	PhaseCreating       = "creating"
+	PhaseSnapshotting   = "snapshotting"
+	PhaseBlocking       = "blocking"
+	PhaseReindexing     = "reindexing"
+	PhaseVerifying      = "verifying"
+	PhaseReadyToPromote = "ready-to-promote"
+	PhaseAliasing       = "aliasing"
+	PhaseDone           = "done"
+	PhaseFailed         = "failed"
+	PhaseCancelled      = "cancelled"
+)
+
+// MigrationRequest asks for a migration to a mapping version, with the bundled mapping file unless a mapping is uploaded
+type MigrationRequest struct {
+	Version string          `json:"version"`
+	Mapping json.RawMessage `json:"mapping,omitempty"`
+}
+
+// Migration is a run of MigrateIndex, started on connection to the cluster or on demand
+type Migration struct {
+	ID                string              `json:"id"`
+	Alias             string              `json:"alias"`
+	Version           string              `json:"version"`
+	Phase             string              `json:"phase"`
+	SourceIndex       string              `json:"sourceIndex,omitempty"`
+	TargetIndex       string              `json:"targetIndex,omitempty"`
+	ResumedFrom       string              `json:"resumedFrom,omitempty"`
+	LockedBy          string              `json:"lockedBy,omitempty"`
+	Plan              *MigrationPlan      `json:"plan,omitempty"`
+	Snapshot          string              `json:"snapshot,omitempty"`
+	Verification      *VerificationResult `json:"verification,omitempty"`
+	SmokeTests        []SmokeTestResult   `json:"smokeTests,omitempty"`
+	CanaryAlias       string              `json:"canaryAlias,omitempty"`
+	PromotionDeadline *time.Time          `json:"promotionDeadline,omitempty"`
+	DocsDone          int                 `json:"docsDone"`
+	DocsTotal         int                 `json:"docsTotal"`
+	DocsPerSecond     float64             `json:"docsPerSecond"`
+	ETA               *time.Time          `json:"eta,omitempty"`
+	StartTime         time.Time           `json:"startTime"`
+	EndTime           *time.Time          `json:"endTime,omitempty"`
+	LastError         string              `json:"lastError,omitempty"`
+
+	reindexStart time.Time
+	phaseStart   time.Time
+	cancel       chan struct{}
+	promote      chan struct{}
+	deleteTarget bool
+	mappingFile  string
+	// uploadedMapping is set when the mapping file was saved from the request, and is deleted unless the migration succeeds
+	uploadedMapping bool
+}
+
+// Running reports whether the migration has not finished yet
+func (m *Migration) Running() bool {
+	return m.Phase != PhaseDone && m.Phase != PhaseFailed && m.Phase != PhaseCancelled
+}
+
+type EsMigrationService interface {
+	StartMigration(request MigrationRequest) (*Migration, error)
+	GetMigration(id string) (*Migration, error)
+	CurrentMigration() (*Migration, error)
+	ListMigrations(size int) ([]*Migration, error)
+}
+
+// StartMigration migrates the index to the requested version in the background, unless a migration is already running.
+// The requested version and mapping become the ones the service checks the index against once the migration succeeds.
+func (es *esService) StartMigration(request MigrationRequest) (*Migration, error) {
+	if len(request.Version) == 0 {
+		return nil, ErrNoIndexVersion
+	}
+	if !versionPattern.MatchString(request.Version) {
+		return nil, ErrInvalidVersion
+	}
+
+	if es.esClient() == nil {
+		return nil, ErrNoElasticClient
+	}
+
+	// the migration is reserved before the uploaded mapping is saved, so that a rejected request leaves no file behind
+	es.Lock()
+	if !es.migrationCheck {
+		es.Unlock()
+		return nil, ErrMigrationRunning
+	}
+	es.migrationCheck = false
+	mappingFile := es.mappingFile
+	es.Unlock()
+
+	uploaded := len(request.Mapping) > 0
+	if uploaded {
+		var err error
+		mappingFile, err = es.saveUploadedMapping(request.Version, request.Mapping)
+		if err != nil {
+			es.Lock()
+			es.migrationCheck = true
+			es.Unlock()
+			return nil, err
+		}
+	}
+
+	es.Lock()
+	es.migrationErr = nil
+	es.progress = "not started"
+	migration := es.newMigration(request.Version, mappingFile)
+	migration.uploadedMapping = uploaded
+	es.Unlock()
+
+	log.WithFields(map[string]interface{}{"migration": migration.ID, "version": request.Version, "mapping": mappingFile}).Info("starting index migration")
+	go es.runMigration(migration)
+
+	return es.GetMigration(migration.ID)
+}
+
+// GetMigration returns a snapshot of a migration started since the service started, or its record in the migrations index otherwise
+func (es *esService) GetMigration(id string) (*Migration, error) {
+	es.RLock()
+	migration, found := es.migrations[id]
+	var result Migration
+	if found {
+		result = *migration
+	}
+	client := es.elasticClient
+	es.RUnlock()
+
+	if found {
+		return &result, nil
+	}
+	if client == nil {
+		return nil, ErrMigrationNotFound
+	}
+	return es.getMigrationRecord(client, id)
+}
+
+// CurrentMigration returns a snapshot of the running migration, or of the last one if none is running
+func (es *esService) CurrentMigration() (*Migration, error) {
+	es.RLock()
+	defer es.RUnlock()
+
+	if es.currentMigration == nil {
+		return nil, ErrMigrationNotFound
+	}
+
+	result := *es.currentMigration
+	return &result, nil
+}
+
+// runMigration runs MigrateIndex and records its outcome in the migration and the health checks
+func (es *esService) runMigration(migration *Migration) {
+	es.recordMigrationOutcome(migration)
+	// runs once the outcome is recorded and the lock released
+	defer es.recordMigrationOutcome(migration)
+
+	err := es.MigrateIndex()
+	if err == nil && es.options.Retention.enabled() {
+		es.retainAfterMigration()
+	}
+
+	es.Lock()
+	defer es.Unlock()
+
+	end := time.Now().UTC()
+	migration.EndTime = &end
+	migration.ETA = nil
+	switch {
+	case err == nil:
+		es.enterPhase(migration, PhaseDone)
+		es.indexVersion = migration.Version
+		es.mappingFile = migration.mappingFile
+	case errors.Is(err, ErrMigrationCancelled):
+		es.enterPhase(migration, PhaseCancelled)
+	default:
+		es.metrics.migrationFailed(migration.Phase)
+		es.enterPhase(migration, PhaseFailed)
+		migration.LastError = err.Error()
+	}
+	// the version and mapping file the index is checked against stay the previous ones unless the migration succeeds
+	if err != nil && migration.uploadedMapping {
+		removeUploadedMapping(migration.mappingFile)
+	}
+
+	es.migrationErr = err
+	es.migrationCheck = true
+}
+
+// newMigration records a running migration to a version and mapping file, the caller must hold the lock
+func (es *esService) newMigration(version string, mappingFile string) *Migration {
+	migration := &Migration{
+		ID:          uuid.NewString(),
+		Alias:       es.aliasName,
+		Version:     version,
+		Phase:       PhasePlanning,
+		StartTime:   time.Now().UTC(),
+		cancel:      make(chan struct{}),
+		promote:     make(chan struct{}),
+		mappingFile: mappingFile,
+	}
+	migration.phaseStart = migration.StartTime
+	es.metrics.migrationStarted()
+
+	if es.migrations == nil {
+		es.migrations = map[string]*Migration{}
+	}
+	es.migrations[migration.ID] = migration
+	es.currentMigration = migration
+	return migration
+}
+
+// migrationTarget returns the version and mapping file the running migration migrates the index to,
+// or the ones the index was last migrated to if no migration is running
+func (es *esService) migrationTarget() (string, string) {
+	es.RLock()
+	defer es.RUnlock()
+
+	if es.currentMigration != nil && es.currentMigration.Running() {
+		return es.currentMigration.Version, es.currentMigration.mappingFile
+	}
+	return es.indexVersion, es.mappingFile
+}
+
+// setProgress records what the running migration is doing, for the mappings health check
+func (es *esService) setProgress(progress string) {
+	es.Lock()
+	defer es.Unlock()
+
+	es.progress = progress
+}
+
+// updateMigration changes the running migration, if MigrateIndex was started as one
+func (es *esService) updateMigration(update func(migration *Migration)) {
+	es.Lock()
+	defer es.Unlock()
+
+	if es.currentMigration != nil && es.currentMigration.Running() {
+		update(es.currentMigration)
+	}
+}
+
+func (es *esService) setPhase(phase string) {
+	es.updateMigration(func(migration *Migration) {
+		es.enterPhase(migration, phase)
+	})
+	es.recordMigration()
+}
+
+// enterPhase moves the migration to a phase, recording how long it spent in the previous one. The caller must hold the lock.
+func (es *esService) enterPhase(migration *Migration, phase string) {
+	if migration.Phase == phase {
+		return
+	}
+
+	now := time.Now()
+	es.metrics.phaseFinished(migration.Phase, now.Sub(migration.phaseStart), phase)
+	migration.Phase = phase
+	migration.phaseStart = now
+}
+
+func (es *esService) setMigrationIndices(sourceIndex string, targetIndex string) {
+	es.updateMigration(func(migration *Migration) {
+		migration.SourceIndex = sourceIndex
+		migration.TargetIndex = targetIndex
+	})
+}
+
+// setMigrationPlan records what the migration does, which changes if an in-place update falls back to a reindex
+func (es *esService) setMigrationPlan(plan *MigrationPlan) {
+	es.updateMigration(func(migration *Migration) {
+		p := *plan
+		migration.Plan = &p
+	})
+}
+
+func (es *esService) setMigrationSnapshot(snapshot string) {
+	es.updateMigration(func(migration *Migration) {
+		migration.Snapshot = snapshot
+	})
+}
+
+func (es *esService) setMigrationVerification(result *VerificationResult) {
+	es.updateMigration(func(migration *Migration) {
+		verification := *result
+		migration.Verification = &verification
+	})
+}
+
+func (es *esService) setMigrationSmokeTests(results []SmokeTestResult) {
+	es.updateMigration(func(migration *Migration) {
+		migration.SmokeTests = results
+	})
+}
+
+// startReindexProgress resets the progress of the running migration for a reindex of total documents
+func (es *esService) startReindexProgress(total int) {
+	es.updateMigration(func(migration *Migration) {
+		es.enterPhase(migration, PhaseReindexing)
+		migration.DocsDone = 0
+		migration.DocsTotal = total
+		migration.DocsPerSecond = 0
+		migration.ETA = nil
+		migration.reindexStart = time.Now()
+		es.metrics.reindexProgress(0, total, 0)
+	})
+	es.recordMigration()
+}
+
+// reindexProgress records the documents reindexed so far, and estimates when the reindex will finish from its rate
+func (es *esService) reindexProgress(done int) {
+	es.updateMigration(func(migration *Migration) {
+		migration.DocsDone = done
+		defer func() {
+			es.metrics.reindexProgress(migration.DocsDone, migration.DocsTotal, migration.DocsPerSecond)
+		}()
+
+		elapsed := time.Since(migration.reindexStart).Seconds()
+		if elapsed <= 0 || done == 0 {
+			return
+		}
+		migration.DocsPerSecond = float64(done) / elapsed
+
+		remaining := migration.DocsTotal - done
+		if remaining < 0 {
+			remaining = 0
+		}
+		eta := time.Now().UTC().Add(time.Duration(float64(remaining) / migration.DocsPerSecond * float64(time.Second)))
+		migration.ETA = &eta
+	})
+}
+
+// recordMigrationError keeps an error the migration recovered from, which is replaced by the error it failed with, if any
+func (es *esService) recordMigrationError(err error) {
+	es.updateMigration(func(migration *Migration) {
+		migration.LastError = err.Error()
+	})
+}
+
+// saveUploadedMapping keeps an uploaded mapping in a new temporary file, which is used like the bundled one once the migration succeeds
+func (es *esService) saveUploadedMapping(version string, mapping json.RawMessage) (string, error) {
+	if !json.Valid(mapping) {
+		return "", ErrInvalidMapping
+	}
+
+	file, err := os.CreateTemp("", fmt.Sprintf("%s-%s-*-mapping.json", es.aliasName, version))
+	if err != nil {
+		return "", fmt.Errorf("saving uploaded mapping: %w", err)
+	}
+	defer file.Close()
+
+	if _, err := file.Write(mapping); err != nil {
+		removeUploadedMapping(file.Name())
+		return "", fmt.Errorf("saving uploaded mapping: %w", err)
+	}
+	return file.Name(), nil
+}
+
+// removeUploadedMapping deletes the file an uploaded mapping was saved to, once no migration uses it
+func removeUploadedMapping(mappingFile string) {
+	if err := os.Remove(mappingFile); err != nil && !os.IsNotExist(err) {
+		log.WithError(err).WithField("file", mappingFile).Warn("unable to delete uploaded mapping")
+	}
+}
@@ -0,0 +1,130 @@
+package service
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/olivere/elastic/v7"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMigrationProgress(t *testing.T) {
+	es := &esService{}
+	migration := es.newMigration("1.0.0", "")
+	assert.Equal(t, PhasePlanning, migration.Phase, "initial phase")
+
+	es.setMigrationIndices("concepts-0.9.0", "concepts-1.0.0")
+	es.startReindexProgress(1000)
+	migration.reindexStart = time.Now().Add(-10 * time.Second)
+	es.reindexProgress(250)
+
+	current, err := es.CurrentMigration()
+	require.NoError(t, err, "expected no error for getting current migration")
+	assert.Equal(t, PhaseReindexing, current.Phase, "phase")
+	assert.Equal(t, "concepts-0.9.0", current.SourceIndex, "source index")
+	assert.Equal(t, "concepts-1.0.0", current.TargetIndex, "target index")
+	assert.Equal(t, 250, current.DocsDone, "documents done")
+	assert.Equal(t, 1000, current.DocsTotal, "documents total")
+	assert.InDelta(t, 25, current.DocsPerSecond, 1, "documents per second")
+	require.NotNil(t, current.ETA, "ETA")
+	assert.WithinDuration(t, time.Now().Add(30*time.Second), *current.ETA, 3*time.Second, "ETA")
+}
+
+func TestMigrationFinishedIsNotUpdated(t *testing.T) {
+	es := &esService{}
+	migration := es.newMigration("1.0.0", "")
+	migration.Phase = PhaseFailed
+	migration.LastError = "failed"
+
+	es.setPhase(PhaseAliasing)
+	es.recordMigrationError(errors.New("later"))
+
+	current, err := es.CurrentMigration()
+	require.NoError(t, err, "expected no error for getting current migration")
+	assert.Equal(t, PhaseFailed, current.Phase, "phase")
+	assert.Equal(t, "failed", current.LastError, "last error")
+	assert.False(t, current.Running(), "running")
+}
+
+func TestCurrentMigrationNone(t *testing.T) {
+	es := &esService{}
+
+	_, err := es.CurrentMigration()
+	assert.ErrorIs(t, err, ErrMigrationNotFound, "expected error without a migration")
+}
+
+func TestMigrationTarget(t *testing.T) {
+	es := &esService{indexVersion: "1.0.0", mappingFile: "mapping.json"}
+	migration := es.newMigration("2.0.0", "uploaded-mapping.json")
+
+	version, mappingFile := es.migrationTarget()
+	assert.Equal(t, "2.0.0", version, "version of the running migration")
+	assert.Equal(t, "uploaded-mapping.json", mappingFile, "mapping file of the running migration")
+
+	// without a client to the cluster the migration fails
+	es.runMigration(migration)
+	assert.Equal(t, PhaseFailed, migration.Phase, "phase")
+	version, mappingFile = es.migrationTarget()
+	assert.Equal(t, "1.0.0", version, "version after a failed migration")
+	assert.Equal(t, "mapping.json", mappingFile, "mapping file after a failed migration")
+}
+
+func TestStartMigrationInvalidVersion(t *testing.T) {
+	es := &esService{aliasName: "concepts"}
+
+	for _, version := range []string{"../../etc/cron.d/job", "1.0.0/x", "Upper", "-1.0.0"} {
+		_, err := es.StartMigration(MigrationRequest{Version: version, Mapping: []byte(`{}`)})
+		assert.ErrorIs(t, err, ErrInvalidVersion, "expected error for version %s", version)
+	}
+}
+
+func TestSaveUploadedMapping(t *testing.T) {
+	es := &esService{aliasName: "concepts"}
+
+	mappingFile, err := es.saveUploadedMapping("2.0.0", []byte(`{"mappings":{}}`))
+	require.NoError(t, err, "expected no error for saving a mapping")
+	defer os.Remove(mappingFile)
+	assert.Equal(t, os.TempDir(), filepath.Dir(mappingFile), "directory of the mapping file")
+
+	another, err := es.saveUploadedMapping("2.0.0", []byte(`{"mappings":{}}`))
+	require.NoError(t, err, "expected no error for saving a mapping")
+	defer os.Remove(another)
+	assert.NotEqual(t, mappingFile, another, "a mapping never overwrites another one")
+
+	_, err = es.saveUploadedMapping("2.0.0", []byte(`{`))
+	assert.ErrorIs(t, err, ErrInvalidMapping, "expected error for invalid JSON")
+}
+
+func TestStartMigrationWhileRunningSavesNoMapping(t *testing.T) {
+	client, err := elastic.NewSimpleClient(elastic.SetURL("http://localhost:9200"))
+	require.NoError(t, err, "expected no error for creating client")
+	es := &esService{aliasName: "concepts-" + uuid.NewString(), elasticClient: client}
+
+	_, err = es.StartMigration(MigrationRequest{Version: "2.0.0", Mapping: []byte(`{"mappings":{}}`)})
+	assert.ErrorIs(t, err, ErrMigrationRunning, "expected error while a migration is running")
+
+	files, err := filepath.Glob(filepath.Join(os.TempDir(), es.aliasName+"-*"))
+	require.NoError(t, err, "expected no error for listing mapping files")
+	assert.Empty(t, files, "expected no uploaded mapping to be saved")
+}
+
+func TestFailedMigrationRemovesUploadedMapping(t *testing.T) {
+	es := &esService{aliasName: "concepts", indexVersion: "1.0.0", mappingFile: "mapping.json"}
+	mappingFile, err := es.saveUploadedMapping("2.0.0", []byte(`{"mappings":{}}`))
+	require.NoError(t, err, "expected no error for saving a mapping")
+	defer os.Remove(mappingFile)
+
+	migration := es.newMigration("2.0.0", mappingFile)
+	migration.uploadedMapping = true
+	// without a client to the cluster the migration fails
+	es.runMigration(migration)
+	assert.Equal(t, PhaseFailed, migration.Phase, "phase")
+
+	_, err = os.Stat(mappingFile)
+	assert.True(t, os.IsNotExist(err), "expected the uploaded mapping to be deleted")
+}
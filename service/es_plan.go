@@ -0,0 +1,361 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	log "github.com/Financial-Times/go-logger"
+	"github.com/olivere/elastic/v7"
+)
+
+// MigrationPlan describes what MigrateIndex would do, as established by its read-only steps
+type MigrationPlan struct {
+	Alias           string          `json:"alias"`
+	IndexVersion    string          `json:"indexVersion"`
+	ClusterHealth   string          `json:"clusterHealth"`
+	CurrentIndex    string          `json:"currentIndex,omitempty"`
+	SourceCluster   string          `json:"sourceCluster,omitempty"`
+	SourceIndex     string          `json:"sourceIndex,omitempty"`
+	NewIndex        string          `json:"newIndex"`
+	UpdateRequired  bool            `json:"updateRequired"`
+	RolledBack      bool            `json:"rolledBack"`
+	InPlace         bool            `json:"inPlace"`
+	Resume          bool            `json:"resume"`
+	ReindexRequired bool            `json:"reindexRequired"`
+	DocumentCount   int64           `json:"documentCount"`
+	ReadOnlyIndex   string          `json:"readOnlyIndex,omitempty"`
+	DeltaField      string          `json:"deltaField,omitempty"`
+	Transform       string          `json:"transform,omitempty"`
+	AliasChanges    []AliasChange   `json:"aliasChanges,omitempty"`
+	MappingDiff     *MappingDiff    `json:"mappingDiff,omitempty"`
+	SettingsUpdate  *SettingsUpdate `json:"settingsUpdate,omitempty"`
+
+	mapping       string
+	aliasFilter   string
+	requiredIndex string
+	transform     *reindexTransform
+}
+
+type AliasChange struct {
+	Alias  string          `json:"alias"`
+	From   string          `json:"from,omitempty"`
+	To     string          `json:"to"`
+	Filter json.RawMessage `json:"filter,omitempty"`
+}
+
+type EsPlanService interface {
+	PlanMigration() (*MigrationPlan, error)
+}
+
+// PlanMigration runs every read-only step of MigrateIndex and reports what the migration would change, without changing anything
+func (es *esService) PlanMigration() (*MigrationPlan, error) {
+	if indexVersion, _ := es.migrationTarget(); len(indexVersion) == 0 {
+		return nil, ErrNoIndexVersion
+	}
+
+	client := es.esClient()
+	if client == nil {
+		return nil, ErrNoElasticClient
+	}
+
+	plan, err := es.planMigration(client)
+	if err != nil {
+		return nil, err
+	}
+
+	health, err := es.healthChecker()
+	if err != nil {
+		health = fmt.Sprintf("%s (%s)", health, err)
+	}
+	plan.ClusterHealth = health
+
+	return plan, nil
+}
+
+func (es *esService) planMigration(client *elastic.Client) (*MigrationPlan, error) {
+	requireUpdate, currentIndexName, newIndexName, err := es.checkIndexAliases(client, es.aliasName)
+	if err != nil {
+		log.WithError(err).Error(fmt.Sprintf("unable to read alias definition for %s alias", es.aliasName))
+		return nil, err
+	}
+
+	indexVersion, _ := es.migrationTarget()
+	plan := &MigrationPlan{
+		Alias:          es.aliasName,
+		IndexVersion:   indexVersion,
+		CurrentIndex:   currentIndexName,
+		NewIndex:       newIndexName,
+		UpdateRequired: requireUpdate,
+		requiredIndex:  newIndexName,
+	}
+	if !requireUpdate {
+		return plan, nil
+	}
+
+	// a version the index was rolled back from is not migrated to again
+	if len(currentIndexName) > 0 {
+		rolledBack, err := es.rolledBackVersion(client, currentIndexName)
+		if err != nil {
+			log.WithError(err).Error("unable to read rolled back index version")
+			return nil, err
+		}
+		if rolledBack == indexVersion {
+			plan.UpdateRequired = false
+			plan.RolledBack = true
+			plan.NewIndex = currentIndexName
+			return plan, nil
+		}
+	}
+
+	plan.mapping, plan.aliasFilter, err = es.readValidatedFiles()
+	if err != nil {
+		log.WithError(err).Error("unable to read new index mapping definition or alias filter")
+		return nil, err
+	}
+
+	if len(es.options.TransformFile) > 0 {
+		transform, err := loadTransform(es.options.TransformFile)
+		if err != nil {
+			log.WithError(err).Error("unable to read transform")
+			return nil, err
+		}
+		plan.transform = transform
+	}
+
+	err = es.planSourceIndex(client, plan)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(plan.SourceIndex) > 0 {
+		source, err := es.sourceEsClient(client)
+		if err != nil {
+			log.WithError(err).Error("unable to connect to source cluster")
+			return nil, err
+		}
+
+		count, err := elastic.NewCountService(source).Index(plan.SourceIndex).Do(context.Background())
+		if err != nil {
+			log.WithError(err).Error("unable to count documents in source index")
+			return nil, err
+		}
+		plan.DocumentCount = count
+	}
+
+	if len(currentIndexName) > 0 {
+		plan.MappingDiff = es.logMappingDiff(client, currentIndexName, plan.mapping)
+	}
+
+	if es.canUpdateInPlace(plan) {
+		es.planInPlaceUpdate(plan)
+		return plan, nil
+	}
+
+	es.planReindex(plan)
+	exists, err := client.IndexExists(plan.NewIndex).Do(context.Background())
+	if err != nil {
+		log.WithError(err).Error("unable to check for new index")
+		return nil, err
+	}
+	plan.Resume = exists
+
+	return plan, nil
+}
+
+// planSourceIndex finds the index to copy the documents from, which is the index behind the alias on the source cluster if there is one
+func (es *esService) planSourceIndex(client *elastic.Client, plan *MigrationPlan) error {
+	plan.SourceIndex = plan.CurrentIndex
+	if es.options.SourceCluster == nil {
+		return nil
+	}
+
+	if es.options.ZeroDowntime {
+		return errors.New("zero-downtime migrations from a source cluster are not supported")
+	}
+
+	switch es.remoteReindexMode() {
+	case RemoteReindexAuto, RemoteReindexServer, RemoteReindexClient:
+	default:
+		return fmt.Errorf("remote reindex must be %s, %s or %s, not %q", RemoteReindexAuto, RemoteReindexServer, RemoteReindexClient, es.options.RemoteReindex)
+	}
+
+	source, err := es.sourceEsClient(client)
+	if err != nil {
+		log.WithError(err).Error("unable to connect to source cluster")
+		return err
+	}
+
+	_, sourceIndex, _, err := es.checkIndexAliases(source, es.aliasName)
+	if err != nil {
+		log.WithError(err).Error(fmt.Sprintf("unable to read alias definition for %s alias on source cluster", es.aliasName))
+		return err
+	}
+	if len(sourceIndex) == 0 {
+		return fmt.Errorf("alias %s was not found on source cluster %s", es.aliasName, es.options.SourceCluster.endpoint)
+	}
+
+	plan.SourceCluster = es.options.SourceCluster.endpoint
+	plan.SourceIndex = sourceIndex
+	return nil
+}
+
+// canUpdateInPlace reports whether the current index can be changed to the new version without a reindex: a migration
+// which only changes settings is if in-place settings updates are enabled, and one which also adds fields is if in-place mapping updates are too
+func (es *esService) canUpdateInPlace(plan *MigrationPlan) bool {
+	diff := plan.MappingDiff
+	// a transform changes the documents, and documents from another cluster have to be copied, which both require a reindex
+	if plan.transform != nil || len(plan.SourceCluster) > 0 || diff == nil {
+		return false
+	}
+	// the smoke queries must pass against a new index before the aliases are moved to it, which an in-place update has not got
+	if len(es.options.SmokeQueriesDir) > 0 {
+		return false
+	}
+	// likewise the canary alias points at a new index until the migration is promoted
+	if len(es.options.CanaryAliasSuffix) > 0 {
+		return false
+	}
+	if len(diff.Removed) > 0 || len(diff.TypeChanged) > 0 || len(diff.AnalyzerChanged) > 0 {
+		return false
+	}
+	if _, ok := inPlaceMappingBody(plan.mapping); !ok {
+		return false
+	}
+
+	update, ok := planSettingsUpdate(plan)
+	if !ok {
+		return false
+	}
+	if !update.Empty() && !es.options.InPlaceSettingsUpdates {
+		return false
+	}
+	return es.options.InPlaceMappingUpdates || (len(diff.Added) == 0 && !update.Empty())
+}
+
+// planReindex plans a migration to a new index, copying the documents of the current one if there is one
+func (es *esService) planReindex(plan *MigrationPlan) {
+	plan.InPlace = false
+	plan.NewIndex = plan.requiredIndex
+	plan.ReindexRequired = len(plan.SourceIndex) > 0
+	plan.ReadOnlyIndex = plan.SourceIndex
+	plan.DeltaField = ""
+	plan.Transform = ""
+	plan.SettingsUpdate = nil
+	if plan.ReindexRequired && es.options.ZeroDowntime {
+		plan.DeltaField = es.deltaField()
+	}
+	if plan.ReindexRequired && plan.transform != nil {
+		plan.Transform = fmt.Sprintf("%s from %s", plan.transform.kind(), es.options.TransformFile)
+	}
+	plan.AliasChanges = es.planAliasChanges(plan, plan.CurrentIndex)
+}
+
+// planInPlaceUpdate plans to put the new mapping on the current index, which keeps its aliases
+func (es *esService) planInPlaceUpdate(plan *MigrationPlan) {
+	plan.InPlace = true
+	plan.NewIndex = plan.CurrentIndex
+	plan.ReindexRequired = false
+	plan.ReadOnlyIndex = ""
+	plan.DeltaField = ""
+	if update, ok := planSettingsUpdate(plan); ok && !update.Empty() {
+		plan.SettingsUpdate = update
+	}
+	plan.AliasChanges = es.planAliasChanges(plan, "")
+}
+
+func (es *esService) planAliasChanges(plan *MigrationPlan, from string) []AliasChange {
+	change := AliasChange{Alias: es.aliasName, From: from, To: plan.NewIndex}
+	if len(plan.aliasFilter) > 0 {
+		change.Filter = json.RawMessage(plan.aliasFilter)
+	}
+	changes := []AliasChange{change}
+
+	for _, alias := range es.unfilteredAliases() {
+		changes = append(changes, AliasChange{Alias: alias, From: from, To: plan.NewIndex})
+	}
+	return changes
+}
+
+// String renders the plan for humans
+func (p *MigrationPlan) String() string {
+	var sb strings.Builder
+
+	fmt.Fprintf(&sb, "Alias:            %s\n", p.Alias)
+	fmt.Fprintf(&sb, "Index version:    %s\n", p.IndexVersion)
+	if len(p.ClusterHealth) > 0 {
+		fmt.Fprintf(&sb, "Cluster health:   %s\n", p.ClusterHealth)
+	}
+	fmt.Fprintf(&sb, "Current index:    %s\n", orNone(p.CurrentIndex))
+	fmt.Fprintf(&sb, "New index:        %s\n", p.NewIndex)
+
+	if p.RolledBack {
+		fmt.Fprintf(&sb, "Index was rolled back from version %s, nothing to do until another version is deployed\n", p.IndexVersion)
+		return sb.String()
+	}
+	if !p.UpdateRequired {
+		sb.WriteString("Index is up-to-date, nothing to do\n")
+		return sb.String()
+	}
+
+	if p.Resume {
+		fmt.Fprintf(&sb, "Resume:           %s already exists, the interrupted migration will be resumed\n", p.NewIndex)
+	}
+
+	if p.InPlace {
+		fmt.Fprintf(&sb, "Reindex:          not required, mapping will be updated in place on %s\n", p.CurrentIndex)
+		if p.SettingsUpdate != nil {
+			fmt.Fprintf(&sb, "Settings update:  %s\n", p.SettingsUpdate)
+		}
+	} else if p.ReindexRequired {
+		if len(p.SourceCluster) > 0 {
+			fmt.Fprintf(&sb, "Reindex:          %d documents from %s on %s to %s\n", p.DocumentCount, p.SourceIndex, p.SourceCluster, p.NewIndex)
+		} else {
+			fmt.Fprintf(&sb, "Reindex:          %d documents from %s to %s\n", p.DocumentCount, p.SourceIndex, p.NewIndex)
+		}
+		if len(p.Transform) > 0 {
+			fmt.Fprintf(&sb, "Transform:        %s\n", p.Transform)
+		}
+		if len(p.DeltaField) > 0 {
+			fmt.Fprintf(&sb, "Catch-up:         documents written during the copy are found by %s\n", p.DeltaField)
+			fmt.Fprintf(&sb, "Read-only index:  %s, for the final catch-up pass only\n", p.ReadOnlyIndex)
+		} else {
+			fmt.Fprintf(&sb, "Read-only index:  %s\n", p.ReadOnlyIndex)
+		}
+	} else {
+		sb.WriteString("Reindex:          not required\n")
+	}
+
+	if p.MappingDiff != nil {
+		fmt.Fprintf(&sb, "Mapping changes:  %s\n", p.MappingDiff)
+	}
+
+	sb.WriteString("Alias changes:\n")
+	for _, change := range p.AliasChanges {
+		filter := "no filter"
+		if len(change.Filter) > 0 {
+			filter = "filter " + compactJSON(change.Filter)
+		}
+		fmt.Fprintf(&sb, "  %s: %s -> %s (%s)\n", change.Alias, orNone(change.From), change.To, filter)
+	}
+
+	return sb.String()
+}
+
+func orNone(s string) string {
+	if len(s) == 0 {
+		return "none"
+	}
+	return s
+}
+
+func compactJSON(raw json.RawMessage) string {
+	var buf bytes.Buffer
+	if err := json.Compact(&buf, raw); err != nil {
+		return string(raw)
+	}
+	return buf.String()
+}
@@ -0,0 +1,152 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	log "github.com/Financial-Times/go-logger"
+	"github.com/olivere/elastic/v7"
+)
+
+var (
+	ErrNotReadyToPromote = errors.New("Migration is not ready to promote")
+	ErrPromotionTimedOut = errors.New("Migration was not promoted before the promotion timeout")
+)
+
+// defaultPromotionTimeout limits the wait for promotion when no promotion timeout is configured
+const defaultPromotionTimeout = 24 * time.Hour
+
+type EsPromoteService interface {
+	PromoteMigration() (*Migration, error)
+}
+
+// canaryAlias is the alias the new index is tested through before it is promoted, or empty if there is no promotion gate
+func (es *esService) canaryAlias() string {
+	if len(es.options.CanaryAliasSuffix) == 0 {
+		return ""
+	}
+	return es.aliasName + es.options.CanaryAliasSuffix
+}
+
+func (es *esService) promotionTimeout() time.Duration {
+	if es.options.PromotionTimeout > 0 {
+		return es.options.PromotionTimeout
+	}
+	return defaultPromotionTimeout
+}
+
+// catchUpOnPromotion reports whether the source index stays writable while the migration waits to be promoted, with the documents
+// written meanwhile copied by a final catch-up pass once it is. The catch-up needs the source index on the destination cluster.
+func (es *esService) catchUpOnPromotion() bool {
+	return len(es.canaryAlias()) > 0 && es.options.SourceCluster == nil
+}
+
+// releaseSourceIndex allows writes to the source index, which a migration which is not zero-downtime has blocked, before waiting to be promoted.
+// The checkpoint the final catch-up pass copies from is taken first, while every document written to the source index has been copied.
+func (es *esService) releaseSourceIndex(client *elastic.Client, plan *MigrationPlan, state *migrationState) error {
+	if es.options.ZeroDowntime {
+		return nil
+	}
+
+	checkpoint, err := es.deltaCheckpoint(client, plan.SourceIndex)
+	if err != nil {
+		log.WithError(err).Error("unable to read reindex checkpoint")
+		return err
+	}
+	state.Checkpoint = checkpoint
+	state.Released = true
+	err = es.saveMigrationState(client, plan.NewIndex, state)
+	if err != nil {
+		log.WithError(err).Error("unable to record reindex checkpoint")
+		return err
+	}
+
+	if state.SourceReadOnly {
+		return nil
+	}
+	return es.setWritable(client, plan.SourceIndex)
+}
+
+// PromoteMigration approves the migration waiting to be promoted, which then moves the aliases to its new index
+func (es *esService) PromoteMigration() (*Migration, error) {
+	es.Lock()
+	defer es.Unlock()
+
+	migration := es.currentMigration
+	if migration == nil || !migration.Running() {
+		return nil, ErrNoMigrationRunning
+	}
+	if migration.Phase != PhaseReadyToPromote {
+		return nil, fmt.Errorf("%w: it is %s", ErrNotReadyToPromote, migration.Phase)
+	}
+
+	select {
+	case <-migration.promote:
+	default:
+		log.WithField("migration", migration.ID).Info("promoting index migration")
+		close(migration.promote)
+	}
+
+	result := *migration
+	return &result, nil
+}
+
+// awaitPromotion points the canary alias at the new index, with the alias filter, and waits until the migration is promoted,
+// cancelled, or the promotion timeout runs out. The canary alias is removed along with moving the aliases if the migration is promoted,
+// and by undoMigration otherwise.
+func (es *esService) awaitPromotion(client *elastic.Client, aliasFilter string, newIndexName string) error {
+	canary := es.canaryAlias()
+	err := es.updateAlias(client, canary, aliasFilter, "", newIndexName)
+	if err != nil {
+		log.WithError(err).WithField("alias", canary).Error("unable to point canary alias at new index")
+		return err
+	}
+
+	timeout := es.promotionTimeout()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	promote := es.readyToPromote(canary, timeout)
+	if promote == nil {
+		// nothing can approve a migration which MigrateIndex was not started as
+		log.WithField("alias", canary).Warn("no migration to approve, promoting new index straight away")
+		return nil
+	}
+	es.recordMigration()
+	es.setProgress(fmt.Sprintf("ready to promote, %s points at %s", canary, newIndexName))
+	log.WithFields(map[string]interface{}{"alias": canary, "index": newIndexName, "timeout": timeout.String()}).Info("new index is ready to promote")
+
+	select {
+	case <-promote:
+		return nil
+	case <-es.cancelSignal():
+		return ErrMigrationCancelled
+	case <-es.lockLostSignal():
+		return ErrMigrationLockLost
+	case <-timer.C:
+		if es.options.PromoteOnTimeout {
+			log.WithField("index", newIndexName).Info("promotion timeout ran out, promoting new index")
+			return nil
+		}
+		return fmt.Errorf("%w of %s", ErrPromotionTimedOut, timeout)
+	}
+}
+
+// readyToPromote moves the running migration to the ready to promote phase, returning the channel closed when it is promoted,
+// or nil if MigrateIndex was not started as a migration
+func (es *esService) readyToPromote(canary string, timeout time.Duration) <-chan struct{} {
+	es.Lock()
+	defer es.Unlock()
+
+	migration := es.currentMigration
+	if migration == nil || !migration.Running() {
+		return nil
+	}
+
+	es.enterPhase(migration, PhaseReadyToPromote)
+	migration.CanaryAlias = canary
+	deadline := time.Now().UTC().Add(timeout)
+	migration.PromotionDeadline = &deadline
+	return migration.promote
+}
@@ -0,0 +1,80 @@
+package service
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPromoteMigration(t *testing.T) {
+	es := &esService{}
+	es.newMigration("1.0.0", "")
+
+	_, err := es.PromoteMigration()
+	assert.ErrorIs(t, err, ErrNotReadyToPromote, "expected error for promoting a migration which is still planning")
+
+	promote := es.readyToPromote("concepts-next", time.Hour)
+	require.NotNil(t, promote, "promotion channel")
+
+	migration, err := es.PromoteMigration()
+	require.NoError(t, err, "expected no error for promoting migration")
+	assert.Equal(t, PhaseReadyToPromote, migration.Phase, "migration phase")
+	assert.Equal(t, "concepts-next", migration.CanaryAlias, "canary alias")
+	assert.NotNil(t, migration.PromotionDeadline, "promotion deadline")
+
+	select {
+	case <-promote:
+	default:
+		assert.Fail(t, "expected migration to be promoted")
+	}
+
+	_, err = es.PromoteMigration()
+	assert.NoError(t, err, "expected no error for promoting migration again")
+}
+
+func TestPromoteMigrationNotRunning(t *testing.T) {
+	es := &esService{}
+
+	_, err := es.PromoteMigration()
+	assert.ErrorIs(t, err, ErrNoMigrationRunning, "expected error without a migration")
+	assert.Nil(t, es.readyToPromote("concepts-next", 0), "expected no promotion without a migration")
+}
+
+func TestCanaryAlias(t *testing.T) {
+	es := &esService{aliasName: "concepts"}
+	assert.Empty(t, es.canaryAlias(), "expected no canary alias without a suffix")
+
+	es.options.CanaryAliasSuffix = "-next"
+	assert.Equal(t, "concepts-next", es.canaryAlias(), "canary alias")
+}
+
+func TestPromotionTimeout(t *testing.T) {
+	es := &esService{}
+	assert.Equal(t, defaultPromotionTimeout, es.promotionTimeout(), "default promotion timeout")
+
+	es.options.PromotionTimeout = time.Hour
+	assert.Equal(t, time.Hour, es.promotionTimeout(), "configured promotion timeout")
+}
+
+func TestCatchUpOnPromotion(t *testing.T) {
+	es := &esService{aliasName: "concepts"}
+	assert.False(t, es.catchUpOnPromotion(), "expected no catch-up without a canary alias")
+
+	es.options.CanaryAliasSuffix = "-next"
+	assert.True(t, es.catchUpOnPromotion(), "expected a catch-up with a canary alias")
+
+	es.options.SourceCluster = &EsAccessConfig{}
+	assert.False(t, es.catchUpOnPromotion(), "expected no catch-up from a source cluster")
+}
+
+func TestCanUpdateInPlaceWithCanaryAlias(t *testing.T) {
+	plan := &MigrationPlan{
+		mapping:     `{"mappings": {"properties": {"id": {"type": "keyword"}}}}`,
+		MappingDiff: &MappingDiff{Added: []FieldChange{{Field: "id", New: "keyword"}}},
+	}
+
+	es := &esService{options: MigrationOptions{InPlaceMappingUpdates: true, CanaryAliasSuffix: "-next"}}
+	assert.False(t, es.canUpdateInPlace(plan), "expected a reindex for migrations which await promotion")
+}
@@ -0,0 +1,198 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	log "github.com/Financial-Times/go-logger"
+	"github.com/olivere/elastic/v7"
+)
+
+// ways of copying documents from a source cluster
+const (
+	RemoteReindexAuto   = "auto"
+	RemoteReindexServer = "remote"
+	RemoteReindexClient = "client"
+)
+
+var ErrRemoteReindexNotAllowed = errors.New("Reindex from the source cluster is not allowed")
+
+// sourceEsClient returns the client for the cluster holding the source index,
+// which is the destination cluster unless a source cluster has been configured
+func (es *esService) sourceEsClient(client *elastic.Client) (*elastic.Client, error) {
+	if es.options.SourceCluster == nil {
+		return client, nil
+	}
+
+	es.Lock()
+	defer es.Unlock()
+
+	if es.sourceClient == nil {
+		sourceClient, err := NewElasticClient(*es.options.SourceCluster)
+		if err != nil {
+			return nil, fmt.Errorf("connecting to source cluster %s: %w", es.options.SourceCluster.endpoint, err)
+		}
+		es.sourceClient = sourceClient
+	}
+	return es.sourceClient, nil
+}
+
+// reindexFromSourceCluster copies the documents from the source cluster, with a remote reindex if the destination cluster
+// is allowed to run one, and otherwise by scrolling the source index and bulk indexing the documents.
+// An empty task ID is returned once the documents have been copied by the reindexer itself.
+func (es *esService) reindexFromSourceCluster(client *elastic.Client, fromIndex string, toIndex string, transform *reindexTransform) (string, int, error) {
+	source, err := es.sourceEsClient(client)
+	if err != nil {
+		return "", 0, err
+	}
+
+	count, err := elastic.NewCountService(source).Index(fromIndex).Do(context.Background())
+	if err != nil {
+		return "", 0, err
+	}
+
+	mode := es.remoteReindexMode()
+	if mode != RemoteReindexClient {
+		taskID, err := es.remoteReindex(client, fromIndex, toIndex, transform)
+		if err == nil {
+			return taskID, int(count), nil
+		}
+		if mode == RemoteReindexServer || !errors.Is(err, ErrRemoteReindexNotAllowed) {
+			return "", 0, err
+		}
+		log.WithError(err).Warn("falling back to copying the documents through the reindexer")
+	}
+
+	return "", int(count), es.copyDocuments(source, client, fromIndex, toIndex, transform, int(count))
+}
+
+func (es *esService) remoteReindexMode() string {
+	if len(es.options.RemoteReindex) == 0 {
+		return RemoteReindexAuto
+	}
+	return es.options.RemoteReindex
+}
+
+// remoteReindex starts a reindex from remote on the destination cluster, which must list the source cluster in its reindex.remote.whitelist setting
+func (es *esService) remoteReindex(client *elastic.Client, fromIndex string, toIndex string, transform *reindexTransform) (string, error) {
+	sourceCluster := es.options.SourceCluster
+	if sourceCluster.signsRequests() {
+		return "", fmt.Errorf("%w: requests to %s must be signed", ErrRemoteReindexNotAllowed, sourceCluster.endpoint)
+	}
+
+	log.WithFields(map[string]interface{}{"host": sourceCluster.endpoint, "from": fromIndex, "to": toIndex}).Info("reindexing from remote")
+
+	remote := elastic.NewReindexRemoteInfo().Host(sourceCluster.endpoint)
+	if sourceCluster.authType == "basic" {
+		remote = remote.Username(sourceCluster.username).Password(sourceCluster.password)
+	}
+
+	reindexService, err := es.newReindexService(client)
+	if err != nil {
+		return "", err
+	}
+
+	destination := elastic.NewReindexDestination().Index(toIndex).OpType("create")
+	transform.apply(reindexService, destination)
+
+	task, err := reindexService.
+		Source(es.newReindexSource(fromIndex).RemoteInfo(remote)).
+		Destination(destination).
+		Conflicts("proceed").
+		DoAsync(context.Background())
+	if err != nil {
+		if elastic.IsStatusCode(err, http.StatusBadRequest) || elastic.IsStatusCode(err, http.StatusUnauthorized) || elastic.IsStatusCode(err, http.StatusForbidden) {
+			return "", fmt.Errorf("%w: %v", ErrRemoteReindexNotAllowed, err)
+		}
+		return "", err
+	}
+
+	log.WithField("task", task.TaskId).Info("reindex task started")
+	return task.TaskId, nil
+}
+
+// copyDocuments scrolls through the source index and bulk indexes its documents into the destination index.
+// Documents which are already in the destination are skipped, so that an interrupted copy can be restarted.
+func (es *esService) copyDocuments(source *elastic.Client, destination *elastic.Client, fromIndex string, toIndex string, transform *reindexTransform, total int) error {
+	if transform != nil && transform.Script != nil {
+		return errors.New("a transform script cannot be applied when the reindexer copies the documents, use an ingest pipeline instead")
+	}
+
+	log.WithFields(map[string]interface{}{"from": fromIndex, "to": toIndex}).Info("copying documents from source cluster")
+
+	batchSize := es.options.ReindexBatchSize
+	if batchSize <= 0 {
+		batchSize = 1000
+	}
+
+	scroll := source.Scroll(fromIndex).Size(batchSize).KeepAlive("5m")
+	defer func() {
+		if err := scroll.Clear(context.Background()); err != nil {
+			log.WithError(err).Warn("unable to clear scroll of source index")
+		}
+	}()
+
+	es.startReindexProgress(total)
+	copied := 0
+	for {
+		if err := es.checkCancelled(); err != nil {
+			return err
+		}
+		start := time.Now()
+
+		result, err := scroll.Do(context.Background())
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		bulk := destination.Bulk().Index(toIndex)
+		if transform != nil && len(transform.pipelineID) > 0 {
+			bulk = bulk.Pipeline(transform.pipelineID)
+		}
+		for _, hit := range result.Hits.Hits {
+			request := elastic.NewBulkIndexRequest().OpType("create").Id(hit.Id).Doc(hit.Source)
+			if len(hit.Routing) > 0 {
+				request = request.Routing(hit.Routing)
+			}
+			bulk = bulk.Add(request)
+		}
+
+		if bulk.NumberOfActions() > 0 {
+			response, err := bulk.Do(context.Background())
+			if err != nil {
+				return err
+			}
+
+			for _, item := range response.Failed() {
+				if item.Status == http.StatusConflict {
+					continue
+				}
+				reason := ""
+				if item.Error != nil {
+					reason = fmt.Sprintf("%s: %s", item.Error.Type, item.Error.Reason)
+				}
+				return fmt.Errorf("%w: copying document %s from %s: %s", ErrReindexTaskFailed, item.Id, fromIndex, reason)
+			}
+		}
+
+		copied += len(result.Hits.Hits)
+		es.setProgress(fmt.Sprintf("%v / %v documents copied", copied, total))
+		es.reindexProgress(copied)
+
+		// throttle to the same rate a reindex task would run at
+		if es.options.RequestsPerSecond > 0 {
+			minimum := time.Duration(len(result.Hits.Hits)) * time.Second / time.Duration(es.options.RequestsPerSecond)
+			time.Sleep(minimum - time.Since(start))
+		}
+	}
+
+	log.WithFields(map[string]interface{}{"from": fromIndex, "to": toIndex, "documents": copied}).Info("documents copied from source cluster")
+	return nil
+}
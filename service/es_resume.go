@@ -0,0 +1,166 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	log "github.com/Financial-Times/go-logger"
+	"github.com/olivere/elastic/v7"
+)
+
+// migrationState is kept in the new index's mapping metadata while it is being built,
+// so that a migration interrupted by a restart can be picked up where it was left
+type migrationState struct {
+	Source  string `json:"source"`
+	Version string `json:"version"`
+	Task    string `json:"task,omitempty"`
+	// Checkpoint is the value of the delta field up to which the documents have been copied, in zero-downtime migrations
+	Checkpoint json.RawMessage `json:"checkpoint,omitempty"`
+	// SourceReadOnly records whether writes to the source index were already blocked before the migration began,
+	// in which case they stay blocked when it is cancelled
+	SourceReadOnly bool `json:"sourceReadOnly,omitempty"`
+	// Snapshot is the snapshot of the source index taken before the migration blocked writes to it
+	Snapshot string `json:"snapshot,omitempty"`
+	// Released records that writes to the source index were allowed again from Checkpoint on, while the migration waited to be promoted
+	Released bool `json:"released,omitempty"`
+	// Stale records that writes to the source index were allowed again after a failed migration began copying it,
+	// so that the documents already copied may be out of date
+	Stale bool `json:"stale,omitempty"`
+}
+
+// prepareTargetIndex creates the new index, or returns the state of the migration which was building it
+func (es *esService) prepareTargetIndex(client *elastic.Client, plan *MigrationPlan) (*migrationState, error) {
+	exists, err := client.IndexExists(plan.NewIndex).Do(context.Background())
+	if err != nil {
+		return nil, err
+	}
+
+	if exists {
+		state, err := es.loadMigrationState(client, plan.NewIndex)
+		if err != nil {
+			return nil, err
+		}
+		if state == nil {
+			return nil, fmt.Errorf("index %s already exists but was not created by a migration", plan.NewIndex)
+		}
+		if state.Source != plan.SourceIndex {
+			return nil, fmt.Errorf("index %s was being built from %s, but the alias now points to %s", plan.NewIndex, state.Source, plan.SourceIndex)
+		}
+
+		stale := state.Stale
+		if !stale && plan.ReindexRequired && !state.SourceReadOnly {
+			// the stale mark is missing if it could not be saved when the migration stopped, so the history has the final say
+			stopped, err := es.stoppedMigrationTo(client, plan.NewIndex)
+			if err != nil {
+				log.WithError(err).WithField("index", plan.NewIndex).Warn("unable to read migration history, resuming from the state of the new index")
+			}
+			stale = stopped != nil
+		}
+
+		if !stale {
+			log.WithFields(map[string]interface{}{"from": state.Source, "to": plan.NewIndex, "task": state.Task}).Info("resuming interrupted index migration")
+			es.resumeMigrationHistory(client, plan.NewIndex)
+			return state, nil
+		}
+
+		// documents may have been changed or deleted in the source index since they were copied, so the copy starts over
+		log.WithFields(map[string]interface{}{"from": state.Source, "to": plan.NewIndex}).Info("source index was written to since the failed migration, building the new index again")
+		_, err = client.DeleteIndex(plan.NewIndex).Do(context.Background())
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	state := &migrationState{Source: plan.SourceIndex, Version: plan.IndexVersion}
+	if plan.ReindexRequired {
+		source, err := es.sourceEsClient(client)
+		if err != nil {
+			return nil, err
+		}
+		state.SourceReadOnly, err = es.isReadOnly(source, plan.SourceIndex)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = es.createIndex(client, plan.NewIndex, plan.mapping)
+	if err != nil {
+		return nil, err
+	}
+
+	return state, es.saveMigrationState(client, plan.NewIndex, state)
+}
+
+// startOrResumeReindex reattaches to the reindex task of an interrupted migration if it is still running or has succeeded,
+// and otherwise starts a new one, which skips the documents that were already copied.
+// An empty task ID is returned if the documents were copied from a source cluster by the reindexer itself.
+func (es *esService) startOrResumeReindex(client *elastic.Client, fromIndex string, toIndex string, state *migrationState, transform *reindexTransform) (string, int, error) {
+	if len(state.Task) > 0 {
+		_, _, err := es.isTaskComplete(client, state.Task)
+		if err == nil {
+			source, err := es.sourceEsClient(client)
+			if err != nil {
+				return "", 0, err
+			}
+
+			count, err := elastic.NewCountService(source).Index(fromIndex).Do(context.Background())
+			if err != nil {
+				return "", 0, err
+			}
+
+			log.WithField("task", state.Task).Info("reattached to reindex task")
+			return state.Task, int(count), nil
+		}
+		log.WithError(err).WithField("task", state.Task).Warn("previous reindex task cannot be resumed, restarting the copy")
+	}
+
+	var taskID string
+	var count int
+	var err error
+	if es.options.SourceCluster != nil {
+		taskID, count, err = es.reindexFromSourceCluster(client, fromIndex, toIndex, transform)
+	} else {
+		taskID, count, err = es.reindex(client, fromIndex, toIndex, transform)
+	}
+	if err != nil || len(taskID) == 0 {
+		return taskID, count, err
+	}
+
+	state.Task = taskID
+	return taskID, count, es.saveMigrationState(client, toIndex, state)
+}
+
+func (es *esService) saveMigrationState(client *elastic.Client, indexName string, state *migrationState) error {
+	meta, err := es.reindexerMeta(client, indexName)
+	if err != nil {
+		return err
+	}
+
+	meta["migration"] = state
+	return es.putReindexerMeta(client, indexName, meta)
+}
+
+// loadMigrationState returns nil if the index was not created by a migration
+func (es *esService) loadMigrationState(client *elastic.Client, indexName string) (*migrationState, error) {
+	meta, err := es.reindexerMeta(client, indexName)
+	if err != nil {
+		return nil, err
+	}
+
+	m, found := meta["migration"]
+	if !found {
+		return nil, nil
+	}
+
+	b, err := json.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+
+	state := &migrationState{}
+	if err := json.Unmarshal(b, state); err != nil {
+		return nil, fmt.Errorf("decoding migration state of index %s: %w", indexName, err)
+	}
+	return state, nil
+}
@@ -0,0 +1,192 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/Financial-Times/go-logger"
+	"github.com/olivere/elastic/v7"
+)
+
+// what the retention policy does with a superseded index
+const (
+	RetentionKeep   = "keep"
+	RetentionClose  = "close"
+	RetentionDelete = "delete"
+)
+
+// RetentionPolicy decides which of the index versions older than the one behind the alias are kept.
+// An index is kept if it is one of the KeepVersions most recent ones, or if it is younger than MaxAge.
+// The policy is disabled when neither is set.
+type RetentionPolicy struct {
+	KeepVersions int
+	MaxAge       time.Duration
+	// Delete deletes the indices which are not kept, instead of closing them
+	Delete bool
+}
+
+func (p RetentionPolicy) enabled() bool {
+	return p.KeepVersions > 0 || p.MaxAge > 0
+}
+
+// SupersededIndex is an index version older than the one behind the alias, with what the retention policy does with it
+type SupersededIndex struct {
+	Name    string    `json:"name"`
+	Created time.Time `json:"created"`
+	Action  string    `json:"action"`
+	Reason  string    `json:"reason"`
+}
+
+// RetentionResult lists the superseded index versions, newest first
+type RetentionResult struct {
+	DryRun  bool              `json:"dryRun"`
+	Indices []SupersededIndex `json:"indices"`
+}
+
+type EsRetentionService interface {
+	ApplyRetention(dryRun bool) (*RetentionResult, error)
+}
+
+// ApplyRetention closes or deletes the superseded index versions which the retention policy does not keep,
+// or only lists what it would do if dryRun is set. Indices which any alias points to are always kept, and only <alias>-<version>
+// indices are versions of the index. The indices are only changed while holding the migration lock.
+func (es *esService) ApplyRetention(dryRun bool) (*RetentionResult, error) {
+	client := es.esClient()
+	if client == nil {
+		return nil, ErrNoElasticClient
+	}
+
+	es.RLock()
+	running := !es.migrationCheck
+	es.RUnlock()
+	if running {
+		return nil, ErrMigrationRunning
+	}
+
+	if !dryRun {
+		lease, err := es.lockIndexChange(client)
+		if err != nil {
+			return nil, err
+		}
+		defer es.releaseMigrationLock(client, lease)
+	}
+	return es.applyRetention(client, dryRun)
+}
+
+func (es *esService) applyRetention(client *elastic.Client, dryRun bool) (*RetentionResult, error) {
+	policy := es.options.Retention
+	result := &RetentionResult{DryRun: dryRun, Indices: []SupersededIndex{}}
+
+	_, currentIndexName, _, err := es.checkIndexAliases(client, es.aliasName)
+	if err != nil {
+		return nil, err
+	}
+	if len(currentIndexName) == 0 {
+		return result, nil
+	}
+
+	created, err := es.indexCreationDates(client, es.aliasName)
+	if err != nil {
+		return nil, err
+	}
+
+	aliases, err := client.Aliases().Do(context.Background())
+	if err != nil {
+		return nil, err
+	}
+
+	// only the indices created before the current one are superseded, newer ones may be the target of a migration
+	current, found := created[currentIndexName]
+	if !found {
+		return nil, fmt.Errorf("index %s is not a version of alias %s", currentIndexName, es.aliasName)
+	}
+	var superseded []string
+	for indexName, date := range created {
+		if date < current {
+			superseded = append(superseded, indexName)
+		}
+	}
+	sort.Slice(superseded, func(i, j int) bool {
+		return created[superseded[i]] > created[superseded[j]]
+	})
+
+	removeAction := RetentionClose
+	if policy.Delete {
+		removeAction = RetentionDelete
+	}
+
+	for i, indexName := range superseded {
+		index := SupersededIndex{Name: indexName, Created: time.UnixMilli(created[indexName]).UTC(), Action: RetentionKeep}
+
+		age := time.Since(index.Created)
+		switch {
+		case !policy.enabled():
+			index.Reason = "no retention policy"
+		case len(aliases.Indices[indexName].Aliases) > 0:
+			index.Reason = "an alias points to it"
+		case policy.KeepVersions > 0 && i < policy.KeepVersions:
+			index.Reason = fmt.Sprintf("one of the %d most recent previous versions", policy.KeepVersions)
+		case policy.MaxAge > 0 && age < policy.MaxAge:
+			index.Reason = fmt.Sprintf("younger than %s", policy.MaxAge)
+		default:
+			index.Action = removeAction
+			index.Reason = fmt.Sprintf("superseded by %d newer versions, created %s ago", i+1, age.Round(time.Minute))
+		}
+		result.Indices = append(result.Indices, index)
+	}
+
+	if dryRun {
+		return result, nil
+	}
+
+	for _, index := range result.Indices {
+		switch index.Action {
+		case RetentionClose:
+			log.WithFields(map[string]interface{}{"index": index.Name, "reason": index.Reason}).Info("closing superseded index")
+			_, err = client.CloseIndex(index.Name).Do(context.Background())
+		case RetentionDelete:
+			log.WithFields(map[string]interface{}{"index": index.Name, "reason": index.Reason}).Info("deleting superseded index")
+			_, err = client.DeleteIndex(index.Name).Do(context.Background())
+		default:
+			continue
+		}
+		if err != nil {
+			return result, fmt.Errorf("unable to %s superseded index %s: %w", index.Action, index.Name, err)
+		}
+	}
+
+	return result, nil
+}
+
+// retainAfterMigration applies the retention policy once a migration has succeeded, on a best-effort basis without failing the migration
+func (es *esService) retainAfterMigration() {
+	client := es.esClient()
+	lease, err := es.lockIndexChange(client)
+	if err == nil {
+		_, err = es.applyRetention(client, false)
+		es.releaseMigrationLock(client, lease)
+	}
+	if err != nil {
+		log.WithError(err).Error("unable to apply index retention policy")
+	}
+}
+
+// String formats the result as a human-readable listing
+func (r *RetentionResult) String() string {
+	var sb strings.Builder
+	if r.DryRun {
+		sb.WriteString("Dry run, no index has been changed\n")
+	}
+	if len(r.Indices) == 0 {
+		sb.WriteString("No superseded index versions\n")
+		return sb.String()
+	}
+
+	for _, index := range r.Indices {
+		fmt.Fprintf(&sb, "%-7s %s (created %s): %s\n", index.Action, index.Name, index.Created.Format(time.RFC3339), index.Reason)
+	}
+	return sb.String()
+}
@@ -0,0 +1,33 @@
+package service
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRetentionPolicyEnabled(t *testing.T) {
+	assert.False(t, RetentionPolicy{}.enabled(), "empty policy")
+	assert.False(t, RetentionPolicy{Delete: true}.enabled(), "policy without limits")
+	assert.True(t, RetentionPolicy{KeepVersions: 2}.enabled(), "policy keeping versions")
+	assert.True(t, RetentionPolicy{MaxAge: time.Hour}.enabled(), "policy keeping young versions")
+}
+
+func TestRetentionResultString(t *testing.T) {
+	created := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	result := &RetentionResult{
+		DryRun: true,
+		Indices: []SupersededIndex{
+			{Name: "concepts-1.1.0", Created: created, Action: RetentionKeep, Reason: "one of the 1 most recent previous versions"},
+			{Name: "concepts-1.0.0", Created: created, Action: RetentionDelete, Reason: "superseded by 2 newer versions, created 720h0m0s ago"},
+		},
+	}
+
+	expected := "Dry run, no index has been changed\n" +
+		"keep    concepts-1.1.0 (created 2024-03-01T12:00:00Z): one of the 1 most recent previous versions\n" +
+		"delete  concepts-1.0.0 (created 2024-03-01T12:00:00Z): superseded by 2 newer versions, created 720h0m0s ago\n"
+	assert.Equal(t, expected, result.String(), "listing")
+
+	assert.Equal(t, "No superseded index versions\n", (&RetentionResult{}).String(), "empty listing")
+}
@@ -0,0 +1,350 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	log "github.com/Financial-Times/go-logger"
+	"github.com/olivere/elastic/v7"
+)
+
+// reindexerMetaKey is the key under the index mapping's _meta object where the reindexer keeps its own data
+const reindexerMetaKey = "elasticsearch-reindexer"
+
+type RollbackResult struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+type EsRollbackService interface {
+	RollbackIndex() (RollbackResult, error)
+}
+
+// RollbackIndex moves the aliases from the current index back to the previous <alias>-<version> index,
+// restoring the alias filter it had before the migration and making it writable again.
+func (es *esService) RollbackIndex() (RollbackResult, error) {
+	client := es.esClient()
+	if client == nil {
+		return RollbackResult{}, ErrNoElasticClient
+	}
+
+	es.RLock()
+	running := !es.migrationCheck
+	es.RUnlock()
+	if running {
+		return RollbackResult{}, ErrMigrationRunning
+	}
+
+	lease, err := es.lockIndexChange(client)
+	if err != nil {
+		return RollbackResult{}, err
+	}
+	defer es.releaseMigrationLock(client, lease)
+
+	_, currentIndexName, _, err := es.checkIndexAliases(client, es.aliasName)
+	if err != nil {
+		log.WithError(err).Error(fmt.Sprintf("unable to read alias definition for %s alias", es.aliasName))
+		return RollbackResult{}, err
+	}
+	if len(currentIndexName) == 0 {
+		return RollbackResult{}, fmt.Errorf("alias %s does not point to any index", es.aliasName)
+	}
+
+	previousIndexName, err := es.previousIndex(client, es.aliasName, currentIndexName)
+	if err != nil {
+		log.WithError(err).Error("unable to find previous index version")
+		return RollbackResult{}, err
+	}
+
+	aliasFilter, err := es.loadAliasFilter(client, previousIndexName, es.aliasName)
+	if err != nil {
+		log.WithError(err).Error("unable to read previous alias filter")
+		return RollbackResult{}, err
+	}
+
+	// the version is recorded before the aliases are moved, so that no migration to it can start once they have been
+	err = es.recordRolledBackVersion(client, previousIndexName, currentIndexName)
+	if err != nil {
+		log.WithError(err).Error("unable to record rolled back index version")
+		return RollbackResult{}, err
+	}
+
+	// writes must be accepted as soon as the aliases point to the previous index
+	err = es.setWritable(client, previousIndexName)
+	if err != nil {
+		log.WithError(err).Error("unable to set index writable")
+		return RollbackResult{}, err
+	}
+
+	aliasService := es.aliasActions(elastic.NewAliasService(client), es.aliasName, aliasFilter, currentIndexName, previousIndexName)
+	for _, alias := range es.unfilteredAliases() {
+		aliasService = es.aliasActions(aliasService, alias, "", currentIndexName, previousIndexName)
+	}
+
+	_, err = aliasService.Do(context.Background())
+	if err != nil {
+		log.WithError(err).Error("failed to roll back index aliases")
+		return RollbackResult{}, err
+	}
+
+	result := RollbackResult{From: currentIndexName, To: previousIndexName}
+	es.Lock()
+	es.migrationErr = fmt.Errorf("index has been rolled back from %s to %s", result.From, result.To)
+	es.Unlock()
+	log.WithFields(map[string]interface{}{"from": result.From, "to": result.To}).Info("index rollback completed")
+
+	return result, nil
+}
+
+// recordRolledBackVersion records the version of the index rolled back from in the mapping metadata of the index rolled back to,
+// so that the migration to it is not run again while that version is deployed
+func (es *esService) recordRolledBackVersion(client *elastic.Client, indexName string, fromIndexName string) error {
+	version, err := es.registeredIndexVersion(client, fromIndexName)
+	if err != nil {
+		return err
+	}
+	if len(version) == 0 {
+		version = strings.TrimPrefix(fromIndexName, es.aliasName+"-")
+	}
+
+	meta, err := es.reindexerMeta(client, indexName)
+	if err != nil {
+		return err
+	}
+	meta["rolled_back_version"] = version
+	return es.putReindexerMeta(client, indexName, meta)
+}
+
+// rolledBackVersion returns the version the index was last rolled back from, if it was
+func (es *esService) rolledBackVersion(client *elastic.Client, indexName string) (string, error) {
+	meta, err := es.reindexerMeta(client, indexName)
+	if err != nil {
+		return "", err
+	}
+
+	version, _ := meta["rolled_back_version"].(string)
+	return version, nil
+}
+
+// aliasIndexPattern matches the name of a version of an index, <alias>-<version>, after the alias and its hyphen.
+// It does not match the indices of other aliases which start with the same name, such as concepts-people-v2 for concepts.
+var aliasIndexPattern = regexp.MustCompile(`^[0-9]+(\.[0-9]+)*([-+][0-9a-z.+-]*)?$`)
+
+// isAliasIndex reports whether the index is a version of the alias, named <alias>-<version>
+func isAliasIndex(aliasName string, indexName string) bool {
+	version := strings.TrimPrefix(indexName, aliasName+"-")
+	return version != indexName && aliasIndexPattern.MatchString(version)
+}
+
+// previousIndex finds the index the last migration to the current one moved the aliases from, according to the migration history.
+// Without a record of it, or if that index no longer exists, it is the most recently created <alias>-<version> index which is older than the current one.
+func (es *esService) previousIndex(client *elastic.Client, aliasName string, currentIndexName string) (string, error) {
+	created, err := es.indexCreationDates(client, aliasName)
+	if err != nil {
+		return "", err
+	}
+
+	current, found := created[currentIndexName]
+	if !found {
+		return "", fmt.Errorf("index %s is not a version of alias %s", currentIndexName, aliasName)
+	}
+
+	migration, err := es.lastMigrationTo(client, aliasName, currentIndexName)
+	if err != nil {
+		log.WithError(err).Warn("unable to read migration history, falling back to index creation dates")
+	}
+	if migration != nil {
+		if _, found := created[migration.SourceIndex]; found {
+			return migration.SourceIndex, nil
+		}
+	}
+
+	var candidates []string
+	for indexName, date := range created {
+		if date < current {
+			candidates = append(candidates, indexName)
+		}
+	}
+	if len(candidates) == 0 {
+		return "", ErrNoPreviousIndex
+	}
+
+	sort.Slice(candidates, func(i, j int) bool {
+		return created[candidates[i]] > created[candidates[j]]
+	})
+	return candidates[0], nil
+}
+
+// indexCreationDates returns the creation time (in epoch millis) of every <alias>-<version> index
+func (es *esService) indexCreationDates(client *elastic.Client, aliasName string) (map[string]int64, error) {
+	settings, err := client.IndexGetSettings(aliasName + "-*").Do(context.Background())
+	if err != nil {
+		return nil, err
+	}
+
+	created := make(map[string]int64)
+	for indexName, s := range settings {
+		if !isAliasIndex(aliasName, indexName) {
+			continue
+		}
+		indexSettings, ok := s.Settings["index"].(map[string]interface{})
+		if !ok {
+			continue
+		}
+		date, ok := indexSettings["creation_date"].(string)
+		if !ok {
+			continue
+		}
+		millis, err := strconv.ParseInt(date, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("index %s has an invalid creation date %q: %w", indexName, date, err)
+		}
+		created[indexName] = millis
+	}
+
+	return created, nil
+}
+
+// aliasFilterRecord is the alias filter recorded in an index's mapping metadata, if one was
+type aliasFilterRecord struct {
+	filter   interface{}
+	recorded bool
+}
+
+// saveAliasFilter records the filter which the alias has on the index in the index's mapping metadata,
+// so that the alias can be restored with the same filter on rollback. It returns the record it replaced.
+func (es *esService) saveAliasFilter(client *elastic.Client, indexName string, aliasName string) (*aliasFilterRecord, error) {
+	resp, err := client.PerformRequest(context.Background(), elastic.PerformRequestOptions{
+		Method: "GET",
+		Path:   fmt.Sprintf("/%s/_alias/%s", indexName, aliasName),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var aliases map[string]struct {
+		Aliases map[string]struct {
+			Filter json.RawMessage `json:"filter,omitempty"`
+		} `json:"aliases"`
+	}
+	if err := json.Unmarshal(resp.Body, &aliases); err != nil {
+		return nil, fmt.Errorf("decoding alias %s: %w", aliasName, err)
+	}
+
+	var filter json.RawMessage
+	if alias, found := aliases[indexName].Aliases[aliasName]; found {
+		filter = alias.Filter
+	}
+
+	meta, err := es.reindexerMeta(client, indexName)
+	if err != nil {
+		return nil, err
+	}
+
+	filters, _ := meta["alias_filters"].(map[string]interface{})
+	if filters == nil {
+		filters = make(map[string]interface{})
+	}
+	previous := &aliasFilterRecord{}
+	previous.filter, previous.recorded = filters[aliasName]
+	filters[aliasName] = filter
+	meta["alias_filters"] = filters
+
+	return previous, es.putReindexerMeta(client, indexName, meta)
+}
+
+// restoreAliasFilter puts back the alias filter record which saveAliasFilter replaced, once the migration it was saved for has stopped
+func (es *esService) restoreAliasFilter(client *elastic.Client, indexName string, aliasName string, previous *aliasFilterRecord) {
+	meta, err := es.reindexerMeta(client, indexName)
+	if err == nil {
+		filters, _ := meta["alias_filters"].(map[string]interface{})
+		if previous.recorded {
+			if filters == nil {
+				filters = make(map[string]interface{})
+			}
+			filters[aliasName] = previous.filter
+		} else {
+			delete(filters, aliasName)
+		}
+		if len(filters) > 0 {
+			meta["alias_filters"] = filters
+		} else {
+			delete(meta, "alias_filters")
+		}
+		err = es.putReindexerMeta(client, indexName, meta)
+	}
+	if err != nil {
+		log.WithError(err).WithField("index", indexName).Error("unable to restore recorded alias filter after stopping migration")
+	}
+}
+
+// loadAliasFilter returns the alias filter previously recorded by saveAliasFilter, or an empty string if there was none
+func (es *esService) loadAliasFilter(client *elastic.Client, indexName string, aliasName string) (string, error) {
+	meta, err := es.reindexerMeta(client, indexName)
+	if err != nil {
+		return "", err
+	}
+
+	filters, _ := meta["alias_filters"].(map[string]interface{})
+	filter, found := filters[aliasName]
+	if !found || filter == nil {
+		return "", nil
+	}
+
+	b, err := json.Marshal(filter)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// indexMeta returns the whole _meta object of the index mapping
+func (es *esService) indexMeta(client *elastic.Client, indexName string) (map[string]interface{}, error) {
+	mappings, err := client.GetMapping().Index(indexName).Do(context.Background())
+	if err != nil {
+		return nil, err
+	}
+
+	index, _ := mappings[indexName].(map[string]interface{})
+	mapping, _ := index["mappings"].(map[string]interface{})
+	meta, _ := mapping["_meta"].(map[string]interface{})
+	if meta == nil {
+		meta = make(map[string]interface{})
+	}
+	return meta, nil
+}
+
+func (es *esService) reindexerMeta(client *elastic.Client, indexName string) (map[string]interface{}, error) {
+	meta, err := es.indexMeta(client, indexName)
+	if err != nil {
+		return nil, err
+	}
+
+	reindexerMeta, _ := meta[reindexerMetaKey].(map[string]interface{})
+	if reindexerMeta == nil {
+		reindexerMeta = make(map[string]interface{})
+	}
+	return reindexerMeta, nil
+}
+
+// putReindexerMeta replaces the reindexer's own entry in the _meta object, keeping anything else defined by the mapping file
+func (es *esService) putReindexerMeta(client *elastic.Client, indexName string, reindexerMeta map[string]interface{}) error {
+	meta, err := es.indexMeta(client, indexName)
+	if err != nil {
+		return err
+	}
+	meta[reindexerMetaKey] = reindexerMeta
+
+	body, err := json.Marshal(map[string]interface{}{"_meta": meta})
+	if err != nil {
+		return err
+	}
+
+	_, err = client.PutMapping().Index(indexName).BodyString(string(body)).Do(context.Background())
+	return err
+}
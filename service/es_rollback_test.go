@@ -0,0 +1,24 @@
+package service
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIsAliasIndex(t *testing.T) {
+	versions := map[string]bool{
+		"concepts-1.0.0":                       true,
+		"concepts-1.0.1-rc.1":                  true,
+		"concepts-2":                           true,
+		"concepts-people-v2":                   false,
+		"concepts-people-1.0.0":                false,
+		"concepts-next":                        false,
+		"concepts":                             false,
+		"content-1.0.0":                        false,
+		"elasticsearch-reindexer-validation-1": false,
+	}
+	for indexName, expected := range versions {
+		assert.Equal(t, expected, isAliasIndex("concepts", indexName), "version of concepts: %s", indexName)
+	}
+}
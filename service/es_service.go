@@ -4,7 +4,7 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"io/ioutil"
+	"net/http"
 	"strings"
 	"sync"
 	"time"
@@ -16,15 +16,71 @@ import (
 )
 
 var (
-	ErrNoIndexVersion  = errors.New("No index version has been specified")
-	ErrNoElasticClient = errors.New("No ElasticSearch client available")
+	ErrNoIndexVersion        = errors.New("No index version has been specified")
+	ErrNoElasticClient       = errors.New("No ElasticSearch client available")
+	ErrReindexTaskFailed     = errors.New("Reindex task failed")
+	ErrNoPreviousIndex       = errors.New("No previous index version to roll back to")
+	ErrVersionRolledBack     = errors.New("Index version was rolled back")
+	ErrMigrationRunning      = errors.New("An index migration is in progress")
+	ErrMappingUpdateRejected = errors.New("Mapping update was rejected")
 )
 
 type EsHealthService interface {
 	GTG() gtg.Status
-	ConnectivityHealthyCheck() fthealth.Check
-	ClusterIsHealthyCheck() fthealth.Check
-	IndexMappingsCheck() fthealth.Check
+	HealthChecks() []fthealth.Check
+	MetricsHandler() http.Handler
+}
+
+// MigrationOptions are the optional behaviours of MigrateIndex
+type MigrationOptions struct {
+	// InPlaceMappingUpdates applies mapping changes which only add fields to the current index, instead of reindexing
+	InPlaceMappingUpdates bool
+	// InPlaceSettingsUpdates applies settings changes to the current index, closing it for static ones, instead of reindexing
+	InPlaceSettingsUpdates bool
+	// ZeroDowntime copies the documents while the current index stays writable, and only blocks writes for a final catch-up pass
+	ZeroDowntime bool
+	// DeltaField is the field used to find the documents written since the previous pass: a timestamp field, or _seq_no
+	DeltaField string
+	// MaxDeltaPasses is the number of catch-up passes run while the current index is writable
+	MaxDeltaPasses int
+	// FinalPassThreshold is the number of outstanding documents below which the final, write-blocked pass is started
+	FinalPassThreshold int
+	// ReindexSlices is the number of slices each reindex runs in parallel, or auto to use one slice per shard
+	ReindexSlices string
+	// ReindexBatchSize is the number of documents read from the source index per scroll request
+	ReindexBatchSize int
+	// RequestsPerSecond throttles each reindex, or leaves it unthrottled if not positive
+	RequestsPerSecond int
+	// TransformFile is an optional file with a script or an ingest pipeline applied to the documents while reindexing
+	TransformFile string
+	// SourceCluster is the cluster holding the index behind the alias to copy the documents from, if it is not the destination cluster
+	SourceCluster *EsAccessConfig
+	// RemoteReindex is how documents are copied from the source cluster: remote, client, or auto to fall back to client if remote is not allowed
+	RemoteReindex string
+	// Retention closes or deletes superseded index versions after each successful migration
+	Retention RetentionPolicy
+	// SnapshotRepository is the repository the current index is snapshotted into before the migration blocks writes to it, if set
+	SnapshotRepository string
+	// SnapshotLocation registers the snapshot repository as a shared file system repository at this path, if set
+	SnapshotLocation string
+	// Verify compares the document counts and a random sample of documents of the new and source indices before moving the aliases
+	Verify bool
+	// VerifySampleSize is the number of documents sampled by the verification
+	VerifySampleSize int
+	// VerifyMaxMismatchRate is the rate of sampled documents which may differ from the source index without failing the migration
+	VerifyMaxMismatchRate float64
+	// SmokeQueriesDir is an optional directory of searches which must succeed against the new index before the aliases are moved
+	SmokeQueriesDir string
+	// CanaryAliasSuffix names an alias, the alias with the suffix, which points at the new index until the migration is promoted
+	CanaryAliasSuffix string
+	// PromotionTimeout is how long a migration with a canary alias waits to be promoted, or defaultPromotionTimeout if not positive
+	PromotionTimeout time.Duration
+	// PromoteOnTimeout promotes the migration when the promotion timeout runs out, instead of failing it
+	PromoteOnTimeout bool
+	// LockOwner identifies the instance in the migration lock, or is the host name and process ID if not set
+	LockOwner string
+	// LockTTL is how long the migration lock is held without a heartbeat before another instance may take it over
+	LockTTL time.Duration
 }
 
 type esService struct {
@@ -33,34 +89,73 @@ type esService struct {
 	aliasName           string
 	mappingFile         string
 	aliasFilterFile     string
+	settingsFile        string
 	indexVersion        string
 	pollReindexInterval time.Duration
 	progress            string
 	migrationCheck      bool
 	migrationErr        error
+	validated           bool
+	validationErr       error
 	panicGuideUrl       string
 	aliasForAllConcepts string
+	extraAliases        []string
+	options             MigrationOptions
+	reindexTaskID       string
+	sourceClient        *elastic.Client
+	migrations          map[string]*Migration
+	currentMigration    *Migration
+	historyIndexReady   bool
+	locksIndexReady     bool
+	lease               *migrationLease
+	metrics             *migrationMetrics
 }
 
-func NewEsService(ch chan *elastic.Client, aliasName string, mappingFile string, aliasFilterFile string,
-	indexVersion string, panicGuideUrl string, aliasForAllConcepts string) *esService {
+func NewEsService(ch chan *elastic.Client, aliasName string, mappingFile string, aliasFilterFile string, settingsFile string,
+	indexVersion string, panicGuideUrl string, aliasForAllConcepts string, options MigrationOptions) *esService {
+	es := newEsService(aliasName, mappingFile, aliasFilterFile, settingsFile, indexVersion, panicGuideUrl, aliasForAllConcepts, options)
+	go func() {
+		for ec := range ch {
+			es.connect(ec)
+		}
+	}()
+	return es
+}
+
+// connect injects the connection to the cluster, and migrates the index to the configured version
+func (es *esService) connect(ec *elastic.Client) {
+	es.setElasticClient(ec)
+
+	es.Lock()
+	migration := es.newMigration(es.indexVersion, es.mappingFile)
+	es.Unlock()
+	es.runMigration(migration)
+}
+
+// NewEsCommandService returns a service for one-off CLI commands, which does not migrate the index on connection
+func NewEsCommandService(ec *elastic.Client, aliasName string, mappingFile string, aliasFilterFile string, settingsFile string,
+	indexVersion string, aliasForAllConcepts string, options MigrationOptions) *esService {
+	es := newEsService(aliasName, mappingFile, aliasFilterFile, settingsFile, indexVersion, "", aliasForAllConcepts, options)
+	es.elasticClient = ec
+	es.migrationCheck = true
+	return es
+}
+
+func newEsService(aliasName string, mappingFile string, aliasFilterFile string, settingsFile string,
+	indexVersion string, panicGuideUrl string, aliasForAllConcepts string, options MigrationOptions) *esService {
 	es := &esService{
 		aliasName:           aliasName,
 		mappingFile:         mappingFile,
 		aliasFilterFile:     aliasFilterFile,
+		settingsFile:        settingsFile,
 		indexVersion:        indexVersion,
 		pollReindexInterval: time.Minute,
 		progress:            "not started",
 		panicGuideUrl:       panicGuideUrl,
 		aliasForAllConcepts: aliasForAllConcepts,
+		options:             options,
 	}
-	go func() {
-		for ec := range ch {
-			es.setElasticClient(ec)
-			es.migrationErr = es.MigrateIndex()
-			es.migrationCheck = true
-		}
-	}()
+	es.metrics = newMigrationMetrics(aliasName)
 	return es
 }
 
@@ -105,6 +200,17 @@ func (es *esService) esClient() *elastic.Client {
 	return es.elasticClient
 }
 
+// HealthChecks are the checks of the cluster and of the index behind the alias
+func (es *esService) HealthChecks() []fthealth.Check {
+	return []fthealth.Check{
+		es.ConnectivityHealthyCheck(),
+		es.ClusterIsHealthyCheck(),
+		es.IndexMappingsCheck(),
+		es.MappingDiffCheck(),
+		es.FilesValidCheck(),
+	}
+}
+
 func (es *esService) ClusterIsHealthyCheck() fthealth.Check {
 	return fthealth.Check{
 		BusinessImpact:   "Full or partial degradation in serving requests from Elasticsearch",
@@ -165,20 +271,28 @@ func (es *esService) IndexMappingsCheck() fthealth.Check {
 }
 
 func (es *esService) mappingsChecker() (string, error) {
+	es.RLock()
+	defer es.RUnlock()
+
 	if es.migrationErr != nil {
 		return "Elasticsearch mappings were not migrated successfully", es.migrationErr
 	}
 
 	if !es.migrationCheck {
-		msg := fmt.Sprintf("Elasticsearch mappings migration to version %s is in progress (%s)", es.indexVersion, es.progress)
+		version := es.indexVersion
+		if es.currentMigration != nil {
+			version = es.currentMigration.Version
+		}
+		msg := fmt.Sprintf("Elasticsearch mappings migration to version %s is in progress (%s)", version, es.progress)
 		return msg, errors.New(msg)
 	}
 
 	return fmt.Sprintf("Elasticsearch mappings are at version %s", es.indexVersion), nil
 }
 
-func (es *esService) MigrateIndex() error {
-	if len(es.indexVersion) == 0 {
+func (es *esService) MigrateIndex() (err error) {
+	indexVersion, _ := es.migrationTarget()
+	if len(indexVersion) == 0 {
 		log.Error(ErrNoIndexVersion.Error())
 		return ErrNoIndexVersion
 	}
@@ -188,92 +302,320 @@ func (es *esService) MigrateIndex() error {
 		return err
 	}
 
-	es.progress = "starting"
 	client := es.esClient()
+	// the migration is planned once the lock is held, as another instance may have migrated the index meanwhile
+	lease, err := es.acquireMigrationLock(client)
+	if err != nil {
+		return err
+	}
+	defer es.releaseMigrationLock(client, lease)
+	es.setProgress("starting")
 
-	requireUpdate, currentIndexName, newIndexName, err := es.checkIndexAliases(client, es.aliasName)
+	plan, err := es.planMigration(client)
+	if errors.Is(err, ErrValidationFailed) {
+		es.setValidationResult(err)
+	}
 	if err != nil {
-		log.WithError(err).Error(fmt.Sprintf("unable to read alias definition for %s alias", es.aliasName))
 		return err
 	}
-	if !requireUpdate {
-		log.WithField("index", es.indexVersion).Info(fmt.Sprintf("index with %s alias is up-to-date", es.aliasName))
+	es.setMigrationPlan(plan)
+	if plan.RolledBack {
+		err = fmt.Errorf("%w: %s was rolled back from version %s, which is not migrated to again", ErrVersionRolledBack, plan.CurrentIndex, plan.IndexVersion)
+		log.WithError(err).Warn("index version was rolled back, deploy another version to migrate the index")
+		return err
+	}
+	if !plan.UpdateRequired {
+		log.WithField("index", plan.IndexVersion).Info(fmt.Sprintf("index with %s alias is up-to-date", es.aliasName))
+		es.validateUpToDateFiles(client)
 		return nil
 	}
 
-	mapping, err := ioutil.ReadFile(es.mappingFile)
+	err = es.validateFiles(client, plan.mapping, plan.aliasFilter)
 	if err != nil {
-		log.WithError(err).Error("unable to read new index mapping definition")
+		log.WithError(err).Error("invalid mapping or alias filter")
+		return err
+	}
+	if err = es.checkCancelled(); err != nil {
+		return err
+	}
+	if err = lease.check(); err != nil {
 		return err
 	}
+	es.setMigrationIndices(plan.SourceIndex, plan.NewIndex)
+
+	if plan.InPlace {
+		es.setPhase(PhaseCreating)
+		err = es.updateMappingInPlace(client, plan)
+		if err == nil {
+			log.WithFields(map[string]interface{}{"index": plan.CurrentIndex, "version": plan.IndexVersion}).Info("index mapping updated in place")
+			if es.options.Verify {
+				// no documents were copied, so there is nothing to compare
+				es.setMigrationVerification(&VerificationResult{CountCheck: countSkipped, Skipped: "in-place update"})
+			}
+			return nil
+		}
+		if !errors.Is(err, ErrMappingUpdateRejected) && !errors.Is(err, ErrSettingsUpdateRejected) {
+			log.WithError(err).Error("unable to update index mapping in place")
+			return err
+		}
+
+		log.WithError(err).Warn("index mapping could not be updated in place, falling back to a full reindex")
+		es.recordMigrationError(err)
+		es.planReindex(plan)
+		es.setMigrationPlan(plan)
+		es.setMigrationIndices(plan.SourceIndex, plan.NewIndex)
+	}
+	currentIndexName, newIndexName := plan.CurrentIndex, plan.NewIndex
 
-	err = es.createIndex(client, newIndexName, string(mapping))
+	if err = lease.check(); err != nil {
+		return err
+	}
+	es.setPhase(PhaseCreating)
+	state, err := es.prepareTargetIndex(client, plan)
 	if err != nil {
 		log.WithError(err).Error("unable to create new index")
 		return err
 	}
+	// whatever fails from here on, the current index is left writable and behind the aliases
+	var previousFilter *aliasFilterRecord
+	defer func() {
+		if err == nil {
+			return
+		}
+		if errors.Is(err, ErrMigrationLockLost) {
+			// the indices are left alone if another instance is migrating them
+			if es.lockTakenOver(client, lease) {
+				return
+			}
+			log.WithField("alias", es.aliasName).Warn("migration lock expired without being taken over, undoing migration")
+			if len(state.Task) > 0 {
+				if cancelErr := es.cancelTask(client, state.Task); cancelErr != nil {
+					log.WithError(cancelErr).WithField("task", state.Task).Warn("unable to cancel reindex task")
+				}
+			}
+		}
+		if errors.Is(err, ErrMigrationCancelled) {
+			es.deleteMigrationSnapshot(client, state)
+		}
+		es.undoMigration(client, plan, state, errors.Is(err, ErrMigrationCancelled) && es.cancelDeletesTarget())
+		if previousFilter != nil {
+			es.restoreAliasFilter(client, currentIndexName, es.aliasName, previousFilter)
+		}
+	}()
 
 	if len(currentIndexName) > 0 {
-		err = es.setReadOnly(client, currentIndexName)
+		previousFilter, err = es.saveAliasFilter(client, currentIndexName, es.aliasName)
+		if err != nil {
+			log.WithError(err).Error("unable to record current alias filter")
+			return err
+		}
+	}
+
+	if plan.ReindexRequired {
+		if err = lease.check(); err != nil {
+			return err
+		}
+		sourceIndexName := plan.SourceIndex
+		source, err := es.sourceEsClient(client)
 		if err != nil {
-			log.WithError(err).Error("unable to set index read-only")
+			log.WithError(err).Error("unable to connect to source cluster")
 			return err
 		}
 
-		completeCount, err := es.reindex(client, currentIndexName, newIndexName)
+		err = es.createTransformPipeline(client, plan.transform, newIndexName)
 		if err != nil {
-			log.WithError(err).Error("failed to begin reindex")
+			log.WithError(err).Error("unable to create transform pipeline")
 			return err
 		}
+		defer es.deleteTransformPipeline(client, plan.transform)
+
+		if len(es.options.SnapshotRepository) > 0 {
+			err = es.snapshotSourceIndex(client, source, sourceIndexName, newIndexName, state)
+			if err != nil {
+				log.WithError(err).Error("unable to snapshot current index")
+				return err
+			}
+		}
 
-		taskErrCount := 0
-		for {
-			finished, done, err := es.isTaskComplete(client, newIndexName, completeCount)
-			es.progress = fmt.Sprintf("%v / %v documents reindexed", done, completeCount)
+		if es.options.ZeroDowntime {
+			err = es.reindexWithCatchUp(client, sourceIndexName, newIndexName, state, plan.transform)
 			if err != nil {
-				log.WithError(err).Error("failed to obtain reindex task status")
-				taskErrCount++
-				if taskErrCount == 3 {
+				return err
+			}
+			if !es.catchUpOnPromotion() {
+				err = es.finishCatchUp(client, sourceIndexName, newIndexName, state, plan.transform)
+				if err != nil {
 					return err
 				}
 			}
+		} else {
+			if err = es.checkCancelled(); err != nil {
+				return err
+			}
 
-			if finished {
-				break
+			es.setPhase(PhaseBlocking)
+			err = es.setReadOnly(source, sourceIndexName)
+			if err != nil {
+				log.WithError(err).Error("unable to set index read-only")
+				return err
 			}
 
-			time.Sleep(es.pollReindexInterval)
+			taskID, completeCount, err := es.startOrResumeReindex(client, sourceIndexName, newIndexName, state, plan.transform)
+			if err != nil {
+				log.WithError(err).Error("failed to begin reindex")
+				return err
+			}
+
+			// there is no task to wait for if the reindexer copied the documents itself
+			if len(taskID) > 0 {
+				err = es.waitForReindex(client, taskID, "", completeCount)
+				if err != nil {
+					return err
+				}
+			}
+
+			// an interrupted migration may have allowed writes to the source index again while it waited to be promoted
+			if state.Released {
+				err = es.reindexDelta(client, sourceIndexName, newIndexName, state.Checkpoint, plan.transform, "catch-up pass")
+				if err != nil {
+					return err
+				}
+			}
 		}
-	}
 
-	var aliasFilter string
-	if len(es.aliasFilterFile) > 0 {
-		aliasFilterBytes, err := ioutil.ReadFile(es.aliasFilterFile)
+		es.setPhase(PhaseVerifying)
+		_, err = client.Refresh(newIndexName).Do(context.Background())
 		if err != nil {
-			log.WithError(err).Error("unable to read alias filter")
+			log.WithError(err).Error("unable to refresh new index")
 			return err
 		}
-		aliasFilter = string(aliasFilterBytes)
+		count, err := elastic.NewCountService(client).Index(newIndexName).Do(context.Background())
+		if err != nil {
+			log.WithError(err).Error("unable to count documents in new index")
+			return err
+		}
+		log.WithFields(map[string]interface{}{"index": newIndexName, "documents": count}).Info("new index populated")
+
+		if es.options.Verify {
+			err = es.verifyMigration(client, source, sourceIndexName, newIndexName, plan.transform, es.verificationCountCheck(state))
+			if err != nil {
+				log.WithError(err).Error("verification of new index failed")
+				return err
+			}
+		}
 	}
 
-	err = es.updateAlias(client, es.aliasName, aliasFilter, currentIndexName, newIndexName)
-	if err != nil {
-		log.WithError(err).Error(fmt.Sprintf("failed to update alias %s", es.aliasName))
-		return err
+	if len(es.options.SmokeQueriesDir) > 0 {
+		err = es.runSmokeTests(client, plan.aliasFilter, currentIndexName, newIndexName)
+		if err != nil {
+			log.WithError(err).Error("smoke tests against new index failed")
+			return err
+		}
 	}
 
-	if strings.TrimSpace(es.aliasForAllConcepts) != "" {
-		err = es.updateAlias(client, es.aliasForAllConcepts, "", currentIndexName, newIndexName)
+	if canary := es.canaryAlias(); len(canary) > 0 {
+		// writes to the source index are only blocked once the migration is promoted, which may take a long time
+		if plan.ReindexRequired && es.catchUpOnPromotion() {
+			err = es.releaseSourceIndex(client, plan, state)
+			if err != nil {
+				log.WithError(err).Error("unable to allow writes to current index while waiting for promotion")
+				return err
+			}
+		}
+
+		err = es.awaitPromotion(client, plan.aliasFilter, newIndexName)
 		if err != nil {
-			log.WithError(err).Error(fmt.Sprintf("failed to update alias %s", es.aliasForAllConcepts))
+			log.WithError(err).Error("new index was not promoted")
 			return err
 		}
+
+		if plan.ReindexRequired && es.catchUpOnPromotion() {
+			err = es.finishCatchUp(client, plan.SourceIndex, newIndexName, state, plan.transform)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	if err = lease.check(); err != nil {
+		return err
+	}
+	err = es.startAliasing()
+	if err != nil {
+		return err
+	}
+	es.recordMigration()
+	// the aliases are moved in a single request, so that they are either both moved or both left on the current index
+	aliasService := es.aliasActions(elastic.NewAliasService(client), es.aliasName, plan.aliasFilter, currentIndexName, newIndexName)
+	for _, alias := range es.unfilteredAliases() {
+		aliasService = es.aliasActions(aliasService, alias, "", currentIndexName, newIndexName)
+	}
+	if canary := es.canaryAlias(); len(canary) > 0 {
+		aliasService = aliasService.Remove(newIndexName, canary)
+	}
+
+	_, err = aliasService.Do(context.Background())
+	if err != nil {
+		log.WithError(err).Error(fmt.Sprintf("failed to update aliases of %s", es.aliasName))
+		return err
 	}
 	log.WithFields(map[string]interface{}{"from": currentIndexName, "to": newIndexName}).Info("index migration completed")
 
 	return nil
 }
 
+// waitForReindex polls the reindex task until it has finished, reporting its progress in the migration health check
+func (es *esService) waitForReindex(client *elastic.Client, taskID string, stage string, completeCount int) error {
+	es.setRunningReindexTask(taskID)
+	defer es.setRunningReindexTask("")
+	es.startReindexProgress(completeCount)
+
+	taskErrCount := 0
+	for {
+		finished, status, err := es.isTaskComplete(client, taskID)
+		if errors.Is(err, ErrReindexTaskFailed) {
+			log.WithError(err).WithField("task", taskID).Error("reindex task failed")
+			return err
+		}
+		if err != nil {
+			log.WithError(err).Error("failed to obtain reindex task status")
+			es.recordMigrationError(err)
+			taskErrCount++
+			if taskErrCount == 3 {
+				// the task would otherwise carry on writing to the new index after the migration has given up on it
+				if cancelErr := es.cancelTask(client, taskID); cancelErr != nil {
+					log.WithError(cancelErr).WithField("task", taskID).Error("unable to cancel reindex task")
+				}
+				return err
+			}
+		} else {
+			progress := fmt.Sprintf("%v / %v documents reindexed", status.done(), completeCount)
+			if len(stage) > 0 {
+				progress = fmt.Sprintf("%s: %s", stage, progress)
+			}
+			es.setProgress(progress)
+			es.reindexProgress(status.done())
+		}
+
+		if finished {
+			log.WithFields(map[string]interface{}{"task": taskID, "total": status.Total, "created": status.Created, "updated": status.Updated}).Info("reindex task completed")
+			return nil
+		}
+
+		select {
+		case <-es.cancelSignal():
+			if err := es.cancelTask(client, taskID); err != nil {
+				log.WithError(err).WithField("task", taskID).Error("unable to cancel reindex task")
+			}
+			return ErrMigrationCancelled
+		case <-es.lockLostSignal():
+			// the task is left for the instance which took over the lock to reattach to
+			return ErrMigrationLockLost
+		case <-time.After(es.pollReindexInterval):
+		}
+	}
+}
+
 func (es *esService) checkIndexAliases(client *elastic.Client, aliasName string) (bool, string, string, error) {
 	aliasesService := elastic.NewAliasesService(client)
 	aliasesResult, err := aliasesService.Do(context.Background())
@@ -281,20 +623,34 @@ func (es *esService) checkIndexAliases(client *elastic.Client, aliasName string)
 		return false, "", "", err
 	}
 
+	indexVersion, _ := es.migrationTarget()
 	aliasedIndices := aliasesResult.IndicesByAlias(aliasName)
 	switch len(aliasedIndices) {
 	case 0:
 		log.WithField("alias", aliasName).Info("no current index alias")
-		requiredIndex := fmt.Sprintf("%s-%s", aliasName, es.indexVersion)
+		requiredIndex := fmt.Sprintf("%s-%s", aliasName, indexVersion)
 
 		return true, "", requiredIndex, nil
 
 	case 1:
 		log.WithFields(map[string]interface{}{"alias": aliasName, "index": aliasedIndices[0]}).Info("current index alias")
-		requiredIndex := fmt.Sprintf("%s-%s", aliasName, es.indexVersion)
+		requiredIndex := fmt.Sprintf("%s-%s", aliasName, indexVersion)
 		log.WithField("index", requiredIndex).Info("comparing to required index alias")
+		if aliasedIndices[0] == requiredIndex {
+			return false, aliasedIndices[0], requiredIndex, nil
+		}
+
+		// the version may have been applied to the current index by an in-place mapping update
+		version, err := es.registeredIndexVersion(client, aliasedIndices[0])
+		if err != nil {
+			return false, "", "", err
+		}
+		if version == indexVersion {
+			log.WithFields(map[string]interface{}{"index": aliasedIndices[0], "version": version}).Info("index version was updated in place")
+			return false, aliasedIndices[0], aliasedIndices[0], nil
+		}
 
-		return !(aliasedIndices[0] == requiredIndex), aliasedIndices[0], requiredIndex, nil
+		return true, aliasedIndices[0], requiredIndex, nil
 
 	default:
 		return false, "", "", fmt.Errorf("alias %s points to multiple indices: %v", aliasName, aliasedIndices)
@@ -319,41 +675,108 @@ func (es *esService) setReadOnly(client *elastic.Client, indexName string) error
 	return err
 }
 
-func (es *esService) reindex(client *elastic.Client, fromIndex string, toIndex string) (int, error) {
+// setWritable removes the write block, resetting the setting to its default rather than leaving it set to false
+func (es *esService) setWritable(client *elastic.Client, indexName string) error {
+	log.WithField("index", indexName).Info("Setting to writable")
+
+	indexService := elastic.NewIndicesPutSettingsService(client)
+	_, err := indexService.Index(indexName).BodyJson(map[string]interface{}{"index.blocks.write": nil}).Do(context.Background())
+
+	return err
+}
+
+func (es *esService) reindex(client *elastic.Client, fromIndex string, toIndex string, transform *reindexTransform) (string, int, error) {
 	log.WithFields(map[string]interface{}{"from": fromIndex, "to": toIndex}).Info("reindexing")
 
+	// the destination must already exist, otherwise the reindex would create it with a dynamic mapping
 	counter := elastic.NewCountService(client)
-	count, err := counter.Index(toIndex).Do(context.Background())
+	_, err := counter.Index(toIndex).Do(context.Background())
 	if err != nil {
-		return 0, err
+		return "", 0, err
 	}
 
 	counter = elastic.NewCountService(client)
-	count, err = counter.Index(fromIndex).Do(context.Background())
+	count, err := counter.Index(fromIndex).Do(context.Background())
 	if err != nil {
-		return 0, err
+		return "", 0, err
 	}
 
-	indexService := elastic.NewReindexService(client)
-	_, err = indexService.SourceIndex(fromIndex).DestinationIndex(toIndex).WaitForCompletion(false).Do(context.Background())
+	indexService, err := es.newReindexService(client)
+	if err != nil {
+		return "", 0, err
+	}
 
+	// documents which are already in the destination are skipped, so that an interrupted copy can be restarted
+	destination := elastic.NewReindexDestination().Index(toIndex).OpType("create")
+	transform.apply(indexService, destination)
+
+	task, err := indexService.
+		Source(es.newReindexSource(fromIndex)).
+		Destination(destination).
+		Conflicts("proceed").
+		DoAsync(context.Background())
 	if err != nil {
-		return 0, err
+		return "", 0, err
 	}
 
-	return int(count), err
+	log.WithField("task", task.TaskId).Info("reindex task started")
+	return task.TaskId, int(count), nil
 }
 
-func (es *esService) isTaskComplete(client *elastic.Client, indexName string, completeCount int) (bool, int, error) {
-	counter := elastic.NewCountService(client)
-	count, err := counter.Index(indexName).Do(context.Background())
-	return int(count) == completeCount, int(count), err
+// isTaskComplete reports whether the reindex task has finished. An error wrapping ErrReindexTaskFailed is returned
+// if the task itself failed or reported per-document failures; any other error means the status could not be read.
+func (es *esService) isTaskComplete(client *elastic.Client, taskID string) (bool, reindexTaskStatus, error) {
+	task, err := es.getReindexTask(client, taskID)
+	if err != nil {
+		return false, reindexTaskStatus{}, err
+	}
+
+	if !task.Completed {
+		return false, task.Task.Status, nil
+	}
+
+	if task.Error != nil {
+		return true, task.Task.Status, fmt.Errorf("%w: task %s: %s", ErrReindexTaskFailed, taskID, task.Error)
+	}
+
+	if task.Response == nil {
+		return true, task.Task.Status, nil
+	}
+
+	status := task.Response.reindexTaskStatus
+	if len(task.Response.Canceled) > 0 {
+		return true, status, fmt.Errorf("%w: task %s was cancelled: %s", ErrReindexTaskFailed, taskID, task.Response.Canceled)
+	}
+
+	if len(task.Response.Failures) > 0 {
+		first := task.Response.Failures[0]
+		return true, status, fmt.Errorf("%w: task %s reported %d failed documents (created %d, updated %d), first failure for document %s: %s",
+			ErrReindexTaskFailed, taskID, len(task.Response.Failures), status.Created, status.Updated, first.ID, &first.Cause)
+	}
+
+	return true, status, nil
 }
 
 func (es *esService) updateAlias(client *elastic.Client, aliasName string, aliasFilter string, oldIndexName string, newIndexName string) error {
+	aliasService := es.aliasActions(elastic.NewAliasService(client), aliasName, aliasFilter, oldIndexName, newIndexName)
+	_, err := aliasService.Do(context.Background())
+
+	return err
+}
+
+// unfilteredAliases are the aliases which are moved along with the alias, without its filter
+func (es *esService) unfilteredAliases() []string {
+	var aliases []string
+	if strings.TrimSpace(es.aliasForAllConcepts) != "" {
+		aliases = append(aliases, es.aliasForAllConcepts)
+	}
+	return append(aliases, es.extraAliases...)
+}
+
+// aliasActions adds the actions that move an alias from one index to another, so that several aliases can be moved in a single atomic request
+func (es *esService) aliasActions(aliasService *elastic.AliasService, aliasName string, aliasFilter string, oldIndexName string, newIndexName string) *elastic.AliasService {
 	log.WithFields(map[string]interface{}{"alias": aliasName, "from": oldIndexName, "to": newIndexName, "filter": aliasFilter}).Info("updating index alias")
 
-	aliasService := elastic.NewAliasService(client)
 	if len(oldIndexName) > 0 {
 		aliasService = aliasService.Remove(oldIndexName, aliasName)
 	}
@@ -364,7 +787,5 @@ func (es *esService) updateAlias(client *elastic.Client, aliasName string, alias
 		aliasService = aliasService.Add(newIndexName, aliasName)
 	}
 
-	_, err := aliasService.Do(context.Background())
-
-	return err
+	return aliasService
 }
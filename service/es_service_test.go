@@ -4,11 +4,15 @@
 package service
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
+	"net/http"
 	"os"
+	"path/filepath"
 	"regexp"
 	"strconv"
 	"strings"
@@ -25,16 +29,24 @@ import (
 )
 
 const (
-	apiBaseURL          = "http://test.api.ft.com"
-	testIndexName       = "test-index"
-	testIndexVersion    = "0.0.1"
-	esTopicType         = "topics"
-	ftTopicType         = "http://www.ft.com/ontology/Topic"
-	testOldMappingFile  = "test/old-mapping.json"
-	testNewMappingFile  = "test/new-mapping.json"
-	testAliasFilterFile = "test/alias-filter.json"
-	size                = 100
-	aliasForAllConcepts = "aliasForAllConcepts"
+	apiBaseURL              = "http://test.api.ft.com"
+	testIndexName           = "test-index"
+	testIndexVersion        = "0.0.1"
+	esTopicType             = "topics"
+	ftTopicType             = "http://www.ft.com/ontology/Topic"
+	testOldMappingFile      = "test/old-mapping.json"
+	testNewMappingFile      = "test/new-mapping.json"
+	testAliasFilterFile     = "test/alias-filter.json"
+	testTransformScript     = "test/transform-script.json"
+	testTransformPipeline   = "test/transform-pipeline.json"
+	testStrictMappingFile   = "test/strict-mapping.json"
+	testBreakingMappingFile = "test/breaking-mapping.json"
+	testSmokeQueriesDir     = "test/smoke-queries"
+	testSettingsFile        = "test/settings.json"
+	testSnapshotRepository  = "test-snapshots"
+	testSnapshotLocation    = "/tmp/snapshots"
+	size                    = 100
+	aliasForAllConcepts     = "aliasForAllConcepts"
 )
 
 var (
@@ -156,6 +168,8 @@ func (s *EsServiceTestSuite) SetupTest() {
 	_, _ = s.ec.Alias().Remove(testNewIndexName, aliasForAllConcepts).Do(context.Background())
 	_, _ = s.ec.DeleteIndex(testOldIndexName).Do(context.Background())
 	_, _ = s.ec.DeleteIndex(testNewIndexName).Do(context.Background())
+	_, _ = s.ec.DeleteIndex(migrationsIndex).Do(context.Background())
+	_, _ = s.ec.DeleteIndex(locksIndex).Do(context.Background())
 
 	err := createIndex(s.ec, testOldIndexName, testOldMappingFile)
 	require.NoError(s.T(), err, "expected no error in creating index")
@@ -315,39 +329,155 @@ func (s *EsServiceTestSuite) TestReindexAndWait() {
 	err := createIndex(s.ec, testNewIndexName, testNewMappingFile)
 	require.NoError(s.T(), err, "expected no error for creating new index")
 
-	count, err := s.service.reindex(s.ec, testOldIndexName, testNewIndexName)
+	taskID, count, err := s.service.reindex(s.ec, testOldIndexName, testNewIndexName, nil)
 	assert.NoError(s.T(), err, "expected no error for starting reindex")
+	assert.NotEmpty(s.T(), taskID, "reindex task id")
+	assert.Equal(s.T(), size, count, "index size")
 
-	complete, done, err := s.service.isTaskComplete(s.ec, testNewIndexName, count)
+	complete, status, err := s.service.isTaskComplete(s.ec, taskID)
 	assert.NoError(s.T(), err, "expected no error for monitoring task completion")
-	assert.Equal(s.T(), size, count, "index size")
 
 	if !complete {
-		assert.True(s.T(), done < count, "not all documents have been reindexed yet")
-
 		// 100 documents may not reindex immediately but should only take a few seconds
 		time.Sleep(5 * time.Second)
-		complete, done, err = s.service.isTaskComplete(s.ec, testNewIndexName, count)
+		complete, status, err = s.service.isTaskComplete(s.ec, taskID)
 		assert.NoError(s.T(), err, "expected no error for monitoring task completion")
 		assert.True(s.T(), complete, "expected reindex to be complete")
 	}
-	assert.Equal(s.T(), size, done, "all documents have been reindexed")
+	assert.Equal(s.T(), size, status.Created, "all documents have been reindexed")
+	assert.Equal(s.T(), size, status.done(), "all documents have been reindexed")
+
+	_, err = s.ec.Refresh(testNewIndexName).Do(context.Background())
+	require.NoError(s.T(), err, "expected no error for refreshing new index")
 
 	actual, err := s.ec.Count(testNewIndexName).Do(context.Background())
 	assert.NoError(s.T(), err, "expected no error for checking index size")
 	assert.Equal(s.T(), size, int(actual), "expected new index to contain same number of documents as original index")
 }
 
+func (s *EsServiceTestSuite) TestReindexTaskFailures() {
+	s.service = esService{}
+	s.forNextIndexVersion()
+	err := createIndex(s.ec, testNewIndexName, testStrictMappingFile)
+	require.NoError(s.T(), err, "expected no error for creating new index")
+
+	taskID, _, err := s.service.reindex(s.ec, testOldIndexName, testNewIndexName, nil)
+	require.NoError(s.T(), err, "expected no error for starting reindex")
+
+	complete, _, err := s.service.isTaskComplete(s.ec, taskID)
+	if !complete {
+		time.Sleep(5 * time.Second)
+		complete, _, err = s.service.isTaskComplete(s.ec, taskID)
+	}
+	assert.True(s.T(), complete, "expected reindex to be complete")
+	assert.Error(s.T(), err, "expected error for reindex task with rejected documents")
+	assert.True(s.T(), errors.Is(err, ErrReindexTaskFailed), "expected reindex task failure")
+	assert.Contains(s.T(), err.Error(), "strict_dynamic_mapping_exception", "error message")
+}
+
+func (s *EsServiceTestSuite) TestReindexTaskNotFound() {
+	s.service = esService{}
+
+	complete, _, err := s.service.isTaskComplete(s.ec, "no-such-node:1")
+	assert.False(s.T(), complete, "expected unknown task not to be complete")
+	assert.Error(s.T(), err, "expected error for unknown task")
+	assert.False(s.T(), errors.Is(err, ErrReindexTaskFailed), "expected a status error rather than a task failure")
+}
+
 func (s *EsServiceTestSuite) TestReindexFailure() {
 	s.service = esService{}
 	s.forNextIndexVersion()
 
-	count, err := s.service.reindex(s.ec, testOldIndexName, testNewIndexName)
+	_, count, err := s.service.reindex(s.ec, testOldIndexName, testNewIndexName, nil)
 	assert.Error(s.T(), err, "expected error for starting reindex")
 	assert.Regexp(s.T(), "no such index", err.Error(), "error message")
 	assert.Equal(s.T(), 0, count, "index size")
 }
 
+func (s *EsServiceTestSuite) TestReindexDelta() {
+	s.service = esService{}
+	s.forNextIndexVersion()
+	s.service.pollReindexInterval = time.Second
+	err := createIndex(s.ec, testNewIndexName, testNewMappingFile)
+	require.NoError(s.T(), err, "expected no error for creating new index")
+
+	checkpoint, err := s.service.deltaCheckpoint(s.ec, testOldIndexName)
+	require.NoError(s.T(), err, "expected no error for reading checkpoint")
+	assert.NotEmpty(s.T(), checkpoint, "checkpoint")
+
+	taskID, count, err := s.service.reindex(s.ec, testOldIndexName, testNewIndexName, nil)
+	require.NoError(s.T(), err, "expected no error for starting reindex")
+	err = s.service.waitForReindex(s.ec, taskID, "", count)
+	require.NoError(s.T(), err, "expected no error for reindex")
+
+	err = writeTestConcepts(s.ec, testOldIndexName, esTopicType, ftTopicType, 5)
+	require.NoError(s.T(), err, "expected no error in adding topics")
+
+	outstanding, err := s.service.countDelta(s.ec, testOldIndexName, checkpoint)
+	assert.NoError(s.T(), err, "expected no error for counting outstanding documents")
+	assert.Equal(s.T(), int64(5), outstanding, "documents written since the checkpoint")
+
+	err = s.service.reindexDelta(s.ec, testOldIndexName, testNewIndexName, checkpoint, nil, "catch-up pass")
+	assert.NoError(s.T(), err, "expected no error for catch-up pass")
+
+	_, err = s.ec.Refresh(testNewIndexName).Do(context.Background())
+	require.NoError(s.T(), err, "expected no error for refreshing new index")
+
+	actual, err := s.ec.Count(testNewIndexName).Do(context.Background())
+	assert.NoError(s.T(), err, "expected no error for checking index size")
+	assert.Equal(s.T(), size+5, int(actual), "expected new index to contain the documents written during the copy")
+}
+
+func (s *EsServiceTestSuite) TestReindexSliced() {
+	s.service = esService{options: MigrationOptions{ReindexSlices: "auto", ReindexBatchSize: 10, RequestsPerSecond: 1000}}
+	s.service.pollReindexInterval = time.Second
+	s.forNextIndexVersion()
+	err := createIndex(s.ec, testNewIndexName, testNewMappingFile)
+	require.NoError(s.T(), err, "expected no error for creating new index")
+
+	taskID, count, err := s.service.reindex(s.ec, testOldIndexName, testNewIndexName, nil)
+	require.NoError(s.T(), err, "expected no error for starting reindex")
+
+	err = s.service.waitForReindex(s.ec, taskID, "", count)
+	assert.NoError(s.T(), err, "expected no error for reindex")
+	assert.Empty(s.T(), s.service.runningReindexTask(), "expected no running reindex task after completion")
+
+	_, err = s.ec.Refresh(testNewIndexName).Do(context.Background())
+	require.NoError(s.T(), err, "expected no error for refreshing new index")
+
+	actual, err := s.ec.Count(testNewIndexName).Do(context.Background())
+	assert.NoError(s.T(), err, "expected no error for checking index size")
+	assert.Equal(s.T(), size, int(actual), "expected new index to contain same number of documents as original index")
+}
+
+func (s *EsServiceTestSuite) TestRethrottleReindex() {
+	s.service = esService{options: MigrationOptions{ReindexBatchSize: 1, RequestsPerSecond: 1}}
+	s.service.elasticClient = s.ec
+	s.forNextIndexVersion()
+	err := createIndex(s.ec, testNewIndexName, testNewMappingFile)
+	require.NoError(s.T(), err, "expected no error for creating new index")
+
+	taskID, _, err := s.service.reindex(s.ec, testOldIndexName, testNewIndexName, nil)
+	require.NoError(s.T(), err, "expected no error for starting reindex")
+	s.service.setRunningReindexTask(taskID)
+
+	result, err := s.service.RethrottleReindex(-1)
+	assert.NoError(s.T(), err, "expected no error for rethrottling reindex")
+	assert.Equal(s.T(), taskID, result.Task, "rethrottled task")
+
+	s.service.pollReindexInterval = time.Second
+	err = s.service.waitForReindex(s.ec, taskID, "", size)
+	assert.NoError(s.T(), err, "expected unthrottled reindex to complete")
+}
+
+func (s *EsServiceTestSuite) TestRethrottleReindexNotRunning() {
+	s.service = esService{}
+	s.service.elasticClient = s.ec
+
+	_, err := s.service.RethrottleReindex(100)
+	assert.ErrorIs(s.T(), err, ErrNoReindexRunning, "expected error for rethrottling without a running reindex")
+}
+
 func (s *EsServiceTestSuite) TestUpdateAlias() {
 	s.service = esService{}
 	s.forNextIndexVersion()
@@ -428,21 +558,9 @@ func (s *EsServiceTestSuite) TestUpdateAliasWithFilter() {
 }
 
 func (s *EsServiceTestSuite) TestMigrateIndex() {
-	s.service = esService{}
-	s.forNextIndexVersion()
-
-	_, err := s.ec.IndexPutSettings().BodyJson(map[string]interface{}{"index.number_of_replicas": 0}).Do(context.Background())
-	require.NoError(s.T(), err, "expected no error in modifying replica settings")
-
-	err = createAlias(s.ec, testIndexName, testOldIndexName)
-	require.NoError(s.T(), err, "expected no error in creating index alias")
-
-	s.service.elasticClient = s.ec
-	s.service.pollReindexInterval = time.Second
-	s.service.aliasName = testIndexName
+	s.prepareMigration(testNewMappingFile, MigrationOptions{})
 	s.service.aliasForAllConcepts = aliasForAllConcepts
-	s.service.mappingFile = testNewMappingFile
-	err = s.service.MigrateIndex()
+	err := s.service.MigrateIndex()
 
 	assert.NoError(s.T(), err, "expected no error for migrating index in unhealthy ES cluster")
 
@@ -464,25 +582,206 @@ func (s *EsServiceTestSuite) TestMigrateIndex() {
 	assert.Equal(s.T(), size, int(count), "aliased index size")
 }
 
-func (s *EsServiceTestSuite) TestMigrateIndexWithAliasFilter() {
-	s.service = esService{}
-	s.forNextIndexVersion()
+func (s *EsServiceTestSuite) TestMigrateIndexWithExtraAliases() {
+	extraAliases := []string{"test-extra-alias", "test-other-alias"}
+	s.prepareMigration(testNewMappingFile, MigrationOptions{})
+	s.service.extraAliases = extraAliases
+	err := s.service.MigrateIndex()
+	assert.NoError(s.T(), err, "expected no error for migrating index")
 
-	_, err := s.ec.IndexPutSettings().BodyJson(map[string]interface{}{"index.number_of_replicas": 0}).Do(context.Background())
-	require.NoError(s.T(), err, "expected no error in modifying replica settings")
+	aliases, err := s.ec.Aliases().Do(context.Background())
+	require.NoError(s.T(), err, "expected no error for retrieving aliases")
 
-	err = createAlias(s.ec, testIndexName, testOldIndexName)
+	for _, alias := range append([]string{testIndexName}, extraAliases...) {
+		actual := aliases.IndicesByAlias(alias)
+		assert.Equal(s.T(), []string{testNewIndexName}, actual, "indices of alias %s", alias)
+	}
+	assert.Empty(s.T(), aliases.IndicesByAlias(aliasForAllConcepts), "the alias for all concepts is not managed")
+}
+
+func (s *EsServiceTestSuite) TestMigrateIndexWithSnapshot() {
+	s.migrateIndexWithSnapshot()
+
+	state, err := s.service.loadMigrationState(s.ec, testNewIndexName)
+	require.NoError(s.T(), err, "expected no error for reading migration state")
+	require.NotNil(s.T(), state, "migration state")
+	require.NotEmpty(s.T(), state.Snapshot, "snapshot recorded in migration state")
+	defer s.deleteSnapshot(state.Snapshot)
+
+	info, err := s.service.getSnapshot(s.ec, state.Snapshot)
+	require.NoError(s.T(), err, "expected no error for reading snapshot")
+	assert.Equal(s.T(), snapshotSuccess, info.State, "snapshot state")
+	assert.Equal(s.T(), []string{testOldIndexName}, info.Indices, "snapshot indices")
+}
+
+func (s *EsServiceTestSuite) TestRestoreSnapshot() {
+	s.migrateIndexWithSnapshot()
+
+	state, err := s.service.loadMigrationState(s.ec, testNewIndexName)
+	require.NoError(s.T(), err, "expected no error for reading migration state")
+	defer s.deleteSnapshot(state.Snapshot)
+
+	_, err = s.ec.DeleteIndex(testOldIndexName).Do(context.Background())
+	require.NoError(s.T(), err, "expected no error for deleting old index")
+
+	s.service.migrationCheck = true
+	result, err := s.service.RestoreSnapshot("")
+	require.NoError(s.T(), err, "expected no error for restoring snapshot")
+	assert.Equal(s.T(), RestoreResult{Snapshot: state.Snapshot, From: testNewIndexName, To: testOldIndexName}, result, "restore result")
+
+	aliases, err := s.ec.Aliases().Do(context.Background())
+	require.NoError(s.T(), err, "expected no error for retrieving aliases")
+	assert.Equal(s.T(), []string{testOldIndexName}, aliases.IndicesByAlias(testIndexName), "alias moved to restored index")
+	assert.Equal(s.T(), []string{testOldIndexName}, aliases.IndicesByAlias(aliasForAllConcepts), "alias moved to restored index")
+
+	readOnly, err := s.service.isReadOnly(s.ec, testOldIndexName)
+	require.NoError(s.T(), err, "expected no error for reading index settings")
+	assert.False(s.T(), readOnly, "restored index is writable")
+
+	count, err := s.ec.Count(testOldIndexName).Do(context.Background())
+	require.NoError(s.T(), err, "expected no error for counting documents")
+	assert.Equal(s.T(), size, int(count), "restored index size")
+}
+
+func (s *EsServiceTestSuite) TestRestoreSnapshotIndexOpen() {
+	s.migrateIndexWithSnapshot()
+
+	state, err := s.service.loadMigrationState(s.ec, testNewIndexName)
+	require.NoError(s.T(), err, "expected no error for reading migration state")
+	defer s.deleteSnapshot(state.Snapshot)
+
+	s.service.migrationCheck = true
+	_, err = s.service.RestoreSnapshot("")
+	assert.ErrorIs(s.T(), err, ErrSnapshotIndexOpen, "expected error for restoring an open index")
+}
+
+func (s *EsServiceTestSuite) TestRestoreSnapshotNotTaken() {
+	s.service = esService{}
+	err := createAlias(s.ec, testIndexName, testOldIndexName)
 	require.NoError(s.T(), err, "expected no error in creating index alias")
 
 	s.service.elasticClient = s.ec
-	s.service.pollReindexInterval = time.Second
 	s.service.aliasName = testIndexName
+	s.service.migrationCheck = true
+	s.service.options = MigrationOptions{SnapshotRepository: testSnapshotRepository, SnapshotLocation: testSnapshotLocation}
+	_, err = s.service.RestoreSnapshot("")
+	assert.ErrorIs(s.T(), err, ErrNoSnapshot, "expected error without a snapshot")
+}
+
+func (s *EsServiceTestSuite) migrateIndexWithSnapshot() {
+	s.prepareMigration(testNewMappingFile, MigrationOptions{SnapshotRepository: testSnapshotRepository, SnapshotLocation: testSnapshotLocation})
 	s.service.aliasForAllConcepts = aliasForAllConcepts
-	s.service.mappingFile = testNewMappingFile
-	s.service.aliasFilterFile = testAliasFilterFile
+	err := s.service.MigrateIndex()
+	require.NoError(s.T(), err, "expected no error for migrating index")
+}
+
+func (s *EsServiceTestSuite) deleteSnapshot(snapshot string) {
+	_, err := s.ec.PerformRequest(context.Background(), elastic.PerformRequestOptions{
+		Method: "DELETE",
+		Path:   fmt.Sprintf("/_snapshot/%s/%s", testSnapshotRepository, snapshot),
+	})
+	assert.NoError(s.T(), err, "expected no error for deleting snapshot")
+}
+
+func (s *EsServiceTestSuite) TestMigrateIndexVerified() {
+	s.prepareMigration(testNewMappingFile, MigrationOptions{Verify: true, VerifySampleSize: 20, VerifyMaxMismatchRate: 0.1})
+
+	err := s.service.MigrateIndex()
+	assert.NoError(s.T(), err, "expected no error for migrating index")
+
+	aliases, err := s.ec.Aliases().Do(context.Background())
+	require.NoError(s.T(), err, "expected no error for retrieving aliases")
+	assert.Equal(s.T(), []string{testNewIndexName}, aliases.IndicesByAlias(testIndexName), "updated alias")
+}
+
+func (s *EsServiceTestSuite) TestMigrateIndexVerificationFailure() {
+	s.prepareMigration(testNewMappingFile, MigrationOptions{Verify: true, VerifySampleSize: 20, VerifyMaxMismatchRate: 0.1})
+
+	// simulate an interrupted migration which copied every document, but changed them
+	plan, err := s.service.planMigration(s.ec)
+	require.NoError(s.T(), err, "expected no error for planning migration")
+	_, err = s.service.prepareTargetIndex(s.ec, plan)
+	require.NoError(s.T(), err, "expected no error for creating new index")
+
+	documents, err := s.service.sampleDocuments(s.ec, testOldIndexName, size)
+	require.NoError(s.T(), err, "expected no error for reading documents")
+	for id, source := range documents {
+		var doc map[string]interface{}
+		require.NoError(s.T(), json.Unmarshal(source, &doc), "expected no error for decoding document")
+		doc["prefLabel"] = "Changed"
+		_, err = s.ec.Index().Index(testNewIndexName).Id(id).BodyJson(doc).Do(context.Background())
+		require.NoError(s.T(), err, "expected no error for writing changed document")
+	}
+
 	err = s.service.MigrateIndex()
+	assert.ErrorIs(s.T(), err, ErrVerificationFailed, "expected verification to fail")
 
-	assert.NoError(s.T(), err, "expected no error for migrating index in unhealthy ES cluster")
+	aliases, err := s.ec.Aliases().Do(context.Background())
+	require.NoError(s.T(), err, "expected no error for retrieving aliases")
+	assert.Equal(s.T(), []string{testOldIndexName}, aliases.IndicesByAlias(testIndexName), "alias left on the old index")
+
+	readOnly, err := s.service.isReadOnly(s.ec, testOldIndexName)
+	require.NoError(s.T(), err, "expected no error for reading index settings")
+	assert.False(s.T(), readOnly, "old index is writable again")
+}
+
+func (s *EsServiceTestSuite) TestMigrateIndexVerifiedZeroDowntime() {
+	s.prepareMigration(testNewMappingFile, MigrationOptions{ZeroDowntime: true, Verify: true, VerifySampleSize: 20, VerifyMaxMismatchRate: 0.1})
+
+	// simulate an interrupted migration which copied a document since deleted from the old index
+	plan, err := s.service.planMigration(s.ec)
+	require.NoError(s.T(), err, "expected no error for planning migration")
+	_, err = s.service.prepareTargetIndex(s.ec, plan)
+	require.NoError(s.T(), err, "expected no error for creating new index")
+	deletedID := uuid.NewString()
+	_, err = s.ec.Index().Index(testNewIndexName).Id(deletedID).BodyJson(map[string]interface{}{"id": deletedID, "prefLabel": "Deleted since copied"}).Do(context.Background())
+	require.NoError(s.T(), err, "expected no error for writing to the new index")
+
+	err = s.service.MigrateIndex()
+	assert.NoError(s.T(), err, "expected no error for migrating index with a document which was deleted while it was copied")
+
+	aliases, err := s.ec.Aliases().Do(context.Background())
+	require.NoError(s.T(), err, "expected no error for retrieving aliases")
+	assert.Equal(s.T(), []string{testNewIndexName}, aliases.IndicesByAlias(testIndexName), "updated alias")
+}
+
+func (s *EsServiceTestSuite) TestMigrateIndexWithSmokeTests() {
+	s.prepareMigration(testNewMappingFile, MigrationOptions{SmokeQueriesDir: testSmokeQueriesDir})
+
+	err := s.service.MigrateIndex()
+	assert.NoError(s.T(), err, "expected no error for migrating index")
+
+	aliases, err := s.ec.Aliases().Do(context.Background())
+	require.NoError(s.T(), err, "expected no error for retrieving aliases")
+	assert.Equal(s.T(), []string{testNewIndexName}, aliases.IndicesByAlias(testIndexName), "updated alias")
+}
+
+func (s *EsServiceTestSuite) TestMigrateIndexSmokeTestFailure() {
+	s.prepareMigration(testBreakingMappingFile, MigrationOptions{SmokeQueriesDir: testSmokeQueriesDir})
+
+	err := s.service.MigrateIndex()
+	assert.ErrorIs(s.T(), err, ErrSmokeTestFailed, "expected smoke tests to fail")
+	assert.Contains(s.T(), err.Error(), "autocomplete", "failed smoke query")
+	assert.NotContains(s.T(), err.Error(), "all-concepts", "passed smoke query")
+
+	aliases, err := s.ec.Aliases().Do(context.Background())
+	require.NoError(s.T(), err, "expected no error for retrieving aliases")
+	assert.Equal(s.T(), []string{testOldIndexName}, aliases.IndicesByAlias(testIndexName), "alias left on the old index")
+
+	readOnly, err := s.service.isReadOnly(s.ec, testOldIndexName)
+	require.NoError(s.T(), err, "expected no error for reading index settings")
+	assert.False(s.T(), readOnly, "old index is writable again")
+}
+
+func (s *EsServiceTestSuite) TestMigrateIndexZeroDowntime() {
+	s.prepareMigration(testNewMappingFile, MigrationOptions{ZeroDowntime: true, MaxDeltaPasses: 2})
+
+	plan, err := s.service.PlanMigration()
+	require.NoError(s.T(), err, "expected no error for planning migration")
+	assert.Equal(s.T(), "_seq_no", plan.DeltaField, "delta field")
+
+	err = s.service.MigrateIndex()
+	assert.NoError(s.T(), err, "expected no error for migrating index")
 
 	aliases, err := s.ec.Aliases().Do(context.Background())
 	assert.NoError(s.T(), err, "expected no error for retrieving aliases")
@@ -491,69 +790,1657 @@ func (s *EsServiceTestSuite) TestMigrateIndexWithAliasFilter() {
 	assert.Len(s.T(), actual, 1, "aliases")
 	assert.Equal(s.T(), testNewIndexName, actual[0], "updated alias")
 
-	actual = aliases.IndicesByAlias(aliasForAllConcepts)
-	assert.Len(s.T(), actual, 1, "aliases")
-	assert.Equal(s.T(), testNewIndexName, actual[0], "updated alias")
-
 	count, err := s.ec.Count(testNewIndexName).Do(context.Background())
+	assert.NoError(s.T(), err, "expected no error for checking index size")
 	assert.Equal(s.T(), size, int(count), "new index size")
 
-	count, err = s.ec.Count(testIndexName).Do(context.Background())
-	assert.Equal(s.T(), size/2, int(count), "aliased index size")
+	settings, err := s.ec.IndexGetSettings(testOldIndexName).Do(context.Background())
+	assert.NoError(s.T(), err, "expected no error for getting index settings")
+	indexBlocksSettings := settings[testOldIndexName].Settings["index"].(map[string]interface{})["blocks"]
+	readOnly, _ := strconv.ParseBool(indexBlocksSettings.(map[string]interface{})["write"].(string))
+	assert.True(s.T(), readOnly, "old index should be read-only after the final catch-up pass")
+
+	state, err := s.service.loadMigrationState(s.ec, testNewIndexName)
+	assert.NoError(s.T(), err, "expected no error for reading migration state")
+	assert.NotEmpty(s.T(), state.Checkpoint, "expected the checkpoint to be recorded")
 }
 
-func (s *EsServiceTestSuite) TestMigrateIndexWithMissingAliasFilter() {
-	s.service = esService{}
-	s.forNextIndexVersion()
+func (s *EsServiceTestSuite) TestMigrateIndexWithTransformScript() {
+	s.migrateIndexWithTransform(testTransformScript)
+}
 
-	_, err := s.ec.IndexPutSettings().BodyJson(map[string]interface{}{"index.number_of_replicas": 0}).Do(context.Background())
-	require.NoError(s.T(), err, "expected no error in modifying replica settings")
+func (s *EsServiceTestSuite) TestMigrateIndexWithTransformPipeline() {
+	s.migrateIndexWithTransform(testTransformPipeline)
 
-	err = createAlias(s.ec, testIndexName, testOldIndexName)
-	require.NoError(s.T(), err, "expected no error in creating index alias")
+	_, err := s.ec.IngestGetPipeline(testNewIndexName + "-transform").Do(context.Background())
+	assert.True(s.T(), elastic.IsNotFound(err), "expected transform pipeline to be deleted")
+}
+
+func (s *EsServiceTestSuite) migrateIndexWithTransform(transformFile string) {
+	s.prepareMigration(testNewMappingFile, MigrationOptions{TransformFile: transformFile, Verify: true, VerifySampleSize: 20})
+
+	plan, err := s.service.PlanMigration()
+	require.NoError(s.T(), err, "expected no error for planning migration")
+	assert.Contains(s.T(), plan.Transform, transformFile, "transform")
 
-	s.service.elasticClient = s.ec
-	s.service.pollReindexInterval = time.Second
-	s.service.aliasName = testIndexName
-	s.service.mappingFile = testNewMappingFile
-	s.service.aliasFilterFile = "./no-such-file.json"
 	err = s.service.MigrateIndex()
+	assert.NoError(s.T(), err, "expected no error for migrating index")
 
-	assert.Error(s.T(), err, "expected error for migrating index with missing alias filter")
+	_, err = s.ec.Refresh(testNewIndexName).Do(context.Background())
+	require.NoError(s.T(), err, "expected no error for refreshing new index")
 
-	aliases, err := s.ec.Aliases().Do(context.Background())
-	assert.NoError(s.T(), err, "expected no error for retrieving aliases")
+	count, err := s.ec.Count(testNewIndexName).Do(context.Background())
+	assert.NoError(s.T(), err, "expected no error for checking index size")
+	assert.Equal(s.T(), size, int(count), "new index size")
 
-	actual := aliases.IndicesByAlias(testIndexName)
-	assert.Len(s.T(), actual, 1, "aliases")
-	assert.Equal(s.T(), testOldIndexName, actual[0], "unmodified alias")
+	transformed, err := s.ec.Count(testNewIndexName).Query(elastic.NewExistsQuery("aliases")).Do(context.Background())
+	assert.NoError(s.T(), err, "expected no error for counting transformed documents")
+	assert.Equal(s.T(), int64(0), transformed, "expected aliases to be removed by the transform")
+}
 
-	actual = aliases.IndicesByAlias(aliasForAllConcepts)
-	assert.Len(s.T(), actual, 0, "aliases")
+func (s *EsServiceTestSuite) TestMigrateIndexFromSourceClusterClientCopy() {
+	s.migrateIndexFromSourceCluster(RemoteReindexClient)
 }
 
-func (s *EsServiceTestSuite) TestMigrateIndexClusterUnhealthy() {
+func (s *EsServiceTestSuite) TestMigrateIndexFromSourceClusterFallback() {
+	// the test cluster does not whitelist itself for reindex from remote
+	s.migrateIndexFromSourceCluster(RemoteReindexAuto)
+}
+
+func (s *EsServiceTestSuite) TestMigrateIndexFromSourceClusterRemoteNotAllowed() {
 	s.service = esService{}
 	s.forNextIndexVersion()
 
 	err := createAlias(s.ec, testIndexName, testOldIndexName)
 	require.NoError(s.T(), err, "expected no error in creating index alias")
 
+	sourceCluster := NewAccessConfig(nil, "", s.esURL, "local", false)
 	s.service.elasticClient = s.ec
 	s.service.aliasName = testIndexName
 	s.service.mappingFile = testNewMappingFile
-	s.service.aliasFilterFile = testAliasFilterFile
+	s.service.options = MigrationOptions{SourceCluster: &sourceCluster, RemoteReindex: RemoteReindexServer}
+
 	err = s.service.MigrateIndex()
+	assert.ErrorIs(s.T(), err, ErrRemoteReindexNotAllowed, "expected error for remote reindex without whitelisting")
+}
 
-	assert.Error(s.T(), err, "expected error for migrating index in unhealthy ES cluster")
-	assert.EqualError(s.T(), err, "Cluster is yellow", "error message")
+func (s *EsServiceTestSuite) migrateIndexFromSourceCluster(remoteReindex string) {
+	sourceCluster := NewAccessConfig(nil, "", s.esURL, "local", false)
+	s.prepareMigration(testNewMappingFile, MigrationOptions{SourceCluster: &sourceCluster, RemoteReindex: remoteReindex, ReindexBatchSize: 30})
+
+	plan, err := s.service.PlanMigration()
+	require.NoError(s.T(), err, "expected no error for planning migration")
+	assert.Equal(s.T(), s.esURL, plan.SourceCluster, "source cluster")
+	assert.Equal(s.T(), testOldIndexName, plan.SourceIndex, "source index")
+	assert.Equal(s.T(), int64(size), plan.DocumentCount, "documents to copy")
+
+	err = s.service.MigrateIndex()
+	assert.NoError(s.T(), err, "expected no error for migrating index from source cluster")
 
 	aliases, err := s.ec.Aliases().Do(context.Background())
 	assert.NoError(s.T(), err, "expected no error for retrieving aliases")
 
 	actual := aliases.IndicesByAlias(testIndexName)
 	assert.Len(s.T(), actual, 1, "aliases")
-	assert.Equal(s.T(), testOldIndexName, actual[0], "unmodified alias")
+	assert.Equal(s.T(), testNewIndexName, actual[0], "updated alias")
+
+	_, err = s.ec.Refresh(testNewIndexName).Do(context.Background())
+	require.NoError(s.T(), err, "expected no error for refreshing new index")
+
+	count, err := s.ec.Count(testNewIndexName).Do(context.Background())
+	assert.NoError(s.T(), err, "expected no error for checking index size")
+	assert.Equal(s.T(), size, int(count), "new index size")
+}
+
+func (s *EsServiceTestSuite) TestMigrateIndexReindexStartFailure() {
+	s.prepareMigration(testNewMappingFile, MigrationOptions{ReindexSlices: "none"})
+
+	err := s.service.MigrateIndex()
+	assert.Error(s.T(), err, "expected error for starting reindex")
+	s.assertMigrationUndone()
+}
+
+func (s *EsServiceTestSuite) TestMigrateIndexReindexTaskFailure() {
+	s.prepareMigration(testStrictMappingFile, MigrationOptions{})
+
+	err := s.service.MigrateIndex()
+	assert.ErrorIs(s.T(), err, ErrReindexTaskFailed, "expected error for reindex task with rejected documents")
+	s.assertMigrationUndone()
+}
+
+func (s *EsServiceTestSuite) TestMigrateIndexReindexTaskCancelledExternally() {
+	s.prepareMigration(testNewMappingFile, MigrationOptions{ReindexBatchSize: 1, RequestsPerSecond: 1})
+
+	go func() {
+		for i := 0; i < 30; i++ {
+			if taskID := s.service.runningReindexTask(); len(taskID) > 0 {
+				_, _ = s.ec.PerformRequest(context.Background(), elastic.PerformRequestOptions{Method: "POST", Path: "/_tasks/" + taskID + "/_cancel"})
+				return
+			}
+			time.Sleep(time.Second)
+		}
+	}()
+
+	err := s.service.MigrateIndex()
+	assert.ErrorIs(s.T(), err, ErrReindexTaskFailed, "expected error for a reindex task cancelled outside the migration")
+	s.assertMigrationUndone()
+}
+
+func (s *EsServiceTestSuite) TestMigrateIndexAliasFailure() {
+	s.prepareMigration(testNewMappingFile, MigrationOptions{})
+	// an alias cannot have the name of an index
+	s.service.aliasForAllConcepts = testOldIndexName
+
+	err := s.service.MigrateIndex()
+	assert.Error(s.T(), err, "expected error for moving aliases")
+	s.assertMigrationUndone()
+
+	count, err := s.ec.Count(testNewIndexName).Do(context.Background())
+	assert.NoError(s.T(), err, "expected no error for checking index size")
+	assert.Equal(s.T(), size, int(count), "expected new index to be kept")
+}
+
+func (s *EsServiceTestSuite) TestMigrateIndexAfterAliasFailure() {
+	s.prepareMigration(testNewMappingFile, MigrationOptions{})
+	s.service.aliasForAllConcepts = testOldIndexName
+
+	err := s.service.MigrateIndex()
+	require.Error(s.T(), err, "expected error for moving aliases")
+
+	state, err := s.service.loadMigrationState(s.ec, testNewIndexName)
+	require.NoError(s.T(), err, "expected no error for reading migration state")
+	assert.True(s.T(), state.Stale, "expected the kept index to be marked stale")
+
+	// written to the old index once it accepted writes again
+	documents, err := s.service.sampleDocuments(s.ec, testOldIndexName, 1)
+	require.NoError(s.T(), err, "expected no error for reading documents")
+	var updatedID string
+	for id := range documents {
+		updatedID = id
+	}
+	_, err = s.ec.Update().Index(testIndexName).Id(updatedID).Doc(map[string]interface{}{"prefLabel": "Updated after the failure"}).Do(context.Background())
+	require.NoError(s.T(), err, "expected no error for updating document")
+	writtenID := uuid.NewString()
+	_, err = s.ec.Index().Index(testIndexName).Id(writtenID).BodyJson(map[string]interface{}{"id": writtenID, "prefLabel": "Written after the failure"}).Do(context.Background())
+	require.NoError(s.T(), err, "expected no error for writing document")
+
+	s.service.aliasForAllConcepts = ""
+	err = s.service.MigrateIndex()
+	require.NoError(s.T(), err, "expected no error for migrating index again")
+
+	written, err := s.ec.Get().Index(testNewIndexName).Id(writtenID).Do(context.Background())
+	require.NoError(s.T(), err, "expected document written after the failure to be copied")
+	assert.Contains(s.T(), string(written.Source), "Written after the failure", "copied document")
+
+	updated, err := s.ec.Get().Index(testNewIndexName).Id(updatedID).Do(context.Background())
+	require.NoError(s.T(), err, "expected updated document to be copied")
+	assert.Contains(s.T(), string(updated.Source), "Updated after the failure", "expected the update to be copied")
+
+	count, err := s.ec.Count(testNewIndexName).Do(context.Background())
+	assert.NoError(s.T(), err, "expected no error for checking index size")
+	assert.Equal(s.T(), size+1, int(count), "new index size")
+}
+
+func (s *EsServiceTestSuite) TestMigrateIndexSetReadOnlyFailure() {
+	s.prepareMigration(testNewMappingFile, MigrationOptions{})
+	s.service.elasticClient = s.failingClient(func(r *http.Request, body string) bool {
+		return r.Method == http.MethodPut && r.URL.Path == "/"+testOldIndexName+"/_settings" && strings.Contains(body, `"true"`)
+	})
+
+	err := s.service.MigrateIndex()
+	assert.Error(s.T(), err, "expected error for setting index read-only")
+	s.assertMigrationUndone()
+}
+
+func (s *EsServiceTestSuite) TestMigrateIndexReindexStatusFailure() {
+	s.prepareMigration(testNewMappingFile, MigrationOptions{ReindexBatchSize: 1, RequestsPerSecond: 1})
+	// the status of the reindex task cannot be read three times in a row, after which it can be cancelled
+	statusFailures := 0
+	s.service.elasticClient = s.failingClient(func(r *http.Request, body string) bool {
+		if r.Method == http.MethodGet && strings.HasPrefix(r.URL.Path, "/_tasks/") && statusFailures < 3 {
+			statusFailures++
+			return true
+		}
+		return false
+	})
+
+	err := s.service.MigrateIndex()
+	assert.Error(s.T(), err, "expected error for reading reindex task status")
+	assert.False(s.T(), errors.Is(err, ErrReindexTaskFailed), "expected a status error rather than a task failure")
+	s.assertMigrationUndone()
+
+	state, err := s.service.loadMigrationState(s.ec, testNewIndexName)
+	require.NoError(s.T(), err, "expected no error for reading migration state")
+	task, err := s.service.getReindexTask(s.ec, state.Task)
+	require.NoError(s.T(), err, "expected no error for reading reindex task")
+	assert.True(s.T(), task.Completed, "expected reindex task to be cancelled")
+}
+
+// failingClient returns a client of the test cluster which fails the requests matching fail with a 503 response
+func (s *EsServiceTestSuite) failingClient(fail func(r *http.Request, body string) bool) *elastic.Client {
+	ec, err := elastic.NewClient(
+		elastic.SetURL(s.esURL),
+		elastic.SetSniff(false),
+		elastic.SetHttpClient(&http.Client{Transport: failingTransport{fail: fail}}),
+	)
+	require.NoError(s.T(), err, "expected no error for ES client")
+	return ec
+}
+
+type failingTransport struct {
+	fail func(r *http.Request, body string) bool
+}
+
+func (t failingTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	var body []byte
+	if r.Body != nil {
+		var err error
+		body, err = ioutil.ReadAll(r.Body)
+		if err != nil {
+			return nil, err
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+
+	if t.fail(r, string(body)) {
+		return &http.Response{
+			StatusCode: http.StatusServiceUnavailable,
+			Header:     http.Header{"Content-Type": []string{"application/json"}},
+			Body:       ioutil.NopCloser(strings.NewReader(`{"error": {"type": "test_failure", "reason": "failed by test"}, "status": 503}`)),
+			Request:    r,
+		}, nil
+	}
+	return http.DefaultTransport.RoundTrip(r)
+}
+
+// prepareMigration sets up a migration to the next index version with the mapping file and options, with the old index behind the alias
+func (s *EsServiceTestSuite) prepareMigration(mappingFile string, options MigrationOptions) {
+	s.service = esService{options: options}
+	s.forNextIndexVersion()
+
+	_, err := s.ec.IndexPutSettings().BodyJson(map[string]interface{}{"index.number_of_replicas": 0}).Do(context.Background())
+	require.NoError(s.T(), err, "expected no error in modifying replica settings")
+
+	err = createAlias(s.ec, testIndexName, testOldIndexName)
+	require.NoError(s.T(), err, "expected no error in creating index alias")
+
+	s.service.elasticClient = s.ec
+	s.service.pollReindexInterval = time.Second
+	s.service.aliasName = testIndexName
+	s.service.mappingFile = mappingFile
+}
+
+func (s *EsServiceTestSuite) TestMigrateIndexWithAliasFilter() {
+	s.prepareMigration(testNewMappingFile, MigrationOptions{})
+	s.service.aliasForAllConcepts = aliasForAllConcepts
+	s.service.aliasFilterFile = testAliasFilterFile
+	err := s.service.MigrateIndex()
+
+	assert.NoError(s.T(), err, "expected no error for migrating index in unhealthy ES cluster")
+
+	aliases, err := s.ec.Aliases().Do(context.Background())
+	assert.NoError(s.T(), err, "expected no error for retrieving aliases")
+
+	actual := aliases.IndicesByAlias(testIndexName)
+	assert.Len(s.T(), actual, 1, "aliases")
+	assert.Equal(s.T(), testNewIndexName, actual[0], "updated alias")
+
+	actual = aliases.IndicesByAlias(aliasForAllConcepts)
+	assert.Len(s.T(), actual, 1, "aliases")
+	assert.Equal(s.T(), testNewIndexName, actual[0], "updated alias")
+
+	count, err := s.ec.Count(testNewIndexName).Do(context.Background())
+	assert.Equal(s.T(), size, int(count), "new index size")
+
+	count, err = s.ec.Count(testIndexName).Do(context.Background())
+	assert.Equal(s.T(), size/2, int(count), "aliased index size")
+}
+
+func (s *EsServiceTestSuite) TestMigrateIndexInPlace() {
+	s.prepareMigration(testNewMappingFile, MigrationOptions{InPlaceMappingUpdates: true, Verify: true})
+	s.service.aliasForAllConcepts = aliasForAllConcepts
+	s.service.aliasFilterFile = testAliasFilterFile
+	migration := s.service.newMigration(s.service.indexVersion, testNewMappingFile)
+	err := s.service.MigrateIndex()
+
+	assert.NoError(s.T(), err, "expected no error for migrating index in place")
+	require.NotNil(s.T(), migration.Verification, "verification")
+	assert.Equal(s.T(), "in-place update", migration.Verification.Skipped, "expected the verification to be recorded as skipped")
+
+	exists, err := s.ec.IndexExists(testNewIndexName).Do(context.Background())
+	assert.NoError(s.T(), err, "expected no error for checking new index")
+	assert.False(s.T(), exists, "no new index should have been created")
+
+	mapping, err := s.ec.GetFieldMapping().Index(testOldIndexName).Field("prefLabel").Do(context.Background())
+	assert.NoError(s.T(), err, "expected no error for reading index mapping")
+	assert.True(s.T(), hasMentionsCompletionMapping(mapping), "current index should have mentionsCompletion in its mappings")
+
+	aliases, err := s.ec.Aliases().Do(context.Background())
+	assert.NoError(s.T(), err, "expected no error for retrieving aliases")
+
+	actual := aliases.IndicesByAlias(testIndexName)
+	assert.Len(s.T(), actual, 1, "aliases")
+	assert.Equal(s.T(), testOldIndexName, actual[0], "unmodified alias")
+
+	actual = aliases.IndicesByAlias(aliasForAllConcepts)
+	assert.Len(s.T(), actual, 1, "aliases")
+	assert.Equal(s.T(), testOldIndexName, actual[0], "added alias")
+
+	count, err := s.ec.Count(testIndexName).Do(context.Background())
+	assert.NoError(s.T(), err, "expected no error for checking index size")
+	assert.Equal(s.T(), size/2, int(count), "aliased index size with new filter")
+
+	requireUpdate, current, required, err := s.service.checkIndexAliases(s.ec, testIndexName)
+	assert.NoError(s.T(), err, "expected no error for checking index")
+	assert.False(s.T(), requireUpdate, "expected no update required after in-place update")
+	assert.Equal(s.T(), testOldIndexName, current, "current index")
+	assert.Equal(s.T(), testOldIndexName, required, "required index")
+
+	_, err = s.ec.Index().Index(testIndexName).Id(uuid.NewString()).BodyJson(map[string]interface{}{"aliases": []string{"Test"}}).Do(context.Background())
+	assert.NoError(s.T(), err, "expected current index to stay writable")
+}
+
+func (s *EsServiceTestSuite) TestMigrateIndexInPlaceBreakingChange() {
+	s.prepareMigration(testBreakingMappingFile, MigrationOptions{InPlaceMappingUpdates: true})
+
+	plan, err := s.service.PlanMigration()
+	require.NoError(s.T(), err, "expected no error for planning migration")
+	assert.False(s.T(), plan.InPlace, "expected a breaking change not to be applied in place")
+	assert.Equal(s.T(), []FieldChange{{Field: "prefLabel", Old: "text", New: "keyword"}}, plan.MappingDiff.TypeChanged, "type changes")
+
+	err = s.service.MigrateIndex()
+	assert.NoError(s.T(), err, "expected no error for migrating index")
+
+	aliases, err := s.ec.Aliases().Do(context.Background())
+	assert.NoError(s.T(), err, "expected no error for retrieving aliases")
+
+	actual := aliases.IndicesByAlias(testIndexName)
+	assert.Len(s.T(), actual, 1, "aliases")
+	assert.Equal(s.T(), testNewIndexName, actual[0], "updated alias")
+}
+
+func (s *EsServiceTestSuite) TestMigrateIndexInPlaceAliasFailure() {
+	s.prepareMigration(testNewMappingFile, MigrationOptions{InPlaceMappingUpdates: true})
+	// an alias cannot have the name of an index
+	s.service.aliasForAllConcepts = testOldIndexName
+	s.service.aliasFilterFile = testAliasFilterFile
+	err := s.service.MigrateIndex()
+	assert.Error(s.T(), err, "expected error for updating aliases")
+
+	requireUpdate, _, _, err := s.service.checkIndexAliases(s.ec, testIndexName)
+	assert.NoError(s.T(), err, "expected no error for checking index")
+	assert.True(s.T(), requireUpdate, "expected the index version not to be registered")
+
+	count, err := s.ec.Count(testIndexName).Do(context.Background())
+	assert.NoError(s.T(), err, "expected no error for checking index size")
+	assert.Equal(s.T(), size, int(count), "expected the alias to keep its filter")
+}
+
+func (s *EsServiceTestSuite) TestMigrateIndexInPlaceRejected() {
+	b, err := ioutil.ReadFile(testOldMappingFile)
+	require.NoError(s.T(), err, "expected no error for reading mapping")
+	var mapping map[string]map[string]map[string]map[string]interface{}
+	require.NoError(s.T(), json.Unmarshal(b, &mapping), "expected no error for decoding mapping")
+	// a parameter change the mapping diff does not look at, which the put-mapping API rejects
+	mapping["mappings"]["properties"]["id"]["index"] = true
+	mapping["mappings"]["properties"]["label"] = map[string]interface{}{"type": "keyword"}
+	b, err = json.Marshal(mapping)
+	require.NoError(s.T(), err, "expected no error for encoding mapping")
+	mappingFile := filepath.Join(s.T().TempDir(), "mapping.json")
+	require.NoError(s.T(), os.WriteFile(mappingFile, b, 0600), "expected no error for writing mapping")
+	s.prepareMigration(mappingFile, MigrationOptions{InPlaceMappingUpdates: true})
+
+	plan, err := s.service.PlanMigration()
+	require.NoError(s.T(), err, "expected no error for planning migration")
+	require.True(s.T(), plan.InPlace, "expected the mapping to be planned in place")
+
+	err = s.service.MigrateIndex()
+	require.NoError(s.T(), err, "expected the migration to fall back to a reindex")
+
+	aliases, err := s.ec.Aliases().Do(context.Background())
+	require.NoError(s.T(), err, "expected no error for retrieving aliases")
+	assert.Equal(s.T(), []string{testNewIndexName}, aliases.IndicesByAlias(testIndexName), "updated alias")
+
+	fields, err := s.ec.GetFieldMapping().Index(testOldIndexName).Field("label").Do(context.Background())
+	assert.NoError(s.T(), err, "expected no error for reading index mapping")
+	assert.Empty(s.T(), fields[testOldIndexName].(map[string]interface{})["mappings"], "expected no field to be added to the current index")
+
+	version, err := s.service.registeredIndexVersion(s.ec, testOldIndexName)
+	assert.NoError(s.T(), err, "expected no error for reading index version")
+	assert.Empty(s.T(), version, "expected no version to be registered on the current index")
+}
+
+func (s *EsServiceTestSuite) TestMigrateIndexSettingsUpdateFailure() {
+	s.prepareMigration(testOldMappingFile, MigrationOptions{InPlaceSettingsUpdates: true})
+	s.service.settingsFile = testSettingsFile
+	s.service.elasticClient = s.failingClient(func(r *http.Request, body string) bool {
+		return r.Method == http.MethodPut && r.URL.Path == "/"+testOldIndexName+"/_settings" && strings.Contains(body, "analysis")
+	})
+
+	err := s.service.MigrateIndex()
+	assert.Error(s.T(), err, "expected error for updating static settings")
+
+	open, err := s.service.isIndexOpen(s.ec, testOldIndexName)
+	assert.NoError(s.T(), err, "expected no error for checking index state")
+	assert.True(s.T(), open, "expected index to be opened again")
+
+	settings, err := s.ec.IndexGetSettings(testOldIndexName).FlatSettings(true).Do(context.Background())
+	require.NoError(s.T(), err, "expected no error for reading index settings")
+	assert.NotContains(s.T(), settings[testOldIndexName].Settings, "index.refresh_interval", "expected the dynamic setting to be restored")
+
+	count, err := s.ec.Count(testIndexName).Do(context.Background())
+	assert.NoError(s.T(), err, "expected no error for checking index size")
+	assert.Equal(s.T(), size, int(count), "aliased index size")
+}
+
+func (s *EsServiceTestSuite) TestMigrateIndexSettingsOnly() {
+	s.prepareMigration(testOldMappingFile, MigrationOptions{InPlaceSettingsUpdates: true})
+	s.service.settingsFile = testSettingsFile
+
+	plan, err := s.service.PlanMigration()
+	require.NoError(s.T(), err, "expected no error for planning migration")
+	assert.True(s.T(), plan.InPlace, "expected settings to be updated in place")
+	require.NotNil(s.T(), plan.SettingsUpdate, "settings update")
+	assert.Equal(s.T(), []string{"refresh_interval"}, plan.SettingsUpdate.Dynamic, "dynamic settings")
+	assert.Equal(s.T(), []string{"analysis.analyzer.label"}, plan.SettingsUpdate.Static, "static settings")
+
+	err = s.service.MigrateIndex()
+	require.NoError(s.T(), err, "expected no error for updating settings in place")
+
+	exists, err := s.ec.IndexExists(testNewIndexName).Do(context.Background())
+	assert.NoError(s.T(), err, "expected no error for checking new index")
+	assert.False(s.T(), exists, "no new index should have been created")
+
+	settings, err := s.ec.IndexGetSettings(testOldIndexName).FlatSettings(true).Do(context.Background())
+	require.NoError(s.T(), err, "expected no error for reading index settings")
+	assert.Equal(s.T(), "5s", settings[testOldIndexName].Settings["index.refresh_interval"], "dynamic setting")
+	assert.Equal(s.T(), "custom", settings[testOldIndexName].Settings["index.analysis.analyzer.label.type"], "static setting")
+
+	open, err := s.service.isIndexOpen(s.ec, testOldIndexName)
+	assert.NoError(s.T(), err, "expected no error for checking index state")
+	assert.True(s.T(), open, "expected index to be opened again")
+
+	requireUpdate, _, _, err := s.service.checkIndexAliases(s.ec, testIndexName)
+	assert.NoError(s.T(), err, "expected no error for checking index")
+	assert.False(s.T(), requireUpdate, "expected no update required after updating settings in place")
+
+	count, err := s.ec.Count(testIndexName).Do(context.Background())
+	assert.NoError(s.T(), err, "expected no error for checking index size")
+	assert.Equal(s.T(), size, int(count), "aliased index size")
+}
+
+func (s *EsServiceTestSuite) TestMigrateIndexShardCountChange() {
+	settingsFile := filepath.Join(s.T().TempDir(), "settings.json")
+	err := os.WriteFile(settingsFile, []byte(`{"index": {"number_of_shards": 2, "number_of_replicas": 0}}`), 0600)
+	require.NoError(s.T(), err, "expected no error for writing settings")
+	s.prepareMigration(testOldMappingFile, MigrationOptions{InPlaceSettingsUpdates: true})
+	s.service.settingsFile = settingsFile
+
+	plan, err := s.service.PlanMigration()
+	require.NoError(s.T(), err, "expected no error for planning migration")
+	assert.False(s.T(), plan.InPlace, "expected a shard count change not to be applied in place")
+	assert.True(s.T(), plan.ReindexRequired, "expected a shard count change to require a reindex")
+
+	err = s.service.MigrateIndex()
+	require.NoError(s.T(), err, "expected no error for migrating index")
+
+	aliases, err := s.ec.Aliases().Do(context.Background())
+	require.NoError(s.T(), err, "expected no error for retrieving aliases")
+	assert.Equal(s.T(), []string{testNewIndexName}, aliases.IndicesByAlias(testIndexName), "updated alias")
+
+	settings, err := s.ec.IndexGetSettings(testNewIndexName).FlatSettings(true).Do(context.Background())
+	require.NoError(s.T(), err, "expected no error for reading index settings")
+	assert.Equal(s.T(), "2", settings[testNewIndexName].Settings["index.number_of_shards"], "shards of new index")
+}
+
+func (s *EsServiceTestSuite) TestMigrateIndexResumesReindexTask() {
+	s.prepareMigration(testNewMappingFile, MigrationOptions{})
+
+	// simulate a restart after the reindex task was started
+	plan, err := s.service.planMigration(s.ec)
+	require.NoError(s.T(), err, "expected no error for planning migration")
+	state, err := s.service.prepareTargetIndex(s.ec, plan)
+	require.NoError(s.T(), err, "expected no error for creating new index")
+	err = s.service.setReadOnly(s.ec, testOldIndexName)
+	require.NoError(s.T(), err, "expected no error for setting index read-only")
+	taskID, _, err := s.service.startOrResumeReindex(s.ec, testOldIndexName, testNewIndexName, state, nil)
+	require.NoError(s.T(), err, "expected no error for starting reindex")
+
+	plan, err = s.service.PlanMigration()
+	require.NoError(s.T(), err, "expected no error for planning migration")
+	assert.True(s.T(), plan.Resume, "expected the migration to be resumed")
+
+	err = s.service.MigrateIndex()
+	assert.NoError(s.T(), err, "expected no error for resuming migration")
+
+	resumed, err := s.service.loadMigrationState(s.ec, testNewIndexName)
+	assert.NoError(s.T(), err, "expected no error for reading migration state")
+	assert.Equal(s.T(), taskID, resumed.Task, "expected the migration to reattach to the reindex task")
+
+	aliases, err := s.ec.Aliases().Do(context.Background())
+	assert.NoError(s.T(), err, "expected no error for retrieving aliases")
+
+	actual := aliases.IndicesByAlias(testIndexName)
+	assert.Len(s.T(), actual, 1, "aliases")
+	assert.Equal(s.T(), testNewIndexName, actual[0], "updated alias")
+
+	count, err := s.ec.Count(testNewIndexName).Do(context.Background())
+	assert.NoError(s.T(), err, "expected no error for checking index size")
+	assert.Equal(s.T(), size, int(count), "new index size")
+}
+
+func (s *EsServiceTestSuite) TestMigrateIndexRestartsLostReindexTask() {
+	s.prepareMigration(testNewMappingFile, MigrationOptions{})
+
+	// simulate a partial copy by a reindex task which no longer exists
+	plan, err := s.service.planMigration(s.ec)
+	require.NoError(s.T(), err, "expected no error for planning migration")
+	state, err := s.service.prepareTargetIndex(s.ec, plan)
+	require.NoError(s.T(), err, "expected no error for creating new index")
+	err = writeTestConcepts(s.ec, testNewIndexName, esTopicType, ftTopicType, 10)
+	require.NoError(s.T(), err, "expected no error in adding topics")
+	state.Task = "no-such-node:1"
+	err = s.service.saveMigrationState(s.ec, testNewIndexName, state)
+	require.NoError(s.T(), err, "expected no error for saving migration state")
+
+	err = s.service.MigrateIndex()
+	assert.NoError(s.T(), err, "expected no error for resuming migration")
+
+	resumed, err := s.service.loadMigrationState(s.ec, testNewIndexName)
+	assert.NoError(s.T(), err, "expected no error for reading migration state")
+	assert.NotEqual(s.T(), "no-such-node:1", resumed.Task, "expected a new reindex task")
+
+	_, err = s.ec.Refresh(testNewIndexName).Do(context.Background())
+	require.NoError(s.T(), err, "expected no error for refreshing new index")
+
+	count, err := s.ec.Count(testNewIndexName).Do(context.Background())
+	assert.NoError(s.T(), err, "expected no error for checking index size")
+	assert.Equal(s.T(), size+10, int(count), "new index size")
+}
+
+func (s *EsServiceTestSuite) TestMigrateIndexExistingTargetIndex() {
+	s.service = esService{}
+	s.forNextIndexVersion()
+
+	err := createAlias(s.ec, testIndexName, testOldIndexName)
+	require.NoError(s.T(), err, "expected no error in creating index alias")
+
+	err = createIndex(s.ec, testNewIndexName, testNewMappingFile)
+	require.NoError(s.T(), err, "expected no error for creating new index")
+
+	s.service.elasticClient = s.ec
+	s.service.aliasName = testIndexName
+	s.service.mappingFile = testNewMappingFile
+	err = s.service.MigrateIndex()
+
+	assert.Error(s.T(), err, "expected error for migrating to an index which was not created by a migration")
+	assert.Contains(s.T(), err.Error(), "was not created by a migration", "error message")
+}
+
+func (s *EsServiceTestSuite) TestMigrateIndexWithMissingAliasFilter() {
+	s.prepareMigration(testNewMappingFile, MigrationOptions{})
+	s.service.aliasFilterFile = "./no-such-file.json"
+	err := s.service.MigrateIndex()
+
+	assert.Error(s.T(), err, "expected error for migrating index with missing alias filter")
+
+	aliases, err := s.ec.Aliases().Do(context.Background())
+	assert.NoError(s.T(), err, "expected no error for retrieving aliases")
+
+	actual := aliases.IndicesByAlias(testIndexName)
+	assert.Len(s.T(), actual, 1, "aliases")
+	assert.Equal(s.T(), testOldIndexName, actual[0], "unmodified alias")
+
+	actual = aliases.IndicesByAlias(aliasForAllConcepts)
+	assert.Len(s.T(), actual, 0, "aliases")
+}
+
+func (s *EsServiceTestSuite) TestMigrateIndexInvalidMapping() {
+	mappingFile := filepath.Join(s.T().TempDir(), "mapping.json")
+	err := os.WriteFile(mappingFile, []byte(`{"mappings": {"properties": {"id": {"type": "no-such-type"}}}}`), 0600)
+	require.NoError(s.T(), err, "expected no error for writing mapping")
+
+	s.prepareMigration(mappingFile, MigrationOptions{})
+	err = s.service.MigrateIndex()
+	assert.ErrorIs(s.T(), err, ErrValidationFailed, "expected mapping to be rejected")
+	s.assertNothingMigrated()
+}
+
+func (s *EsServiceTestSuite) TestMigrateIndexInvalidAliasFilter() {
+	aliasFilterFile := filepath.Join(s.T().TempDir(), "alias-filter.json")
+	err := os.WriteFile(aliasFilterFile, []byte(`{"no_such_query": {"type": "topics"}}`), 0600)
+	require.NoError(s.T(), err, "expected no error for writing alias filter")
+
+	s.prepareMigration(testNewMappingFile, MigrationOptions{})
+	s.service.aliasFilterFile = aliasFilterFile
+	err = s.service.MigrateIndex()
+	assert.ErrorIs(s.T(), err, ErrValidationFailed, "expected alias filter to be rejected")
+	s.assertNothingMigrated()
+}
+
+func (s *EsServiceTestSuite) TestMigrateIndexUpToDateValidatesFiles() {
+	aliasFilterFile := filepath.Join(s.T().TempDir(), "alias-filter.json")
+	err := os.WriteFile(aliasFilterFile, []byte(`{"no_such_query": {"type": "topics"}}`), 0600)
+	require.NoError(s.T(), err, "expected no error for writing alias filter")
+
+	s.prepareMigration(testOldMappingFile, MigrationOptions{})
+	s.service.aliasFilterFile = aliasFilterFile
+	s.forCurrentIndexVersion()
+	err = s.service.MigrateIndex()
+	assert.NoError(s.T(), err, "expected no error for an up-to-date index")
+
+	_, err = s.service.filesValidChecker()
+	assert.ErrorIs(s.T(), err, ErrValidationFailed, "expected validation failure in the health check")
+
+	s.service.aliasFilterFile = testAliasFilterFile
+	err = s.service.MigrateIndex()
+	assert.NoError(s.T(), err, "expected no error for an up-to-date index")
+
+	_, err = s.service.filesValidChecker()
+	assert.NoError(s.T(), err, "expected the health check to pass once the files are valid")
+}
+
+// assertNothingMigrated checks that a migration which failed validation did not change the cluster, and reports the failure
+func (s *EsServiceTestSuite) assertNothingMigrated() {
+	exists, err := s.ec.IndexExists(testNewIndexName).Do(context.Background())
+	require.NoError(s.T(), err, "expected no error for checking new index")
+	assert.False(s.T(), exists, "new index created")
+
+	readOnly, err := s.service.isReadOnly(s.ec, testOldIndexName)
+	require.NoError(s.T(), err, "expected no error for reading index settings")
+	assert.False(s.T(), readOnly, "old index made read-only")
+
+	indices, err := s.ec.IndexNames()
+	require.NoError(s.T(), err, "expected no error for listing indices")
+	for _, index := range indices {
+		assert.False(s.T(), strings.HasPrefix(index, validationIndexPrefix), "validation index %s left behind", index)
+	}
+
+	_, err = s.service.filesValidChecker()
+	assert.ErrorIs(s.T(), err, ErrValidationFailed, "expected validation failure in the health check")
+}
+
+func (s *EsServiceTestSuite) TestMigrateIndexClusterUnhealthy() {
+	s.service = esService{}
+	s.forNextIndexVersion()
+
+	err := createAlias(s.ec, testIndexName, testOldIndexName)
+	require.NoError(s.T(), err, "expected no error in creating index alias")
+
+	s.service.elasticClient = s.ec
+	s.service.aliasName = testIndexName
+	s.service.mappingFile = testNewMappingFile
+	s.service.aliasFilterFile = testAliasFilterFile
+	err = s.service.MigrateIndex()
+
+	assert.Error(s.T(), err, "expected error for migrating index in unhealthy ES cluster")
+	assert.EqualError(s.T(), err, "Cluster is yellow", "error message")
+
+	aliases, err := s.ec.Aliases().Do(context.Background())
+	assert.NoError(s.T(), err, "expected no error for retrieving aliases")
+
+	actual := aliases.IndicesByAlias(testIndexName)
+	assert.Len(s.T(), actual, 1, "aliases")
+	assert.Equal(s.T(), testOldIndexName, actual[0], "unmodified alias")
+}
+
+func (s *EsServiceTestSuite) TestStartMigration() {
+	s.service = esService{}
+	s.forCurrentIndexVersion()
+
+	err := createAlias(s.ec, testIndexName, testOldIndexName)
+	require.NoError(s.T(), err, "expected no error in creating index alias")
+
+	s.service.elasticClient = s.ec
+	s.service.migrationCheck = true
+	s.service.pollReindexInterval = time.Second
+	s.service.aliasName = testIndexName
+	s.service.mappingFile = testNewMappingFile
+
+	requiredVersion := semver.MustParse(testIndexVersion).IncPatch()
+	version := requiredVersion.String()
+	migration, err := s.service.StartMigration(MigrationRequest{Version: version})
+	require.NoError(s.T(), err, "expected no error for starting migration")
+	assert.NotEmpty(s.T(), migration.ID, "migration id")
+	assert.Equal(s.T(), version, migration.Version, "migration version")
+
+	migration = s.waitForMigration(migration.ID)
+	assert.Equal(s.T(), PhaseDone, migration.Phase, "migration phase")
+	assert.Empty(s.T(), migration.LastError, "migration error")
+	assert.NotNil(s.T(), migration.EndTime, "migration end time")
+	assert.Equal(s.T(), testOldIndexName, migration.SourceIndex, "migration source index")
+	assert.Equal(s.T(), testNewIndexName, migration.TargetIndex, "migration target index")
+	assert.Equal(s.T(), size, migration.DocsTotal, "documents to reindex")
+	assert.Equal(s.T(), size, migration.DocsDone, "documents reindexed")
+
+	current, err := s.service.CurrentMigration()
+	assert.NoError(s.T(), err, "expected no error for getting current migration")
+	assert.Equal(s.T(), migration.ID, current.ID, "current migration")
+
+	aliases, err := s.ec.Aliases().Do(context.Background())
+	assert.NoError(s.T(), err, "expected no error for retrieving aliases")
+
+	actual := aliases.IndicesByAlias(testIndexName)
+	assert.Len(s.T(), actual, 1, "aliases")
+	assert.Equal(s.T(), testNewIndexName, actual[0], "updated alias")
+
+	msg, err := s.service.mappingsChecker()
+	assert.NoError(s.T(), err, "expected mappings check to pass after migration")
+	assert.Contains(s.T(), msg, version, "mappings check message")
+}
+
+func (s *EsServiceTestSuite) TestStartMigrationWithUploadedMapping() {
+	s.service = esService{}
+	s.forCurrentIndexVersion()
+
+	err := createAlias(s.ec, testIndexName, testOldIndexName)
+	require.NoError(s.T(), err, "expected no error in creating index alias")
+
+	mapping, err := ioutil.ReadFile(testStrictMappingFile)
+	require.NoError(s.T(), err, "expected no error for reading mapping")
+
+	s.service.elasticClient = s.ec
+	s.service.migrationCheck = true
+	s.service.pollReindexInterval = time.Second
+	s.service.aliasName = testIndexName
+	s.service.mappingFile = testNewMappingFile
+
+	requiredVersion := semver.MustParse(testIndexVersion).IncPatch()
+	version := requiredVersion.String()
+	migration, err := s.service.StartMigration(MigrationRequest{Version: version, Mapping: mapping})
+	require.NoError(s.T(), err, "expected no error for starting migration")
+
+	migration = s.waitForMigration(migration.ID)
+	assert.Equal(s.T(), PhaseDone, migration.Phase, "migration phase")
+
+	mappings, err := s.ec.GetMapping().Index(testNewIndexName).Do(context.Background())
+	require.NoError(s.T(), err, "expected no error for reading new index mapping")
+	dynamic := mappings[testNewIndexName].(map[string]interface{})["mappings"].(map[string]interface{})["dynamic"]
+	assert.Equal(s.T(), "strict", dynamic, "expected new index to have the uploaded mapping")
+	assert.Equal(s.T(), version, s.service.indexVersion, "index version after migration")
+	assert.NotEqual(s.T(), testNewMappingFile, s.service.mappingFile, "mapping file after migration")
+}
+
+func (s *EsServiceTestSuite) TestStartMigrationFailureKeepsVersion() {
+	s.service = esService{}
+	s.forCurrentIndexVersion()
+
+	err := createAlias(s.ec, testIndexName, testOldIndexName)
+	require.NoError(s.T(), err, "expected no error in creating index alias")
+
+	s.service.elasticClient = s.ec
+	s.service.migrationCheck = true
+	s.service.pollReindexInterval = time.Second
+	s.service.aliasName = testIndexName
+	s.service.mappingFile = testNewMappingFile
+
+	requiredVersion := semver.MustParse(testIndexVersion).IncPatch()
+	version := requiredVersion.String()
+	mapping := []byte(`{"mappings": {"properties": {"id": {"type": "no-such-type"}}}}`)
+	migration, err := s.service.StartMigration(MigrationRequest{Version: version, Mapping: mapping})
+	require.NoError(s.T(), err, "expected no error for starting migration")
+
+	migration = s.waitForMigration(migration.ID)
+	assert.Equal(s.T(), PhaseFailed, migration.Phase, "migration phase")
+	assert.Equal(s.T(), testIndexVersion, s.service.indexVersion, "expected index version to be kept")
+	assert.Equal(s.T(), testNewMappingFile, s.service.mappingFile, "expected mapping file to be kept")
+}
+
+func (s *EsServiceTestSuite) TestStartMigrationWhileRunning() {
+	s.service = esService{}
+	s.service.elasticClient = s.ec
+	s.service.migrationCheck = false
+
+	_, err := s.service.StartMigration(MigrationRequest{Version: "9.9.9"})
+	assert.ErrorIs(s.T(), err, ErrMigrationRunning, "expected error for starting a migration while one is running")
+}
+
+func (s *EsServiceTestSuite) TestStartMigrationInvalidMapping() {
+	s.service = esService{}
+	s.service.elasticClient = s.ec
+	s.service.migrationCheck = true
+
+	_, err := s.service.StartMigration(MigrationRequest{Version: "9.9.9", Mapping: []byte(`{"mappings": `)})
+	assert.ErrorIs(s.T(), err, ErrInvalidMapping, "expected error for starting a migration with an invalid mapping")
+	assert.True(s.T(), s.service.migrationCheck, "expected no migration to be running")
+}
+
+func (s *EsServiceTestSuite) TestGetMigrationNotFound() {
+	s.service = esService{}
+
+	_, err := s.service.GetMigration("unknown")
+	assert.ErrorIs(s.T(), err, ErrMigrationNotFound, "expected error for unknown migration")
+}
+
+func (s *EsServiceTestSuite) TestMigrationHistory() {
+	s.service = esService{}
+	err := createAlias(s.ec, testIndexName, testOldIndexName)
+	require.NoError(s.T(), err, "expected no error in creating index alias")
+
+	migration := s.startMigration()
+	migration = s.waitForMigration(migration.ID)
+	require.Equal(s.T(), PhaseDone, migration.Phase, "migration phase")
+
+	// a restarted service only knows the migration from its record
+	restarted := esService{elasticClient: s.ec, aliasName: testIndexName}
+	migrations, err := restarted.ListMigrations(0)
+	require.NoError(s.T(), err, "expected no error for listing migrations")
+	require.Len(s.T(), migrations, 1, "migrations")
+	assert.Equal(s.T(), migration.ID, migrations[0].ID, "migration id")
+	assert.Equal(s.T(), PhaseDone, migrations[0].Phase, "recorded phase")
+	assert.Equal(s.T(), testOldIndexName, migrations[0].SourceIndex, "recorded source index")
+	assert.Equal(s.T(), testNewIndexName, migrations[0].TargetIndex, "recorded target index")
+	assert.Equal(s.T(), size, migrations[0].DocsDone, "recorded documents reindexed")
+	assert.NotNil(s.T(), migrations[0].EndTime, "recorded end time")
+	require.NotNil(s.T(), migrations[0].Plan, "recorded plan")
+	assert.True(s.T(), migrations[0].Plan.ReindexRequired, "recorded plan reindex")
+
+	recorded, err := restarted.GetMigration(migration.ID)
+	require.NoError(s.T(), err, "expected no error for getting recorded migration")
+	assert.Equal(s.T(), migration.StartTime.Unix(), recorded.StartTime.Unix(), "recorded start time")
+
+	other := esService{elasticClient: s.ec, aliasName: aliasForAllConcepts}
+	migrations, err = other.ListMigrations(0)
+	assert.NoError(s.T(), err, "expected no error for listing migrations")
+	assert.Empty(s.T(), migrations, "migrations of another index")
+}
+
+func (s *EsServiceTestSuite) TestMigrationHistoryResumesInterruptedMigration() {
+	s.service = esService{}
+	s.forNextIndexVersion()
+
+	err := createAlias(s.ec, testIndexName, testOldIndexName)
+	require.NoError(s.T(), err, "expected no error in creating index alias")
+
+	s.service.elasticClient = s.ec
+	s.service.aliasName = testIndexName
+	s.service.mappingFile = testNewMappingFile
+
+	// simulate a restart after the new index was created
+	plan, err := s.service.planMigration(s.ec)
+	require.NoError(s.T(), err, "expected no error for planning migration")
+	_, err = s.service.prepareTargetIndex(s.ec, plan)
+	require.NoError(s.T(), err, "expected no error for creating new index")
+	interrupted := &Migration{ID: "interrupted", Alias: testIndexName, Phase: PhaseReindexing, SourceIndex: testOldIndexName, TargetIndex: testNewIndexName, StartTime: time.Now().UTC().Add(-time.Minute)}
+	err = s.service.saveMigrationRecord(s.ec, interrupted)
+	require.NoError(s.T(), err, "expected no error for recording migration")
+
+	migration := s.startMigration()
+	migration = s.waitForMigration(migration.ID)
+	assert.Equal(s.T(), PhaseDone, migration.Phase, "migration phase")
+	assert.Equal(s.T(), "interrupted", migration.ResumedFrom, "resumed migration")
+
+	recorded, err := s.service.GetMigration("interrupted")
+	require.NoError(s.T(), err, "expected no error for getting interrupted migration")
+	assert.Equal(s.T(), PhaseFailed, recorded.Phase, "interrupted migration phase")
+	assert.Equal(s.T(), errInterrupted, recorded.LastError, "interrupted migration error")
+}
+
+func (s *EsServiceTestSuite) TestMigrationHistoryRestartsCopyOfFailedMigration() {
+	s.service = esService{}
+	s.forNextIndexVersion()
+
+	err := createAlias(s.ec, testIndexName, testOldIndexName)
+	require.NoError(s.T(), err, "expected no error in creating index alias")
+
+	s.service.elasticClient = s.ec
+	s.service.aliasName = testIndexName
+	s.service.mappingFile = testNewMappingFile
+
+	// simulate a failed migration whose new index was not marked stale, and a document deleted from the old index since it was copied
+	plan, err := s.service.planMigration(s.ec)
+	require.NoError(s.T(), err, "expected no error for planning migration")
+	_, err = s.service.prepareTargetIndex(s.ec, plan)
+	require.NoError(s.T(), err, "expected no error for creating new index")
+	deletedID := uuid.NewString()
+	_, err = s.ec.Index().Index(testNewIndexName).Id(deletedID).BodyJson(map[string]interface{}{"id": deletedID, "prefLabel": "Deleted since copied"}).Refresh("true").Do(context.Background())
+	require.NoError(s.T(), err, "expected no error for writing to the new index")
+	end := time.Now().UTC()
+	failed := &Migration{ID: "failed", Alias: testIndexName, Phase: PhaseFailed, SourceIndex: testOldIndexName, TargetIndex: testNewIndexName, StartTime: end.Add(-time.Minute), EndTime: &end, LastError: "reindex failed"}
+	err = s.service.saveMigrationRecord(s.ec, failed)
+	require.NoError(s.T(), err, "expected no error for recording migration")
+
+	migration := s.startMigration()
+	migration = s.waitForMigration(migration.ID)
+	assert.Equal(s.T(), PhaseDone, migration.Phase, "migration phase")
+	assert.Empty(s.T(), migration.ResumedFrom, "expected the failed migration not to be resumed")
+
+	exists, err := s.ec.Exists().Index(testNewIndexName).Id(deletedID).Do(context.Background())
+	assert.NoError(s.T(), err, "expected no error for checking document")
+	assert.False(s.T(), exists, "expected the new index to be copied again")
+}
+
+func (s *EsServiceTestSuite) TestMigrationLockOwnedByAnotherInstance() {
+	s.service = esService{options: MigrationOptions{LockTTL: 3 * time.Second}}
+	err := createAlias(s.ec, testIndexName, testOldIndexName)
+	require.NoError(s.T(), err, "expected no error in creating index alias")
+	s.lockMigration("other-reindexer", time.Minute)
+
+	migration := s.startMigration()
+	for i := 0; i < 10 && migration.LockedBy == ""; i++ {
+		time.Sleep(time.Second)
+		migration, err = s.service.GetMigration(migration.ID)
+		require.NoError(s.T(), err, "expected no error for getting migration")
+	}
+	assert.Equal(s.T(), "other-reindexer", migration.LockedBy, "instance the migration waits for")
+	assert.Equal(s.T(), PhasePlanning, migration.Phase, "migration phase")
+
+	msg, err := s.service.mappingsChecker()
+	assert.Error(s.T(), err, "expected mappings check to fail while waiting for the lock")
+	assert.Contains(s.T(), msg, "migration owned by other-reindexer", "mappings check message")
+
+	exists, err := s.ec.IndexExists(testNewIndexName).Do(context.Background())
+	require.NoError(s.T(), err, "expected no error for checking new index")
+	assert.False(s.T(), exists, "expected no new index while another instance holds the lock")
+
+	_, err = s.ec.Delete().Index(locksIndex).Id(testIndexName).Do(context.Background())
+	require.NoError(s.T(), err, "expected no error for releasing lock")
+
+	migration = s.waitForMigration(migration.ID)
+	assert.Equal(s.T(), PhaseDone, migration.Phase, "migration phase")
+	assert.Empty(s.T(), migration.LockedBy, "instance the migration waits for")
+	s.assertMigrationUnlocked()
+}
+
+func (s *EsServiceTestSuite) TestMigrationLockExpiredIsTakenOver() {
+	s.service = esService{}
+	s.forNextIndexVersion()
+	err := createAlias(s.ec, testIndexName, testOldIndexName)
+	require.NoError(s.T(), err, "expected no error in creating index alias")
+	s.lockMigration("stopped-reindexer", -time.Minute)
+
+	s.service.elasticClient = s.ec
+	s.service.pollReindexInterval = time.Second
+	s.service.aliasName = testIndexName
+	s.service.mappingFile = testNewMappingFile
+	err = s.service.MigrateIndex()
+	require.NoError(s.T(), err, "expected no error for migrating index")
+
+	aliases, err := s.ec.Aliases().Do(context.Background())
+	require.NoError(s.T(), err, "expected no error for retrieving aliases")
+	assert.Equal(s.T(), []string{testNewIndexName}, aliases.IndicesByAlias(testIndexName), "updated alias")
+	s.assertMigrationUnlocked()
+}
+
+// lockMigration records a migration lock of the alias held by another instance, which expires after ttl
+func (s *EsServiceTestSuite) lockMigration(owner string, ttl time.Duration) {
+	err := createSystemIndex(s.ec, locksIndex, locksIndexBody)
+	require.NoError(s.T(), err, "expected no error for creating locks index")
+
+	now := time.Now().UTC()
+	lock := migrationLock{Owner: owner, Alias: testIndexName, Acquired: now, Expires: now.Add(ttl)}
+	_, err = s.ec.Index().Index(locksIndex).Id(testIndexName).BodyJson(lock).Do(context.Background())
+	require.NoError(s.T(), err, "expected no error for recording lock")
+}
+
+func (s *EsServiceTestSuite) assertMigrationUnlocked() {
+	_, err := s.ec.Get().Index(locksIndex).Id(testIndexName).Do(context.Background())
+	assert.True(s.T(), elastic.IsNotFound(err), "expected the lock to be released")
+}
+
+// startMigration starts a migration of the alias, which must point to the old index, to the new index
+func (s *EsServiceTestSuite) startMigration() *Migration {
+	s.service.elasticClient = s.ec
+	s.service.migrationCheck = true
+	s.service.pollReindexInterval = time.Second
+	s.service.aliasName = testIndexName
+	s.service.mappingFile = testNewMappingFile
+
+	requiredVersion := semver.MustParse(testIndexVersion).IncPatch()
+	migration, err := s.service.StartMigration(MigrationRequest{Version: requiredVersion.String()})
+	require.NoError(s.T(), err, "expected no error for starting migration")
+	return migration
+}
+
+func (s *EsServiceTestSuite) TestCancelMigration() {
+	s.startThrottledMigration(MigrationOptions{})
+
+	migration, err := s.service.CancelMigration(false)
+	require.NoError(s.T(), err, "expected no error for cancelling migration")
+
+	migration = s.waitForMigration(migration.ID)
+	assert.Equal(s.T(), PhaseCancelled, migration.Phase, "migration phase")
+	s.assertMigrationUndone()
+
+	exists, err := s.ec.IndexExists(testNewIndexName).Do(context.Background())
+	assert.NoError(s.T(), err, "expected no error for checking new index")
+	assert.True(s.T(), exists, "expected new index to be kept")
+
+	_, err = s.service.CancelMigration(false)
+	assert.ErrorIs(s.T(), err, ErrNoMigrationRunning, "expected error for cancelling a finished migration")
+}
+
+func (s *EsServiceTestSuite) TestCancelMigrationDeletingTarget() {
+	s.startThrottledMigration(MigrationOptions{})
+
+	migration, err := s.service.CancelMigration(true)
+	require.NoError(s.T(), err, "expected no error for cancelling migration")
+
+	migration = s.waitForMigration(migration.ID)
+	assert.Equal(s.T(), PhaseCancelled, migration.Phase, "migration phase")
+	s.assertMigrationUndone()
+
+	exists, err := s.ec.IndexExists(testNewIndexName).Do(context.Background())
+	assert.NoError(s.T(), err, "expected no error for checking new index")
+	assert.False(s.T(), exists, "expected new index to be deleted")
+}
+
+func (s *EsServiceTestSuite) TestCancelMigrationRestoresAliasFilter() {
+	s.startThrottledMigration(MigrationOptions{})
+
+	filter, err := s.service.loadAliasFilter(s.ec, testOldIndexName, testIndexName)
+	require.NoError(s.T(), err, "expected no error for reading recorded alias filter")
+	meta, err := s.service.reindexerMeta(s.ec, testOldIndexName)
+	require.NoError(s.T(), err, "expected no error for reading reindexer metadata")
+	require.Contains(s.T(), meta, "alias_filters", "alias filter recorded by the running migration")
+
+	migration, err := s.service.CancelMigration(false)
+	require.NoError(s.T(), err, "expected no error for cancelling migration")
+	migration = s.waitForMigration(migration.ID)
+	assert.Equal(s.T(), PhaseCancelled, migration.Phase, "migration phase")
+
+	meta, err = s.service.reindexerMeta(s.ec, testOldIndexName)
+	require.NoError(s.T(), err, "expected no error for reading reindexer metadata")
+	assert.NotContains(s.T(), meta, "alias_filters", "expected the alias filter record to be removed, as there was none before the migration")
+
+	restored, err := s.service.loadAliasFilter(s.ec, testOldIndexName, testIndexName)
+	assert.NoError(s.T(), err, "expected no error for reading recorded alias filter")
+	assert.Equal(s.T(), filter, restored, "recorded alias filter")
+}
+
+func (s *EsServiceTestSuite) TestCancelMigrationDeletesSnapshot() {
+	s.startThrottledMigration(MigrationOptions{SnapshotRepository: testSnapshotRepository, SnapshotLocation: testSnapshotLocation})
+
+	state, err := s.service.loadMigrationState(s.ec, testNewIndexName)
+	require.NoError(s.T(), err, "expected no error for reading migration state")
+	require.NotNil(s.T(), state, "migration state")
+	require.NotEmpty(s.T(), state.Snapshot, "snapshot recorded in migration state")
+
+	migration, err := s.service.CancelMigration(false)
+	require.NoError(s.T(), err, "expected no error for cancelling migration")
+	migration = s.waitForMigration(migration.ID)
+	assert.Equal(s.T(), PhaseCancelled, migration.Phase, "migration phase")
+	assert.Empty(s.T(), migration.Snapshot, "expected no snapshot for a cancelled migration")
+
+	_, err = s.service.getSnapshot(s.ec, state.Snapshot)
+	if !assert.True(s.T(), elastic.IsNotFound(err), "expected snapshot to be deleted, got %v", err) {
+		s.deleteSnapshot(state.Snapshot)
+	}
+}
+
+// startThrottledMigration starts a migration with the options which reindexes one document per second, and waits for its reindex to start
+func (s *EsServiceTestSuite) startThrottledMigration(options MigrationOptions) {
+	options.ReindexBatchSize = 1
+	options.RequestsPerSecond = 1
+	s.service = esService{options: options}
+	s.forCurrentIndexVersion()
+
+	err := createAlias(s.ec, testIndexName, testOldIndexName)
+	require.NoError(s.T(), err, "expected no error in creating index alias")
+
+	s.service.elasticClient = s.ec
+	s.service.migrationCheck = true
+	s.service.pollReindexInterval = time.Second
+	s.service.aliasName = testIndexName
+	s.service.mappingFile = testNewMappingFile
+
+	requiredVersion := semver.MustParse(testIndexVersion).IncPatch()
+	migration, err := s.service.StartMigration(MigrationRequest{Version: requiredVersion.String()})
+	require.NoError(s.T(), err, "expected no error for starting migration")
+
+	for i := 0; i < 30; i++ {
+		migration, err = s.service.GetMigration(migration.ID)
+		require.NoError(s.T(), err, "expected no error for getting migration")
+		if migration.Phase == PhaseReindexing {
+			return
+		}
+		time.Sleep(time.Second)
+	}
+	require.Fail(s.T(), "migration did not start reindexing")
+}
+
+func (s *EsServiceTestSuite) TestPromoteMigration() {
+	migration := s.startPromotableMigration(MigrationOptions{CanaryAliasSuffix: "-next"})
+	assert.Equal(s.T(), testIndexName+"-next", migration.CanaryAlias, "canary alias")
+	assert.NotNil(s.T(), migration.PromotionDeadline, "expected the default promotion deadline without a timeout")
+
+	aliases, err := s.ec.Aliases().Do(context.Background())
+	require.NoError(s.T(), err, "expected no error for retrieving aliases")
+	assert.Equal(s.T(), []string{testNewIndexName}, aliases.IndicesByAlias(testIndexName+"-next"), "canary alias")
+	assert.Equal(s.T(), []string{testOldIndexName}, aliases.IndicesByAlias(testIndexName), "alias before promotion")
+
+	// the old index accepts writes while the migration waits to be promoted
+	writtenID := uuid.NewString()
+	_, err = s.ec.Index().Index(testIndexName).Id(writtenID).BodyJson(map[string]interface{}{"id": writtenID, "prefLabel": "Written before promotion"}).Do(context.Background())
+	require.NoError(s.T(), err, "expected no error for writing to the old index while waiting for promotion")
+
+	_, err = s.service.PromoteMigration()
+	require.NoError(s.T(), err, "expected no error for promoting migration")
+
+	migration = s.waitForMigration(migration.ID)
+	assert.Equal(s.T(), PhaseDone, migration.Phase, "migration phase")
+
+	aliases, err = s.ec.Aliases().Do(context.Background())
+	require.NoError(s.T(), err, "expected no error for retrieving aliases")
+	assert.Equal(s.T(), []string{testNewIndexName}, aliases.IndicesByAlias(testIndexName), "alias after promotion")
+	assert.Empty(s.T(), aliases.IndicesByAlias(testIndexName+"-next"), "expected canary alias to be removed")
+
+	_, err = s.ec.Get().Index(testNewIndexName).Id(writtenID).Do(context.Background())
+	assert.NoError(s.T(), err, "expected document written while waiting for promotion to be copied by the final catch-up pass")
+
+	readOnly, err := s.service.isReadOnly(s.ec, testOldIndexName)
+	require.NoError(s.T(), err, "expected no error for reading index settings")
+	assert.True(s.T(), readOnly, "expected old index to be read-only after promotion")
+
+	_, err = s.service.PromoteMigration()
+	assert.ErrorIs(s.T(), err, ErrNoMigrationRunning, "expected error for promoting a finished migration")
+}
+
+func (s *EsServiceTestSuite) TestPromotionTimeout() {
+	migration := s.startPromotableMigration(MigrationOptions{CanaryAliasSuffix: "-next", PromotionTimeout: 2 * time.Second})
+	assert.NotNil(s.T(), migration.PromotionDeadline, "promotion deadline")
+
+	migration = s.waitForMigration(migration.ID)
+	assert.Equal(s.T(), PhaseFailed, migration.Phase, "migration phase")
+	assert.Contains(s.T(), migration.LastError, ErrPromotionTimedOut.Error(), "migration error")
+	s.assertMigrationUndone()
+
+	aliases, err := s.ec.Aliases().Do(context.Background())
+	require.NoError(s.T(), err, "expected no error for retrieving aliases")
+	assert.Empty(s.T(), aliases.IndicesByAlias(testIndexName+"-next"), "expected canary alias to be removed")
+}
+
+func (s *EsServiceTestSuite) TestPromoteOnTimeout() {
+	migration := s.startPromotableMigration(MigrationOptions{CanaryAliasSuffix: "-next", PromotionTimeout: 2 * time.Second, PromoteOnTimeout: true})
+
+	migration = s.waitForMigration(migration.ID)
+	assert.Equal(s.T(), PhaseDone, migration.Phase, "migration phase")
+
+	aliases, err := s.ec.Aliases().Do(context.Background())
+	require.NoError(s.T(), err, "expected no error for retrieving aliases")
+	assert.Equal(s.T(), []string{testNewIndexName}, aliases.IndicesByAlias(testIndexName), "alias after promotion")
+}
+
+func (s *EsServiceTestSuite) TestPromotedMigrationFailure() {
+	migration := s.startPromotableMigration(MigrationOptions{CanaryAliasSuffix: "-next"})
+
+	// an alias cannot have the name of an index, so moving the aliases fails once the migration is promoted
+	s.service.aliasForAllConcepts = testOldIndexName
+	_, err := s.service.PromoteMigration()
+	require.NoError(s.T(), err, "expected no error for promoting migration")
+
+	migration = s.waitForMigration(migration.ID)
+	assert.Equal(s.T(), PhaseFailed, migration.Phase, "migration phase")
+	s.assertMigrationUndone()
+
+	aliases, err := s.ec.Aliases().Do(context.Background())
+	require.NoError(s.T(), err, "expected no error for retrieving aliases")
+	assert.Empty(s.T(), aliases.IndicesByAlias(testIndexName+"-next"), "expected canary alias to be removed")
+}
+
+func (s *EsServiceTestSuite) TestPromotableMigrationLockExpired() {
+	migration := s.startPromotableMigration(MigrationOptions{CanaryAliasSuffix: "-next", LockTTL: 3 * time.Second})
+
+	// the heartbeat cannot extend a lock which no longer exists, and no other instance holds it
+	_, err := s.ec.Delete().Index(locksIndex).Id(testIndexName).Do(context.Background())
+	require.NoError(s.T(), err, "expected no error for deleting lock")
+
+	migration = s.waitForMigration(migration.ID)
+	assert.Equal(s.T(), PhaseFailed, migration.Phase, "migration phase")
+	assert.Contains(s.T(), migration.LastError, ErrMigrationLockLost.Error(), "migration error")
+	s.assertMigrationUndone()
+
+	aliases, err := s.ec.Aliases().Do(context.Background())
+	require.NoError(s.T(), err, "expected no error for retrieving aliases")
+	assert.Empty(s.T(), aliases.IndicesByAlias(testIndexName+"-next"), "expected canary alias to be removed")
+}
+
+func (s *EsServiceTestSuite) TestPromotableMigrationLockTakenOver() {
+	migration := s.startPromotableMigration(MigrationOptions{CanaryAliasSuffix: "-next", LockTTL: 3 * time.Second})
+	s.lockMigration("other-reindexer", time.Minute)
+
+	migration = s.waitForMigration(migration.ID)
+	assert.Equal(s.T(), PhaseFailed, migration.Phase, "migration phase")
+	assert.Contains(s.T(), migration.LastError, ErrMigrationLockLost.Error(), "migration error")
+
+	aliases, err := s.ec.Aliases().Do(context.Background())
+	require.NoError(s.T(), err, "expected no error for retrieving aliases")
+	assert.Equal(s.T(), []string{testNewIndexName}, aliases.IndicesByAlias(testIndexName+"-next"), "expected canary alias to be left to the other instance")
+}
+
+func (s *EsServiceTestSuite) TestMigrationLockTakenOver() {
+	s.service = esService{aliasName: testIndexName}
+	lease := &migrationLease{lock: migrationLock{Owner: "reindexer-1", Alias: testIndexName}}
+	err := createSystemIndex(s.ec, locksIndex, locksIndexBody)
+	require.NoError(s.T(), err, "expected no error for creating locks index")
+	assert.False(s.T(), s.service.lockTakenOver(s.ec, lease), "expected no other owner without a lock")
+
+	s.lockMigration("reindexer-1", -time.Minute)
+	assert.False(s.T(), s.service.lockTakenOver(s.ec, lease), "expected no other owner of an expired lock of this instance")
+
+	s.lockMigration("reindexer-2", -time.Minute)
+	assert.False(s.T(), s.service.lockTakenOver(s.ec, lease), "expected no other owner of an expired lock")
+
+	s.lockMigration("reindexer-2", time.Minute)
+	assert.True(s.T(), s.service.lockTakenOver(s.ec, lease), "expected another owner of the lock")
+}
+
+// startPromotableMigration starts a migration with a canary alias, and waits for it to be ready to promote
+func (s *EsServiceTestSuite) startPromotableMigration(options MigrationOptions) *Migration {
+	s.service = esService{options: options}
+	s.forCurrentIndexVersion()
+
+	err := createAlias(s.ec, testIndexName, testOldIndexName)
+	require.NoError(s.T(), err, "expected no error in creating index alias")
+
+	s.service.elasticClient = s.ec
+	s.service.migrationCheck = true
+	s.service.pollReindexInterval = time.Second
+	s.service.aliasName = testIndexName
+	s.service.mappingFile = testNewMappingFile
+
+	requiredVersion := semver.MustParse(testIndexVersion).IncPatch()
+	migration, err := s.service.StartMigration(MigrationRequest{Version: requiredVersion.String()})
+	require.NoError(s.T(), err, "expected no error for starting migration")
+
+	for i := 0; i < 30; i++ {
+		migration, err = s.service.GetMigration(migration.ID)
+		require.NoError(s.T(), err, "expected no error for getting migration")
+		if migration.Phase == PhaseReadyToPromote {
+			return migration
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+	require.Fail(s.T(), "migration did not become ready to promote")
+	return nil
+}
+
+// assertMigrationUndone checks that the old index is writable and still behind the alias
+func (s *EsServiceTestSuite) assertMigrationUndone() {
+	readOnly, err := s.service.isReadOnly(s.ec, testOldIndexName)
+	assert.NoError(s.T(), err, "expected no error for reading old index settings")
+	assert.False(s.T(), readOnly, "expected old index to be writable")
+
+	aliases, err := s.ec.Aliases().Do(context.Background())
+	assert.NoError(s.T(), err, "expected no error for retrieving aliases")
+
+	actual := aliases.IndicesByAlias(testIndexName)
+	assert.Len(s.T(), actual, 1, "aliases")
+	assert.Equal(s.T(), testOldIndexName, actual[0], "unmodified alias")
+}
+
+func (s *EsServiceTestSuite) TestApplyRetentionClosesSupersededIndex() {
+	s.prepareRetention(RetentionPolicy{MaxAge: time.Nanosecond})
+
+	result, err := s.service.ApplyRetention(false)
+	require.NoError(s.T(), err, "expected no error for applying retention policy")
+	require.Len(s.T(), result.Indices, 1, "superseded indices")
+	assert.Equal(s.T(), testOldIndexName, result.Indices[0].Name, "superseded index")
+	assert.Equal(s.T(), RetentionClose, result.Indices[0].Action, "retention action")
+
+	_, err = s.ec.Count(testOldIndexName).Do(context.Background())
+	assert.Error(s.T(), err, "expected superseded index to be closed")
+
+	_, err = s.ec.Count(testNewIndexName).Do(context.Background())
+	assert.NoError(s.T(), err, "expected current index to stay open")
+}
+
+func (s *EsServiceTestSuite) TestApplyRetentionDryRun() {
+	s.prepareRetention(RetentionPolicy{MaxAge: time.Nanosecond, Delete: true})
+
+	result, err := s.service.ApplyRetention(true)
+	require.NoError(s.T(), err, "expected no error for applying retention policy")
+	assert.True(s.T(), result.DryRun, "dry run")
+	require.Len(s.T(), result.Indices, 1, "superseded indices")
+	assert.Equal(s.T(), RetentionDelete, result.Indices[0].Action, "retention action")
+
+	exists, err := s.ec.IndexExists(testOldIndexName).Do(context.Background())
+	assert.NoError(s.T(), err, "expected no error for checking superseded index")
+	assert.True(s.T(), exists, "expected superseded index not to be deleted by a dry run")
+}
+
+func (s *EsServiceTestSuite) TestApplyRetentionKeepsIndices() {
+	policies := map[string]RetentionPolicy{
+		"most recent versions": {KeepVersions: 1, Delete: true},
+		"younger than max age": {MaxAge: time.Hour, Delete: true},
+		"no policy":            {},
+	}
+
+	for name, policy := range policies {
+		s.SetupTest()
+		s.prepareRetention(policy)
+
+		result, err := s.service.ApplyRetention(false)
+		require.NoError(s.T(), err, "expected no error for applying retention policy")
+		require.Len(s.T(), result.Indices, 1, "superseded indices")
+		assert.Equal(s.T(), RetentionKeep, result.Indices[0].Action, "retention action for %s", name)
+
+		exists, err := s.ec.IndexExists(testOldIndexName).Do(context.Background())
+		assert.NoError(s.T(), err, "expected no error for checking superseded index")
+		assert.True(s.T(), exists, "expected superseded index to be kept for %s", name)
+	}
+}
+
+func (s *EsServiceTestSuite) TestApplyRetentionKeepsAliasedIndex() {
+	s.prepareRetention(RetentionPolicy{MaxAge: time.Nanosecond, Delete: true})
+
+	err := createAlias(s.ec, aliasForAllConcepts, testOldIndexName)
+	require.NoError(s.T(), err, "expected no error in creating index alias")
+
+	result, err := s.service.ApplyRetention(false)
+	require.NoError(s.T(), err, "expected no error for applying retention policy")
+	require.Len(s.T(), result.Indices, 1, "superseded indices")
+	assert.Equal(s.T(), RetentionKeep, result.Indices[0].Action, "retention action")
+
+	exists, err := s.ec.IndexExists(testOldIndexName).Do(context.Background())
+	assert.NoError(s.T(), err, "expected no error for checking superseded index")
+	assert.True(s.T(), exists, "expected aliased index to be kept")
+
+	_, _ = s.ec.Alias().Remove(testOldIndexName, aliasForAllConcepts).Do(context.Background())
+}
+
+func (s *EsServiceTestSuite) TestApplyRetentionIgnoresOtherAliases() {
+	// the index of another alias which starts with the same name, created before the new index
+	other := testIndexName + "-people-v2"
+	err := createIndex(s.ec, other, testOldMappingFile)
+	require.NoError(s.T(), err, "expected no error in creating index")
+	defer s.ec.DeleteIndex(other).Do(context.Background())
+	s.prepareRetention(RetentionPolicy{MaxAge: time.Nanosecond, Delete: true})
+
+	result, err := s.service.ApplyRetention(false)
+	require.NoError(s.T(), err, "expected no error for applying retention policy")
+	require.Len(s.T(), result.Indices, 1, "superseded indices")
+	assert.Equal(s.T(), testOldIndexName, result.Indices[0].Name, "superseded index")
+
+	exists, err := s.ec.IndexExists(other).Do(context.Background())
+	assert.NoError(s.T(), err, "expected no error for checking index of another alias")
+	assert.True(s.T(), exists, "expected index of another alias to be kept")
+}
+
+func (s *EsServiceTestSuite) TestApplyRetentionLocked() {
+	s.prepareRetention(RetentionPolicy{MaxAge: time.Nanosecond, Delete: true})
+	s.lockMigration("other-reindexer", time.Minute)
+
+	_, err := s.service.ApplyRetention(false)
+	assert.ErrorIs(s.T(), err, ErrMigrationLocked, "expected error while another instance migrates the index")
+
+	exists, err := s.ec.IndexExists(testOldIndexName).Do(context.Background())
+	assert.NoError(s.T(), err, "expected no error for checking superseded index")
+	assert.True(s.T(), exists, "expected superseded index to be kept")
+}
+
+func (s *EsServiceTestSuite) TestApplyRetentionWhileMigrating() {
+	s.service = esService{}
+	s.service.elasticClient = s.ec
+
+	_, err := s.service.ApplyRetention(true)
+	assert.ErrorIs(s.T(), err, ErrMigrationRunning, "expected error for applying retention policy during a migration")
+}
+
+// prepareRetention sets up the new index behind the alias, superseding the old one
+func (s *EsServiceTestSuite) prepareRetention(policy RetentionPolicy) {
+	s.prepareMigration(testNewMappingFile, MigrationOptions{Retention: policy})
+
+	err := createIndex(s.ec, testNewIndexName, testNewMappingFile)
+	require.NoError(s.T(), err, "expected no error for creating new index")
+	_, err = s.ec.Alias().Remove(testOldIndexName, testIndexName).Add(testNewIndexName, testIndexName).Do(context.Background())
+	require.NoError(s.T(), err, "expected no error in moving index alias")
+
+	s.service.migrationCheck = true
+}
+
+func (s *EsServiceTestSuite) waitForMigration(id string) *Migration {
+	for i := 0; i < 60; i++ {
+		migration, err := s.service.GetMigration(id)
+		require.NoError(s.T(), err, "expected no error for getting migration")
+		if !migration.Running() {
+			return migration
+		}
+		time.Sleep(time.Second)
+	}
+	require.Fail(s.T(), "migration did not finish")
+	return nil
+}
+
+func (s *EsServiceTestSuite) TestPlanMigration() {
+	s.service = esService{}
+	s.forNextIndexVersion()
+
+	err := createAlias(s.ec, testIndexName, testOldIndexName)
+	require.NoError(s.T(), err, "expected no error in creating index alias")
+
+	s.service.elasticClient = s.ec
+	s.service.aliasName = testIndexName
+	s.service.aliasForAllConcepts = aliasForAllConcepts
+	s.service.mappingFile = testNewMappingFile
+	s.service.aliasFilterFile = testAliasFilterFile
+	plan, err := s.service.PlanMigration()
+
+	require.NoError(s.T(), err, "expected no error for planning migration")
+	assert.True(s.T(), plan.UpdateRequired, "expected update required")
+	assert.True(s.T(), plan.ReindexRequired, "expected reindex required")
+	assert.Equal(s.T(), testOldIndexName, plan.CurrentIndex, "current index")
+	assert.Equal(s.T(), testNewIndexName, plan.NewIndex, "new index")
+	assert.Equal(s.T(), testOldIndexName, plan.ReadOnlyIndex, "read-only index")
+	assert.Equal(s.T(), int64(size), plan.DocumentCount, "documents to copy")
+	require.Len(s.T(), plan.AliasChanges, 2, "alias changes")
+	assert.Equal(s.T(), testIndexName, plan.AliasChanges[0].Alias, "filtered alias")
+	assert.NotEmpty(s.T(), plan.AliasChanges[0].Filter, "alias filter")
+	assert.Equal(s.T(), aliasForAllConcepts, plan.AliasChanges[1].Alias, "unfiltered alias")
+	assert.Empty(s.T(), plan.AliasChanges[1].Filter, "alias filter")
+	assert.Contains(s.T(), plan.String(), fmt.Sprintf("%d documents from %s to %s", size, testOldIndexName, testNewIndexName), "plan text")
+
+	exists, err := s.ec.IndexExists(testNewIndexName).Do(context.Background())
+	assert.NoError(s.T(), err, "expected no error for checking new index")
+	assert.False(s.T(), exists, "new index should not have been created")
+
+	aliases, err := s.ec.Aliases().Do(context.Background())
+	assert.NoError(s.T(), err, "expected no error for retrieving aliases")
+
+	actual := aliases.IndicesByAlias(testIndexName)
+	assert.Len(s.T(), actual, 1, "aliases")
+	assert.Equal(s.T(), testOldIndexName, actual[0], "unmodified alias")
+}
+
+func (s *EsServiceTestSuite) TestPlanMigrationUpToDate() {
+	s.service = esService{}
+	s.forCurrentIndexVersion()
+
+	err := createAlias(s.ec, testIndexName, testOldIndexName)
+	require.NoError(s.T(), err, "expected no error in creating index alias")
+
+	s.service.elasticClient = s.ec
+	s.service.aliasName = testIndexName
+	s.service.mappingFile = testNewMappingFile
+	plan, err := s.service.PlanMigration()
+
+	require.NoError(s.T(), err, "expected no error for planning migration")
+	assert.False(s.T(), plan.UpdateRequired, "expected no update required")
+	assert.False(s.T(), plan.ReindexRequired, "expected no reindex required")
+	assert.Empty(s.T(), plan.AliasChanges, "alias changes")
+}
+
+func (s *EsServiceTestSuite) TestDiffMapping() {
+	s.service = esService{}
+	s.forNextIndexVersion()
+
+	err := createAlias(s.ec, testIndexName, testOldIndexName)
+	require.NoError(s.T(), err, "expected no error in creating index alias")
+
+	s.service.elasticClient = s.ec
+	s.service.aliasName = testIndexName
+	s.service.mappingFile = testNewMappingFile
+	diff, err := s.service.DiffMapping()
+
+	require.NoError(s.T(), err, "expected no error for comparing mappings")
+	assert.Equal(s.T(), testOldIndexName, diff.Index, "compared index")
+	assert.Len(s.T(), diff.Added, 2, "added fields")
+	assert.Equal(s.T(), "prefLabel.mentionsCompletion", diff.Added[0].Field, "added field")
+	assert.Empty(s.T(), diff.Removed, "removed fields")
+	assert.Empty(s.T(), diff.TypeChanged, "type changes")
+	assert.Empty(s.T(), diff.AnalyzerChanged, "analyzer changes")
+}
+
+func (s *EsServiceTestSuite) TestMappingDiffCheckerUpToDate() {
+	s.service = esService{}
+	s.forCurrentIndexVersion()
+
+	err := createAlias(s.ec, testIndexName, testOldIndexName)
+	require.NoError(s.T(), err, "expected no error in creating index alias")
+
+	s.service.elasticClient = s.ec
+	s.service.aliasName = testIndexName
+	s.service.mappingFile = testOldMappingFile
+	s.service.migrationCheck = true
+
+	msg, err := s.service.mappingDiffChecker()
+	assert.NoError(s.T(), err, "expected no error")
+	assert.Contains(s.T(), msg, "matches", "healthcheck message")
+}
+
+func (s *EsServiceTestSuite) TestMappingDiffCheckerOutOfDate() {
+	s.service = esService{}
+	s.forCurrentIndexVersion()
+
+	err := createAlias(s.ec, testIndexName, testOldIndexName)
+	require.NoError(s.T(), err, "expected no error in creating index alias")
+
+	s.service.elasticClient = s.ec
+	s.service.aliasName = testIndexName
+	s.service.mappingFile = testNewMappingFile
+	s.service.migrationCheck = true
+
+	msg, err := s.service.mappingDiffChecker()
+	assert.Error(s.T(), err, "expected an unhealthy response")
+	assert.Contains(s.T(), msg, "prefLabel.mentionsCompletion", "healthcheck message")
+}
+
+func (s *EsServiceTestSuite) TestRollbackIndex() {
+	s.prepareMigration(testNewMappingFile, MigrationOptions{})
+	s.service.aliasForAllConcepts = aliasForAllConcepts
+
+	filter, err := ioutil.ReadFile(testAliasFilterFile)
+	require.NoError(s.T(), err, "this test case requires a query filter json at '%v'", testAliasFilterFile)
+
+	_, err = s.ec.Alias().AddWithFilter(testOldIndexName, testIndexName, elastic.NewRawStringQuery(string(filter))).Do(context.Background())
+	require.NoError(s.T(), err, "expected no error in filtering index alias")
+
+	err = s.service.MigrateIndex()
+	require.NoError(s.T(), err, "expected no error for migrating index")
+	s.service.migrationCheck = true
+
+	result, err := s.service.RollbackIndex()
+	assert.NoError(s.T(), err, "expected no error for rolling back index")
+	assert.Equal(s.T(), testNewIndexName, result.From, "rolled back from")
+	assert.Equal(s.T(), testOldIndexName, result.To, "rolled back to")
+
+	aliases, err := s.ec.Aliases().Do(context.Background())
+	assert.NoError(s.T(), err, "expected no error for retrieving aliases")
+
+	actual := aliases.IndicesByAlias(testIndexName)
+	assert.Len(s.T(), actual, 1, "aliases")
+	assert.Equal(s.T(), testOldIndexName, actual[0], "rolled back alias")
+
+	actual = aliases.IndicesByAlias(aliasForAllConcepts)
+	assert.Len(s.T(), actual, 1, "aliases")
+	assert.Equal(s.T(), testOldIndexName, actual[0], "rolled back alias")
+
+	count, err := s.ec.Count(testIndexName).Do(context.Background())
+	assert.NoError(s.T(), err, "expected no error for checking index size")
+	assert.Equal(s.T(), size/2, int(count), "aliased index size with restored filter")
+
+	_, err = s.ec.Index().Index(testIndexName).Id(uuid.NewString()).BodyJson(map[string]interface{}{"aliases": []string{"Test"}}).Do(context.Background())
+	assert.NoError(s.T(), err, "expected previous index to be writable")
+
+	err = s.service.MigrateIndex()
+	assert.ErrorIs(s.T(), err, ErrVersionRolledBack, "expected the rolled back version not to be migrated to again")
+
+	aliases, err = s.ec.Aliases().Do(context.Background())
+	assert.NoError(s.T(), err, "expected no error for retrieving aliases")
+	assert.Equal(s.T(), []string{testOldIndexName}, aliases.IndicesByAlias(testIndexName), "rolled back alias")
+}
+
+func (s *EsServiceTestSuite) TestRollbackIndexFromHistory() {
+	s.service = esService{}
+	err := createAlias(s.ec, testIndexName, testOldIndexName)
+	require.NoError(s.T(), err, "expected no error in creating index alias")
+
+	// the most recently created index before the new one is not the one the aliases are moved from
+	unused := testIndexName + "-0.0.0"
+	err = createIndex(s.ec, unused, testOldMappingFile)
+	require.NoError(s.T(), err, "expected no error in creating index")
+	defer s.ec.DeleteIndex(unused).Do(context.Background())
+
+	migration := s.waitForMigration(s.startMigration().ID)
+	require.Equal(s.T(), PhaseDone, migration.Phase, "migration phase")
+
+	result, err := s.service.RollbackIndex()
+	assert.NoError(s.T(), err, "expected no error for rolling back index")
+	assert.Equal(s.T(), testNewIndexName, result.From, "rolled back from")
+	assert.Equal(s.T(), testOldIndexName, result.To, "rolled back to the index of the last migration")
+}
+
+func (s *EsServiceTestSuite) TestRollbackIndexIgnoresOtherAliases() {
+	s.prepareMigration(testNewMappingFile, MigrationOptions{})
+
+	// the index of another alias which starts with the same name, created after the old index
+	other := testIndexName + "-people-v2"
+	err := createIndex(s.ec, other, testOldMappingFile)
+	require.NoError(s.T(), err, "expected no error in creating index")
+	defer s.ec.DeleteIndex(other).Do(context.Background())
+
+	err = s.service.MigrateIndex()
+	require.NoError(s.T(), err, "expected no error for migrating index")
+	s.service.migrationCheck = true
+
+	result, err := s.service.RollbackIndex()
+	assert.NoError(s.T(), err, "expected no error for rolling back index")
+	assert.Equal(s.T(), testOldIndexName, result.To, "rolled back to a version of the alias")
+}
+
+func (s *EsServiceTestSuite) TestRollbackIndexLocked() {
+	s.service = esService{}
+	err := createAlias(s.ec, testIndexName, testOldIndexName)
+	require.NoError(s.T(), err, "expected no error in creating index alias")
+	s.lockMigration("other-reindexer", time.Minute)
+
+	s.service.elasticClient = s.ec
+	s.service.aliasName = testIndexName
+	s.service.migrationCheck = true
+
+	_, err = s.service.RollbackIndex()
+	assert.ErrorIs(s.T(), err, ErrMigrationLocked, "expected error while another instance migrates the index")
+}
+
+func (s *EsServiceTestSuite) TestRollbackIndexNoPreviousVersion() {
+	s.service = esService{}
+	s.forCurrentIndexVersion()
+
+	err := createAlias(s.ec, testIndexName, testOldIndexName)
+	require.NoError(s.T(), err, "expected no error in creating index alias")
+
+	s.service.elasticClient = s.ec
+	s.service.aliasName = testIndexName
+	s.service.migrationCheck = true
+
+	_, err = s.service.RollbackIndex()
+	assert.True(s.T(), errors.Is(err, ErrNoPreviousIndex), "expected no previous index error")
+
+	aliases, err := s.ec.Aliases().Do(context.Background())
+	assert.NoError(s.T(), err, "expected no error for retrieving aliases")
+
+	actual := aliases.IndicesByAlias(testIndexName)
+	assert.Len(s.T(), actual, 1, "aliases")
+	assert.Equal(s.T(), testOldIndexName, actual[0], "unmodified alias")
+}
+
+func (s *EsServiceTestSuite) TestRollbackIndexWhileMigrating() {
+	s.service = esService{}
+	s.service.elasticClient = s.ec
+	s.service.aliasName = testIndexName
+
+	_, err := s.service.RollbackIndex()
+	assert.EqualError(s.T(), err, ErrMigrationRunning.Error(), "expected migration running error")
 }
 
 func (s *EsServiceTestSuite) TestMappingsCheckerInProgress() {
@@ -0,0 +1,261 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+
+	log "github.com/Financial-Times/go-logger"
+	"github.com/olivere/elastic/v7"
+)
+
+var ErrSettingsUpdateRejected = errors.New("Settings update was rejected")
+
+// creationSettings can only be set when an index is created, so changing them requires a reindex.
+// A setting ending with a dot stands for all the settings it is the prefix of.
+var creationSettings = []string{"number_of_shards", "number_of_routing_shards", "routing_partition_size", "sort.", "soft_deletes."}
+
+// staticSettings can only be updated while the index is closed, as can the analysis settings, which the mapping diff compares by component.
+// All the other settings which are not creation settings are dynamic.
+var staticSettings = []string{"codec", "shard.check_on_startup", "load_fixed_bitset_filters_eagerly", "store.", "similarity."}
+
+// SettingsUpdate is how an in-place migration changes the settings of the current index, by their keys without the index. prefix
+type SettingsUpdate struct {
+	Dynamic []string `json:"dynamic,omitempty"`
+	// Static settings, including the analysis settings, are updated with the index closed
+	Static []string `json:"static,omitempty"`
+
+	dynamic map[string]interface{}
+	static  map[string]interface{}
+}
+
+// readSettings reads the optional settings file, which holds the settings section of an index creation body
+func (es *esService) readSettings() (map[string]interface{}, error) {
+	if len(es.settingsFile) == 0 {
+		return nil, nil
+	}
+
+	b, err := ioutil.ReadFile(es.settingsFile)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrValidationFailed, err)
+	}
+	var settings map[string]interface{}
+	if err := json.Unmarshal(b, &settings); err != nil {
+		return nil, fmt.Errorf("%w: settings %s is not a valid JSON object: %s", ErrValidationFailed, es.settingsFile, err)
+	}
+	return settings, nil
+}
+
+// indexBody merges the settings into the index creation body of the mapping file, overriding the settings they both define
+func indexBody(mapping string, settings map[string]interface{}) (string, error) {
+	if len(settings) == 0 {
+		return mapping, nil
+	}
+
+	var body map[string]interface{}
+	if err := json.Unmarshal([]byte(mapping), &body); err != nil {
+		return "", err
+	}
+
+	existing, _ := body["settings"].(map[string]interface{})
+	merged := flatIndexSettings(existing)
+	for key, value := range flatIndexSettings(settings) {
+		merged[key] = value
+	}
+	body["settings"] = merged
+
+	b, err := json.Marshal(body)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// flatIndexSettings flattens settings, whether nested or flat and whether or not they are under "index", into dotted keys with the index. prefix
+func flatIndexSettings(settings map[string]interface{}) map[string]interface{} {
+	expanded := expandSettings(settings)
+	index, ok := expanded["index"].(map[string]interface{})
+	if !ok {
+		index = make(map[string]interface{})
+	}
+	for key, value := range expanded {
+		if key != "index" {
+			index[key] = value
+		}
+	}
+
+	flat := make(map[string]interface{})
+	flattenSettingValues("index", index, flat)
+	return flat
+}
+
+func flattenSettingValues(prefix string, settings map[string]interface{}, flat map[string]interface{}) {
+	for key, value := range settings {
+		path := prefix + "." + key
+		if nested, ok := value.(map[string]interface{}); ok {
+			flattenSettingValues(path, nested, flat)
+			continue
+		}
+		flat[path] = value
+	}
+}
+
+func matchesSetting(key string, settings []string) bool {
+	for _, setting := range settings {
+		if key == setting || (strings.HasSuffix(setting, ".") && strings.HasPrefix(key, setting)) {
+			return true
+		}
+	}
+	return false
+}
+
+// planSettingsUpdate works out how the settings the mapping diff found changed can be applied to the current index.
+// It returns false if any of them can only be changed by a reindex: a creation setting, or a removed analysis component.
+func planSettingsUpdate(plan *MigrationPlan) (*SettingsUpdate, bool) {
+	diff := plan.MappingDiff
+	update := &SettingsUpdate{dynamic: map[string]interface{}{}, static: map[string]interface{}{}}
+
+	var index struct {
+		Settings map[string]interface{} `json:"settings"`
+	}
+	if err := json.Unmarshal([]byte(plan.mapping), &index); err != nil {
+		return nil, false
+	}
+	wanted := flatIndexSettings(index.Settings)
+
+	for _, change := range diff.SettingsChanged {
+		if matchesSetting(change.Field, creationSettings) {
+			return nil, false
+		}
+
+		key := "index." + change.Field
+		if matchesSetting(change.Field, staticSettings) {
+			update.Static = append(update.Static, change.Field)
+			update.static[key] = wanted[key]
+		} else {
+			update.Dynamic = append(update.Dynamic, change.Field)
+			update.dynamic[key] = wanted[key]
+		}
+	}
+
+	// analysis components are compared as a whole, so the changed ones are updated with all their settings
+	for _, change := range diff.AnalysisChanged {
+		if change.Change == "removed" {
+			return nil, false
+		}
+
+		update.Static = append(update.Static, "analysis."+change.Component)
+		prefix := "index.analysis." + change.Component + "."
+		for key, value := range wanted {
+			if strings.HasPrefix(key, prefix) {
+				update.static[key] = value
+			}
+		}
+	}
+
+	sort.Strings(update.Dynamic)
+	sort.Strings(update.Static)
+	return update, true
+}
+
+// Empty reports whether the update changes no settings
+func (u *SettingsUpdate) Empty() bool {
+	return len(u.Dynamic) == 0 && len(u.Static) == 0
+}
+
+// String summarises the update on a single line
+func (u *SettingsUpdate) String() string {
+	var parts []string
+	if len(u.Dynamic) > 0 {
+		parts = append(parts, fmt.Sprintf("dynamic %s", strings.Join(u.Dynamic, ", ")))
+	}
+	if len(u.Static) > 0 {
+		parts = append(parts, fmt.Sprintf("static %s, with the index closed", strings.Join(u.Static, ", ")))
+	}
+	return strings.Join(parts, "; ")
+}
+
+// updateSettingsInPlace applies the dynamic settings to the open index, then the static ones in a close, update and open cycle.
+// Searches and writes through the aliases fail while the index is closed.
+func (es *esService) updateSettingsInPlace(client *elastic.Client, indexName string, update *SettingsUpdate) error {
+	if len(update.dynamic) > 0 {
+		log.WithFields(map[string]interface{}{"index": indexName, "settings": strings.Join(update.Dynamic, ", ")}).Info("updating dynamic index settings")
+		_, err := client.IndexPutSettings(indexName).BodyJson(update.dynamic).Do(context.Background())
+		if elastic.IsStatusCode(err, http.StatusBadRequest) {
+			return fmt.Errorf("%w: %v", ErrSettingsUpdateRejected, err)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(update.static) == 0 {
+		return nil
+	}
+
+	log.WithFields(map[string]interface{}{"index": indexName, "settings": strings.Join(update.Static, ", ")}).Info("closing index to update static index settings")
+	_, err := client.CloseIndex(indexName).Do(context.Background())
+	if err != nil {
+		// the index may have been closed even though the request failed, for example if it timed out
+		if openErr := es.reopenIndex(client, indexName); openErr != nil {
+			return openErr
+		}
+		return err
+	}
+
+	_, err = client.IndexPutSettings(indexName).BodyJson(update.static).Do(context.Background())
+	// the index is opened again whether or not its settings were updated, and a migration must not carry on with it closed
+	if openErr := es.reopenIndex(client, indexName); openErr != nil {
+		return openErr
+	}
+
+	if elastic.IsStatusCode(err, http.StatusBadRequest) {
+		return fmt.Errorf("%w: %v", ErrSettingsUpdateRejected, err)
+	}
+	return err
+}
+
+// previousSettings returns the update which puts back the values the index has for the settings an update changes,
+// removing the ones it has not got
+func (es *esService) previousSettings(client *elastic.Client, indexName string, update *SettingsUpdate) (*SettingsUpdate, error) {
+	settings, err := client.IndexGetSettings(indexName).FlatSettings(true).Do(context.Background())
+	if err != nil {
+		return nil, err
+	}
+
+	var current map[string]interface{}
+	if index, found := settings[indexName]; found {
+		current = index.Settings
+	}
+	previous := &SettingsUpdate{Dynamic: update.Dynamic, Static: update.Static, dynamic: map[string]interface{}{}, static: map[string]interface{}{}}
+	for key := range update.dynamic {
+		previous.dynamic[key] = current[key]
+	}
+	for key := range update.static {
+		previous.static[key] = current[key]
+	}
+	return previous, nil
+}
+
+// restoreSettings puts back the settings of an index after a failed in-place update
+func (es *esService) restoreSettings(client *elastic.Client, indexName string, previous *SettingsUpdate) {
+	log.WithField("index", indexName).Info("restoring index settings after failed in-place update")
+	if err := es.updateSettingsInPlace(client, indexName, previous); err != nil {
+		log.WithError(err).WithField("index", indexName).Error("unable to restore index settings after failed in-place update")
+	}
+}
+
+// reopenIndex opens an index closed by an in-place update
+func (es *esService) reopenIndex(client *elastic.Client, indexName string) error {
+	_, err := client.OpenIndex(indexName).Do(context.Background())
+	if err != nil {
+		log.WithError(err).WithField("index", indexName).Error("unable to open index after updating its settings")
+		return fmt.Errorf("index %s was left closed: %w", indexName, err)
+	}
+	return nil
+}
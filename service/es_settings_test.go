@@ -0,0 +1,125 @@
+package service
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIndexBody(t *testing.T) {
+	mapping := `{"settings": {"index": {"number_of_shards": 1, "refresh_interval": "1s"}}, "mappings": {"properties": {"id": {"type": "keyword"}}}}`
+	settings := map[string]interface{}{
+		"index.refresh_interval": "5s",
+		"analysis":               map[string]interface{}{"analyzer": map[string]interface{}{"label": map[string]interface{}{"type": "standard"}}},
+	}
+
+	body, err := indexBody(mapping, settings)
+	require.NoError(t, err, "expected no error for merging settings")
+
+	var index struct {
+		Settings map[string]interface{} `json:"settings"`
+		Mappings map[string]interface{} `json:"mappings"`
+	}
+	require.NoError(t, json.Unmarshal([]byte(body), &index), "expected valid index creation body")
+	assert.Equal(t, map[string]interface{}{
+		"index.number_of_shards":             1.0,
+		"index.refresh_interval":             "5s",
+		"index.analysis.analyzer.label.type": "standard",
+	}, index.Settings, "merged settings")
+	assert.Contains(t, index.Mappings, "properties", "mappings")
+
+	unchanged, err := indexBody(mapping, nil)
+	require.NoError(t, err, "expected no error without settings")
+	assert.Equal(t, mapping, unchanged, "expected the mapping to be kept as it is without settings")
+}
+
+func TestReadSettingsInvalid(t *testing.T) {
+	settingsFile := filepath.Join(t.TempDir(), "settings.json")
+	require.NoError(t, os.WriteFile(settingsFile, []byte(`["number_of_replicas"]`), 0600), "expected no error for writing settings")
+
+	es := &esService{mappingFile: "test/new-mapping.json", settingsFile: settingsFile}
+	_, _, err := es.readValidatedFiles()
+	assert.ErrorIs(t, err, ErrValidationFailed, "expected validation error for settings which are not an object")
+}
+
+func TestPlanSettingsUpdate(t *testing.T) {
+	plan := &MigrationPlan{
+		mapping: `{"settings": {"index": {"number_of_replicas": 2, "codec": "best_compression"}, "analysis": {"analyzer": {"label": {"type": "custom", "tokenizer": "standard"}}}}}`,
+		MappingDiff: &MappingDiff{
+			SettingsChanged: []FieldChange{{Field: "number_of_replicas", Old: "1", New: "2"}, {Field: "codec", New: "best_compression"}},
+			AnalysisChanged: []AnalysisChange{{Component: "analyzer.label", Change: "added"}},
+		},
+	}
+
+	update, ok := planSettingsUpdate(plan)
+	require.True(t, ok, "expected settings to be updated in place")
+	assert.Equal(t, []string{"number_of_replicas"}, update.Dynamic, "dynamic settings")
+	assert.Equal(t, []string{"analysis.analyzer.label", "codec"}, update.Static, "static settings")
+	assert.Equal(t, map[string]interface{}{"index.number_of_replicas": 2.0}, update.dynamic, "dynamic settings body")
+	assert.Equal(t, map[string]interface{}{
+		"index.codec":                             "best_compression",
+		"index.analysis.analyzer.label.type":      "custom",
+		"index.analysis.analyzer.label.tokenizer": "standard",
+	}, update.static, "static settings body")
+}
+
+func TestPlanSettingsUpdateRequiresReindex(t *testing.T) {
+	diffs := map[string]*MappingDiff{
+		"shard count":                {SettingsChanged: []FieldChange{{Field: "number_of_shards", Old: "1", New: "2"}}},
+		"index sorting":              {SettingsChanged: []FieldChange{{Field: "sort.field", New: "prefLabel"}}},
+		"removed analysis component": {AnalysisChanged: []AnalysisChange{{Component: "filter.synonyms", Change: "removed"}}},
+	}
+	for name, diff := range diffs {
+		_, ok := planSettingsUpdate(&MigrationPlan{mapping: `{}`, MappingDiff: diff})
+		assert.False(t, ok, "expected a reindex for %s", name)
+	}
+}
+
+func TestCanUpdateInPlaceOptOut(t *testing.T) {
+	settingsOnly := func() *MigrationPlan {
+		return &MigrationPlan{
+			mapping:     `{"settings": {"index": {"number_of_replicas": 2}}, "mappings": {"properties": {"id": {"type": "keyword"}}}}`,
+			MappingDiff: &MappingDiff{SettingsChanged: []FieldChange{{Field: "number_of_replicas", Old: "1", New: "2"}}},
+		}
+	}
+	addedField := func() *MigrationPlan {
+		return &MigrationPlan{
+			mapping:     `{"mappings": {"properties": {"id": {"type": "keyword"}}}}`,
+			MappingDiff: &MappingDiff{Added: []FieldChange{{Field: "id", New: "keyword"}}},
+		}
+	}
+
+	es := &esService{options: MigrationOptions{InPlaceMappingUpdates: true, InPlaceSettingsUpdates: true}}
+	assert.True(t, es.canUpdateInPlace(settingsOnly()), "expected settings to be updated in place")
+	assert.True(t, es.canUpdateInPlace(addedField()), "expected mapping to be updated in place")
+
+	es = &esService{options: MigrationOptions{InPlaceMappingUpdates: true}}
+	assert.False(t, es.canUpdateInPlace(settingsOnly()), "expected a reindex for settings without in-place settings updates")
+	assert.True(t, es.canUpdateInPlace(addedField()), "expected mapping to be updated in place")
+
+	es = &esService{options: MigrationOptions{InPlaceSettingsUpdates: true}}
+	assert.True(t, es.canUpdateInPlace(settingsOnly()), "expected settings to be updated in place")
+	assert.False(t, es.canUpdateInPlace(addedField()), "expected a reindex for added fields without in-place mapping updates")
+}
+
+func TestCanUpdateInPlaceWithCompletionField(t *testing.T) {
+	// the cluster reports the analyzers of a completion field, which the mapping file leaves to their defaults
+	live, err := parseIndexDefinition([]byte(`{"mappings": {"properties": {
+		"prefLabel": {"type": "text", "fields": {"mentionsCompletion": {"type": "completion", "analyzer": "simple", "search_analyzer": "simple"}}}
+	}}}`))
+	require.NoError(t, err, "expected no error for parsing live definition")
+	mapping := `{"mappings": {"properties": {
+		"prefLabel": {"type": "text", "fields": {"mentionsCompletion": {"type": "completion"}}},
+		"aliases": {"type": "text"}
+	}}}`
+	wanted, err := parseIndexDefinition([]byte(mapping))
+	require.NoError(t, err, "expected no error for parsing wanted definition")
+
+	es := &esService{options: MigrationOptions{InPlaceMappingUpdates: true}}
+	plan := &MigrationPlan{mapping: mapping, MappingDiff: compareIndexDefinitions(live, wanted)}
+	assert.True(t, es.canUpdateInPlace(plan), "expected an added field to be applied in place next to a completion field")
+}
@@ -0,0 +1,208 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	log "github.com/Financial-Times/go-logger"
+	"github.com/olivere/elastic/v7"
+)
+
+var ErrSmokeTestFailed = errors.New("Smoke test against the new index failed")
+
+// smokeQuery is a search which consumers of the index rely on, with what it must return.
+// Every smoke query must run without error, even if it has no other expectation.
+type smokeQuery struct {
+	name string
+	// Search is the body of the search request, run as it is apart from the alias filter
+	Search map[string]interface{} `json:"search"`
+	// Hits is the exact number of hits the search must find
+	Hits *int64 `json:"hits,omitempty"`
+	// MinHits is the least number of hits the search must find
+	MinHits *int64 `json:"minHits,omitempty"`
+	// RequiredIDs must be among the returned hits, which may need a larger size in the search
+	RequiredIDs []string `json:"requiredIds,omitempty"`
+}
+
+// SmokeTestResult is the outcome of a smoke query against the new index, with the hits it finds in the current index for comparison
+type SmokeTestResult struct {
+	Query        string   `json:"query"`
+	Passed       bool     `json:"passed"`
+	Hits         int64    `json:"hits"`
+	CurrentHits  *int64   `json:"currentHits,omitempty"`
+	Failures     []string `json:"failures,omitempty"`
+	CurrentError string   `json:"currentError,omitempty"`
+}
+
+// loadSmokeQueries reads every .json file of the directory as a smoke query named after the file, in the order of their names
+func loadSmokeQueries(dir string) ([]*smokeQuery, error) {
+	if _, err := os.Stat(dir); err != nil {
+		return nil, err
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+
+	var queries []*smokeQuery
+	for _, file := range files {
+		b, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+
+		query := &smokeQuery{name: strings.TrimSuffix(filepath.Base(file), ".json")}
+		if err := json.Unmarshal(b, query); err != nil {
+			return nil, fmt.Errorf("smoke query %s is not valid: %w", file, err)
+		}
+		if query.Search == nil {
+			query.Search = make(map[string]interface{})
+		}
+		queries = append(queries, query)
+	}
+	return queries, nil
+}
+
+// runSmokeTests runs the smoke queries against the new index, and against the current index to compare the number of hits.
+// It fails if any query errors or does not meet its expectations on the new index. The current index is only reported on.
+func (es *esService) runSmokeTests(client *elastic.Client, aliasFilter string, currentIndexName string, newIndexName string) error {
+	queries, err := loadSmokeQueries(es.options.SmokeQueriesDir)
+	if err != nil {
+		return err
+	}
+
+	var results []SmokeTestResult
+	var failed []string
+	for _, query := range queries {
+		result := SmokeTestResult{Query: query.name}
+
+		hits, ids, err := es.smokeSearch(client, newIndexName, aliasFilter, query.Search)
+		if err != nil {
+			result.Failures = append(result.Failures, fmt.Sprintf("search failed: %s", err))
+		} else {
+			result.Hits = hits
+			result.Failures = query.check(hits, ids)
+		}
+
+		if len(currentIndexName) > 0 {
+			currentHits, _, err := es.smokeSearch(client, currentIndexName, aliasFilter, query.Search)
+			if err != nil {
+				result.CurrentError = err.Error()
+			} else {
+				result.CurrentHits = &currentHits
+			}
+		}
+
+		result.Passed = len(result.Failures) == 0
+		fields := map[string]interface{}{"query": query.name, "index": newIndexName, "hits": result.Hits, "passed": result.Passed}
+		if result.CurrentHits != nil {
+			fields["currentHits"] = *result.CurrentHits
+		}
+		if result.Passed {
+			log.WithFields(fields).Info("smoke query passed")
+		} else {
+			fields["failures"] = strings.Join(result.Failures, "; ")
+			log.WithFields(fields).Error("smoke query failed")
+			failed = append(failed, query.name)
+		}
+		results = append(results, result)
+	}
+	es.setMigrationSmokeTests(results)
+
+	if len(failed) > 0 {
+		return fmt.Errorf("%w: %s", ErrSmokeTestFailed, strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// check returns how the hits found by the search fall short of the expectations of the query
+func (q *smokeQuery) check(hits int64, ids []string) []string {
+	var failures []string
+	if q.Hits != nil && hits != *q.Hits {
+		failures = append(failures, fmt.Sprintf("expected %d hits, found %d", *q.Hits, hits))
+	}
+	if q.MinHits != nil && hits < *q.MinHits {
+		failures = append(failures, fmt.Sprintf("expected at least %d hits, found %d", *q.MinHits, hits))
+	}
+
+	found := make(map[string]bool)
+	for _, id := range ids {
+		found[id] = true
+	}
+	for _, id := range q.RequiredIDs {
+		if !found[id] {
+			failures = append(failures, fmt.Sprintf("expected document %s among the hits", id))
+		}
+	}
+	return failures
+}
+
+// smokeSearch runs a search against the index as it would run against the alias, returning the total hits and the IDs of the returned hits
+func (es *esService) smokeSearch(client *elastic.Client, indexName string, aliasFilter string, search map[string]interface{}) (int64, []string, error) {
+	body := make(map[string]interface{})
+	for key, value := range search {
+		body[key] = value
+	}
+	body["track_total_hits"] = true
+	if len(aliasFilter) > 0 {
+		query, found := body["query"]
+		if !found {
+			query = map[string]interface{}{"match_all": map[string]interface{}{}}
+		}
+		body["query"] = map[string]interface{}{
+			"bool": map[string]interface{}{"must": query, "filter": json.RawMessage(aliasFilter)},
+		}
+	}
+
+	resp, err := client.PerformRequest(context.Background(), elastic.PerformRequestOptions{
+		Method: "POST",
+		Path:   fmt.Sprintf("/%s/_search", indexName),
+		Body:   body,
+	})
+	if err != nil {
+		return 0, nil, err
+	}
+
+	var result struct {
+		Hits struct {
+			Total struct {
+				Value int64 `json:"value"`
+			} `json:"total"`
+			Hits []struct {
+				ID string `json:"_id"`
+			} `json:"hits"`
+		} `json:"hits"`
+		Shards struct {
+			Failed   int `json:"failed"`
+			Failures []struct {
+				Reason taskError `json:"reason"`
+			} `json:"failures,omitempty"`
+		} `json:"_shards"`
+	}
+	if err := json.Unmarshal(resp.Body, &result); err != nil {
+		return 0, nil, fmt.Errorf("decoding search result of index %s: %w", indexName, err)
+	}
+	// a query which fails on some shards only still returns the hits of the others
+	if result.Shards.Failed > 0 {
+		reason := "unknown reason"
+		if len(result.Shards.Failures) > 0 {
+			reason = result.Shards.Failures[0].Reason.String()
+		}
+		return 0, nil, fmt.Errorf("search failed on %d shards: %s", result.Shards.Failed, reason)
+	}
+
+	var ids []string
+	for _, hit := range result.Hits.Hits {
+		ids = append(ids, hit.ID)
+	}
+	return result.Hits.Total.Value, ids, nil
+}
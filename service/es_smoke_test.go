@@ -0,0 +1,49 @@
+package service
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadSmokeQueries(t *testing.T) {
+	queries, err := loadSmokeQueries("test/smoke-queries")
+	require.NoError(t, err, "expected no error for loading smoke queries")
+	require.Len(t, queries, 3, "smoke queries")
+
+	assert.Equal(t, "all-concepts", queries[0].name, "queries named after their files, in order")
+	require.NotNil(t, queries[0].Hits, "expected hits")
+	assert.Equal(t, int64(100), *queries[0].Hits, "expected hits")
+
+	assert.Equal(t, "autocomplete", queries[1].name, "queries named after their files, in order")
+	assert.Nil(t, queries[1].Hits, "a query without expectations must only not error")
+	assert.Contains(t, queries[1].Search, "suggest", "search")
+
+	_, err = loadSmokeQueries("test/no-such-directory")
+	assert.Error(t, err, "expected error for a missing directory")
+}
+
+func TestSmokeQueryCheck(t *testing.T) {
+	hits, minHits := int64(2), int64(3)
+	query := &smokeQuery{Hits: &hits, MinHits: &minHits, RequiredIDs: []string{"a", "b"}}
+
+	assert.Equal(t, []string{
+		"expected 2 hits, found 1",
+		"expected at least 3 hits, found 1",
+		"expected document b among the hits",
+	}, query.check(1, []string{"a"}), "failures")
+
+	assert.Empty(t, (&smokeQuery{}).check(0, nil), "a query without expectations passes")
+	assert.Empty(t, (&smokeQuery{RequiredIDs: []string{"a"}}).check(5, []string{"c", "a"}), "required documents among the hits")
+}
+
+func TestCanUpdateInPlaceWithSmokeQueries(t *testing.T) {
+	plan := &MigrationPlan{
+		mapping:     `{"mappings": {"properties": {"id": {"type": "keyword"}}}}`,
+		MappingDiff: &MappingDiff{Added: []FieldChange{{Field: "id", New: "keyword"}}},
+	}
+
+	es := &esService{options: MigrationOptions{InPlaceMappingUpdates: true, SmokeQueriesDir: "test/smoke-queries"}}
+	assert.False(t, es.canUpdateInPlace(plan), "expected a reindex for smoke-tested migrations")
+}
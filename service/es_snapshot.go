@@ -0,0 +1,350 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	log "github.com/Financial-Times/go-logger"
+	"github.com/olivere/elastic/v7"
+)
+
+var (
+	ErrNoSnapshotRepository = errors.New("No snapshot repository is configured")
+	ErrNoSnapshot           = errors.New("No snapshot was taken by the migration of the current index")
+	ErrSnapshotFailed       = errors.New("Snapshot failed")
+	ErrSnapshotIndexOpen    = errors.New("Index of the snapshot is still open, roll back to it instead")
+	ErrSnapshotOnSource     = errors.New("Snapshots are taken on the source cluster and cannot be restored to the destination cluster")
+)
+
+// snapshot states, as reported by the snapshot API
+const (
+	snapshotInProgress = "IN_PROGRESS"
+	snapshotSuccess    = "SUCCESS"
+)
+
+type snapshotInfo struct {
+	Snapshot string   `json:"snapshot"`
+	State    string   `json:"state"`
+	Indices  []string `json:"indices"`
+	Failures []struct {
+		Index  string `json:"index"`
+		Reason string `json:"reason"`
+	} `json:"failures,omitempty"`
+}
+
+type RestoreResult struct {
+	Snapshot string `json:"snapshot"`
+	From     string `json:"from"`
+	To       string `json:"to"`
+}
+
+type EsSnapshotService interface {
+	RestoreSnapshot(snapshot string) (RestoreResult, error)
+}
+
+// snapshotSourceIndex snapshots the index the documents are copied from before writes to it are blocked, and waits for the snapshot to succeed.
+// The snapshot is recorded in the migration state, so that a resumed migration does not take another one.
+func (es *esService) snapshotSourceIndex(client *elastic.Client, source *elastic.Client, sourceIndexName string, targetIndexName string, state *migrationState) error {
+	es.setPhase(PhaseSnapshotting)
+	if len(state.Snapshot) > 0 {
+		info, err := es.getSnapshot(source, state.Snapshot)
+		switch {
+		case elastic.IsNotFound(err):
+			log.WithField("snapshot", state.Snapshot).Warn("snapshot of interrupted migration not found, taking a new one")
+		case err != nil:
+			return err
+		case info.State == snapshotSuccess || info.State == snapshotInProgress:
+			es.setMigrationSnapshot(state.Snapshot)
+			return es.waitForSnapshot(source, state.Snapshot)
+		default:
+			log.WithFields(map[string]interface{}{"snapshot": state.Snapshot, "state": info.State}).Warn("snapshot of interrupted migration did not succeed, taking a new one")
+		}
+	}
+
+	if err := es.ensureSnapshotRepository(source); err != nil {
+		return err
+	}
+
+	snapshot := snapshotName(sourceIndexName, time.Now())
+	log.WithFields(map[string]interface{}{"repository": es.options.SnapshotRepository, "snapshot": snapshot, "index": sourceIndexName}).Info("taking snapshot of current index")
+
+	_, err := source.PerformRequest(context.Background(), elastic.PerformRequestOptions{
+		Method: "PUT",
+		Path:   fmt.Sprintf("/_snapshot/%s/%s", es.options.SnapshotRepository, snapshot),
+		Body:   map[string]interface{}{"indices": sourceIndexName, "include_global_state": false},
+	})
+	if err != nil {
+		return err
+	}
+
+	state.Snapshot = snapshot
+	if err := es.saveMigrationState(client, targetIndexName, state); err != nil {
+		return err
+	}
+	es.setMigrationSnapshot(snapshot)
+
+	return es.waitForSnapshot(source, snapshot)
+}
+
+// snapshotName names a snapshot after the index and the time it was taken, in the lowercase form snapshot names require
+func snapshotName(indexName string, t time.Time) string {
+	return fmt.Sprintf("%s-%s", indexName, strings.ToLower(t.UTC().Format("20060102t150405z")))
+}
+
+// waitForSnapshot polls the snapshot until it has finished, aborting it if the migration is cancelled
+func (es *esService) waitForSnapshot(client *elastic.Client, snapshot string) error {
+	for {
+		info, err := es.getSnapshot(client, snapshot)
+		if err != nil {
+			return err
+		}
+
+		switch info.State {
+		case snapshotSuccess:
+			log.WithField("snapshot", snapshot).Info("snapshot of current index completed")
+			return nil
+		case snapshotInProgress:
+			es.setProgress(fmt.Sprintf("taking snapshot %s", snapshot))
+		default:
+			err := fmt.Errorf("%w: %s is %s", ErrSnapshotFailed, snapshot, info.State)
+			for _, failure := range info.Failures {
+				err = fmt.Errorf("%w, %s: %s", err, failure.Index, failure.Reason)
+			}
+			return err
+		}
+
+		select {
+		case <-es.cancelSignal():
+			if err := es.deleteSnapshot(client, snapshot); err != nil {
+				log.WithError(err).WithField("snapshot", snapshot).Error("unable to abort snapshot")
+			}
+			return ErrMigrationCancelled
+		case <-es.lockLostSignal():
+			return ErrMigrationLockLost
+		case <-time.After(es.pollReindexInterval):
+		}
+	}
+}
+
+// deleteSnapshot deletes a snapshot, aborting it if it is still being taken
+func (es *esService) deleteSnapshot(client *elastic.Client, snapshot string) error {
+	_, err := client.PerformRequest(context.Background(), elastic.PerformRequestOptions{
+		Method: "DELETE",
+		Path:   fmt.Sprintf("/_snapshot/%s/%s", es.options.SnapshotRepository, snapshot),
+	})
+	if elastic.IsNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+// deleteMigrationSnapshot deletes the snapshot taken by a cancelled migration, which no migration will restore
+func (es *esService) deleteMigrationSnapshot(client *elastic.Client, state *migrationState) {
+	if len(state.Snapshot) == 0 {
+		return
+	}
+
+	source, err := es.sourceEsClient(client)
+	if err == nil {
+		err = es.deleteSnapshot(source, state.Snapshot)
+	}
+	if err != nil {
+		log.WithError(err).WithField("snapshot", state.Snapshot).Error("unable to delete snapshot of cancelled migration")
+		return
+	}
+	log.WithField("snapshot", state.Snapshot).Info("deleted snapshot of cancelled migration")
+	state.Snapshot = ""
+	es.setMigrationSnapshot("")
+}
+
+func (es *esService) getSnapshot(client *elastic.Client, snapshot string) (*snapshotInfo, error) {
+	resp, err := client.PerformRequest(context.Background(), elastic.PerformRequestOptions{
+		Method: "GET",
+		Path:   fmt.Sprintf("/_snapshot/%s/%s", es.options.SnapshotRepository, snapshot),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var snapshots struct {
+		Snapshots []snapshotInfo `json:"snapshots"`
+	}
+	if err := json.Unmarshal(resp.Body, &snapshots); err != nil {
+		return nil, fmt.Errorf("decoding snapshot %s: %w", snapshot, err)
+	}
+	if len(snapshots.Snapshots) != 1 {
+		return nil, fmt.Errorf("expected one snapshot named %s, found %d", snapshot, len(snapshots.Snapshots))
+	}
+	return &snapshots.Snapshots[0], nil
+}
+
+// ensureSnapshotRepository registers the snapshot repository as a shared file system repository if a location is configured.
+// Otherwise the repository must already be registered on the cluster.
+func (es *esService) ensureSnapshotRepository(client *elastic.Client) error {
+	if len(es.options.SnapshotRepository) == 0 {
+		return ErrNoSnapshotRepository
+	}
+	if len(es.options.SnapshotLocation) == 0 {
+		return nil
+	}
+
+	_, err := client.PerformRequest(context.Background(), elastic.PerformRequestOptions{
+		Method: "PUT",
+		Path:   fmt.Sprintf("/_snapshot/%s", es.options.SnapshotRepository),
+		Body:   map[string]interface{}{"type": "fs", "settings": map[string]interface{}{"location": es.options.SnapshotLocation}},
+	})
+	if err != nil {
+		return fmt.Errorf("unable to register snapshot repository %s: %w", es.options.SnapshotRepository, err)
+	}
+	return nil
+}
+
+// RestoreSnapshot restores the index of a snapshot taken before a migration, and moves the aliases back to it with the alias filter
+// it had then. Without a snapshot name, the snapshot taken by the migration to the current index is restored.
+// The index must have been deleted or closed since, otherwise the migration can simply be rolled back to it.
+// Migrations from a source cluster snapshot the index there, so their snapshots are not restored.
+func (es *esService) RestoreSnapshot(snapshot string) (RestoreResult, error) {
+	client := es.esClient()
+	if client == nil {
+		return RestoreResult{}, ErrNoElasticClient
+	}
+
+	if es.options.SourceCluster != nil {
+		return RestoreResult{}, ErrSnapshotOnSource
+	}
+
+	es.RLock()
+	running := !es.migrationCheck
+	es.RUnlock()
+	if running {
+		return RestoreResult{}, ErrMigrationRunning
+	}
+
+	if err := es.ensureSnapshotRepository(client); err != nil {
+		return RestoreResult{}, err
+	}
+
+	lease, err := es.lockIndexChange(client)
+	if err != nil {
+		return RestoreResult{}, err
+	}
+	defer es.releaseMigrationLock(client, lease)
+
+	_, currentIndexName, _, err := es.checkIndexAliases(client, es.aliasName)
+	if err != nil {
+		log.WithError(err).Error(fmt.Sprintf("unable to read alias definition for %s alias", es.aliasName))
+		return RestoreResult{}, err
+	}
+
+	if len(snapshot) == 0 {
+		if len(currentIndexName) == 0 {
+			return RestoreResult{}, ErrNoSnapshot
+		}
+		state, err := es.loadMigrationState(client, currentIndexName)
+		if err != nil {
+			return RestoreResult{}, err
+		}
+		if state == nil || len(state.Snapshot) == 0 {
+			return RestoreResult{}, ErrNoSnapshot
+		}
+		snapshot = state.Snapshot
+	}
+
+	info, err := es.getSnapshot(client, snapshot)
+	if err != nil {
+		log.WithError(err).WithField("snapshot", snapshot).Error("unable to read snapshot")
+		return RestoreResult{}, err
+	}
+	if info.State != snapshotSuccess {
+		return RestoreResult{}, fmt.Errorf("%w: %s is %s", ErrSnapshotFailed, snapshot, info.State)
+	}
+
+	var indexName string
+	for _, index := range info.Indices {
+		if isAliasIndex(es.aliasName, index) {
+			indexName = index
+		}
+	}
+	if len(indexName) == 0 {
+		return RestoreResult{}, fmt.Errorf("snapshot %s holds no version of alias %s", snapshot, es.aliasName)
+	}
+
+	// an existing index can only be restored into while it is closed
+	open, err := es.isIndexOpen(client, indexName)
+	if err != nil {
+		return RestoreResult{}, err
+	}
+	if open {
+		return RestoreResult{}, fmt.Errorf("%w: %s", ErrSnapshotIndexOpen, indexName)
+	}
+
+	log.WithFields(map[string]interface{}{"snapshot": snapshot, "index": indexName}).Info("restoring index from snapshot")
+	_, err = client.PerformRequest(context.Background(), elastic.PerformRequestOptions{
+		Method: "POST",
+		Path:   fmt.Sprintf("/_snapshot/%s/%s/_restore", es.options.SnapshotRepository, snapshot),
+		Params: map[string][]string{"wait_for_completion": {"true"}},
+		Body:   map[string]interface{}{"indices": indexName, "include_aliases": false, "include_global_state": false},
+	})
+	if err != nil {
+		log.WithError(err).WithField("snapshot", snapshot).Error("unable to restore snapshot")
+		return RestoreResult{}, err
+	}
+
+	aliasFilter, err := es.loadAliasFilter(client, indexName, es.aliasName)
+	if err != nil {
+		log.WithError(err).Error("unable to read restored alias filter")
+		return RestoreResult{}, err
+	}
+
+	err = es.setWritable(client, indexName)
+	if err != nil {
+		log.WithError(err).Error("unable to set index writable")
+		return RestoreResult{}, err
+	}
+
+	aliasService := es.aliasActions(elastic.NewAliasService(client), es.aliasName, aliasFilter, currentIndexName, indexName)
+	for _, alias := range es.unfilteredAliases() {
+		aliasService = es.aliasActions(aliasService, alias, "", currentIndexName, indexName)
+	}
+
+	_, err = aliasService.Do(context.Background())
+	if err != nil {
+		log.WithError(err).Error("failed to move index aliases to restored index")
+		return RestoreResult{}, err
+	}
+
+	result := RestoreResult{Snapshot: snapshot, From: currentIndexName, To: indexName}
+	es.Lock()
+	es.migrationErr = fmt.Errorf("index %s has been restored from snapshot %s", result.To, result.Snapshot)
+	es.Unlock()
+	log.WithFields(map[string]interface{}{"snapshot": result.Snapshot, "from": result.From, "to": result.To}).Info("index restored from snapshot")
+
+	return result, nil
+}
+
+// isIndexOpen returns false if the index is closed or does not exist
+func (es *esService) isIndexOpen(client *elastic.Client, indexName string) (bool, error) {
+	resp, err := client.PerformRequest(context.Background(), elastic.PerformRequestOptions{
+		Method: "GET",
+		Path:   fmt.Sprintf("/_cat/indices/%s", indexName),
+		Params: map[string][]string{"format": {"json"}, "h": {"status"}},
+	})
+	if elastic.IsNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	var indices []struct {
+		Status string `json:"status"`
+	}
+	if err := json.Unmarshal(resp.Body, &indices); err != nil {
+		return false, fmt.Errorf("decoding status of index %s: %w", indexName, err)
+	}
+	return len(indices) == 1 && indices[0].Status == "open", nil
+}
@@ -0,0 +1,34 @@
+package service
+
+import (
+	"testing"
+	"time"
+
+	"github.com/olivere/elastic/v7"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSnapshotName(t *testing.T) {
+	taken := time.Date(2024, 3, 1, 12, 30, 5, 0, time.FixedZone("CET", 3600))
+	assert.Equal(t, "concepts-1.0.0-20240301t113005z", snapshotName("concepts-1.0.0", taken), "snapshot name")
+}
+
+func TestEnsureSnapshotRepositoryNotConfigured(t *testing.T) {
+	es := &esService{}
+	assert.ErrorIs(t, es.ensureSnapshotRepository(nil), ErrNoSnapshotRepository, "expected error without a snapshot repository")
+
+	es.options.SnapshotRepository = "backups"
+	assert.NoError(t, es.ensureSnapshotRepository(nil), "expected a repository without a location to be registered already")
+}
+
+func TestRestoreSnapshotFromSourceCluster(t *testing.T) {
+	client, err := elastic.NewSimpleClient(elastic.SetURL("http://localhost:9200"))
+	require.NoError(t, err, "expected no error for creating client")
+	es := &esService{elasticClient: client, migrationCheck: true}
+	es.options.SnapshotRepository = "backups"
+	es.options.SourceCluster = &EsAccessConfig{}
+
+	_, err = es.RestoreSnapshot("")
+	assert.ErrorIs(t, err, ErrSnapshotOnSource, "expected error for restoring a snapshot of the source cluster")
+}
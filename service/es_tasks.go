@@ -0,0 +1,72 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/olivere/elastic/v7"
+)
+
+// reindexTask is the subset of the Tasks API response (GET _tasks/<id>) used to follow a reindex.
+type reindexTask struct {
+	Completed bool `json:"completed"`
+	Task      struct {
+		Status reindexTaskStatus `json:"status"`
+	} `json:"task"`
+	Response *reindexTaskResponse `json:"response,omitempty"`
+	Error    *taskError           `json:"error,omitempty"`
+}
+
+type reindexTaskStatus struct {
+	Total            int `json:"total"`
+	Created          int `json:"created"`
+	Updated          int `json:"updated"`
+	Deleted          int `json:"deleted"`
+	Batches          int `json:"batches"`
+	VersionConflicts int `json:"version_conflicts"`
+	Noops            int `json:"noops"`
+}
+
+// done returns the number of source documents the task has processed so far.
+func (s reindexTaskStatus) done() int {
+	return s.Created + s.Updated + s.Deleted + s.VersionConflicts + s.Noops
+}
+
+type reindexTaskResponse struct {
+	reindexTaskStatus
+	Canceled string           `json:"canceled,omitempty"`
+	Failures []reindexFailure `json:"failures,omitempty"`
+}
+
+type reindexFailure struct {
+	Index  string    `json:"index"`
+	ID     string    `json:"id"`
+	Status int       `json:"status"`
+	Cause  taskError `json:"cause"`
+}
+
+type taskError struct {
+	Type   string `json:"type"`
+	Reason string `json:"reason"`
+}
+
+func (e *taskError) String() string {
+	return fmt.Sprintf("%s: %s", e.Type, e.Reason)
+}
+
+func (es *esService) getReindexTask(client *elastic.Client, taskID string) (*reindexTask, error) {
+	resp, err := client.PerformRequest(context.Background(), elastic.PerformRequestOptions{
+		Method: "GET",
+		Path:   fmt.Sprintf("/_tasks/%s", taskID),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	task := &reindexTask{}
+	if err := json.Unmarshal(resp.Body, task); err != nil {
+		return nil, fmt.Errorf("decoding task %s: %w", taskID, err)
+	}
+	return task, nil
+}
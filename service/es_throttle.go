@@ -0,0 +1,138 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+
+	log "github.com/Financial-Times/go-logger"
+	"github.com/olivere/elastic/v7"
+)
+
+var (
+	ErrNoReindexRunning = errors.New("No reindex task is running")
+	ErrInvalidThrottle  = errors.New("Requests per second must be a positive number, or -1 for no throttling")
+)
+
+// RethrottleResult is the throttle applied to the running reindex task
+type RethrottleResult struct {
+	Task              string  `json:"task"`
+	RequestsPerSecond float64 `json:"requestsPerSecond"`
+}
+
+type EsThrottleService interface {
+	RethrottleReindex(requestsPerSecond float64) (*RethrottleResult, error)
+}
+
+// rethrottleResponse is the subset of the rethrottle API response which reports failures
+type rethrottleResponse struct {
+	NodeFailures []taskError `json:"node_failures"`
+	TaskFailures []struct {
+		Reason taskError `json:"reason"`
+	} `json:"task_failures"`
+}
+
+// RethrottleReindex changes the throttle of the running reindex task, taking effect from its next batch.
+// A requestsPerSecond of -1 removes the throttle.
+func (es *esService) RethrottleReindex(requestsPerSecond float64) (*RethrottleResult, error) {
+	if requestsPerSecond <= 0 && requestsPerSecond != -1 {
+		return nil, ErrInvalidThrottle
+	}
+
+	client := es.esClient()
+	if client == nil {
+		return nil, ErrNoElasticClient
+	}
+
+	taskID := es.runningReindexTask()
+	if len(taskID) == 0 {
+		return nil, ErrNoReindexRunning
+	}
+
+	resp, err := client.PerformRequest(context.Background(), elastic.PerformRequestOptions{
+		Method: "POST",
+		Path:   fmt.Sprintf("/_reindex/%s/_rethrottle", taskID),
+		Params: map[string][]string{"requests_per_second": {strconv.FormatFloat(requestsPerSecond, 'f', -1, 64)}},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	result := &rethrottleResponse{}
+	if err := json.Unmarshal(resp.Body, result); err != nil {
+		return nil, fmt.Errorf("decoding rethrottle response for task %s: %w", taskID, err)
+	}
+	if len(result.NodeFailures) > 0 {
+		return nil, fmt.Errorf("unable to rethrottle task %s: %s", taskID, &result.NodeFailures[0])
+	}
+	if len(result.TaskFailures) > 0 {
+		return nil, fmt.Errorf("unable to rethrottle task %s: %s", taskID, &result.TaskFailures[0].Reason)
+	}
+
+	log.WithFields(map[string]interface{}{"task": taskID, "requestsPerSecond": requestsPerSecond}).Info("reindex task rethrottled")
+	return &RethrottleResult{Task: taskID, RequestsPerSecond: requestsPerSecond}, nil
+}
+
+func (es *esService) runningReindexTask() string {
+	es.RLock()
+	defer es.RUnlock()
+	return es.reindexTaskID
+}
+
+func (es *esService) setRunningReindexTask(taskID string) {
+	es.Lock()
+	defer es.Unlock()
+	es.reindexTaskID = taskID
+}
+
+// newReindexService applies the slicing and throttling options to a reindex request
+func (es *esService) newReindexService(client *elastic.Client) (*elastic.ReindexService, error) {
+	reindexService := elastic.NewReindexService(client)
+
+	slices, err := parseSlices(es.options.ReindexSlices)
+	if err != nil {
+		return nil, err
+	}
+	// reindex from a remote cluster cannot be sliced
+	if slices != nil && es.options.SourceCluster == nil {
+		reindexService = reindexService.Slices(slices)
+	}
+
+	if es.options.RequestsPerSecond > 0 {
+		reindexService = reindexService.RequestsPerSecond(es.options.RequestsPerSecond)
+	}
+
+	return reindexService, nil
+}
+
+// newReindexSource applies the batch size option to the source of a reindex request
+func (es *esService) newReindexSource(indexName string) *elastic.ReindexSource {
+	source := elastic.NewReindexSource()
+	if es.options.ReindexBatchSize > 0 {
+		// the request replaces the indices of the source, so it is set first
+		source = source.Request(elastic.NewSearchRequest().Size(es.options.ReindexBatchSize))
+	}
+	return source.Index(indexName)
+}
+
+// parseSlices returns the slices parameter of a reindex request, which is either auto or a number of slices,
+// or nil for a single slice
+func parseSlices(slices string) (interface{}, error) {
+	if len(slices) == 0 {
+		return nil, nil
+	}
+	if slices == "auto" {
+		return slices, nil
+	}
+
+	n, err := strconv.Atoi(slices)
+	if err != nil || n < 1 {
+		return nil, fmt.Errorf("reindex slices must be auto or a positive number, not %q", slices)
+	}
+	if n == 1 {
+		return nil, nil
+	}
+	return n, nil
+}
@@ -0,0 +1,52 @@
+package service
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseSlices(t *testing.T) {
+	tests := []struct {
+		slices   string
+		expected interface{}
+	}{
+		{"", nil},
+		{"1", nil},
+		{"4", 4},
+		{"auto", "auto"},
+	}
+
+	for _, test := range tests {
+		actual, err := parseSlices(test.slices)
+		assert.NoError(t, err, "expected no error for slices %q", test.slices)
+		assert.Equal(t, test.expected, actual, "slices %q", test.slices)
+	}
+}
+
+func TestParseSlicesInvalid(t *testing.T) {
+	for _, slices := range []string{"0", "-2", "many"} {
+		_, err := parseSlices(slices)
+		assert.Error(t, err, "expected error for slices %q", slices)
+	}
+}
+
+func TestRethrottleReindexInvalidThrottle(t *testing.T) {
+	es := &esService{}
+	for _, requestsPerSecond := range []float64{0, -2} {
+		_, err := es.RethrottleReindex(requestsPerSecond)
+		assert.ErrorIs(t, err, ErrInvalidThrottle, "requests per second %v", requestsPerSecond)
+	}
+}
+
+func TestNewReindexSource(t *testing.T) {
+	es := &esService{}
+	source, err := es.newReindexSource("concepts-1.0.0").Source()
+	assert.NoError(t, err, "expected no error for building reindex source")
+	assert.Equal(t, map[string]interface{}{"index": "concepts-1.0.0"}, source, "reindex source without batch size")
+
+	es.options.ReindexBatchSize = 500
+	source, err = es.newReindexSource("concepts-1.0.0").Source()
+	assert.NoError(t, err, "expected no error for building reindex source")
+	assert.Equal(t, map[string]interface{}{"index": "concepts-1.0.0", "size": 500}, source, "reindex source with batch size")
+}
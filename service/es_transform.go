@@ -0,0 +1,117 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	log "github.com/Financial-Times/go-logger"
+	"github.com/olivere/elastic/v7"
+)
+
+// reindexTransform changes the documents as they are copied to the new index, with either a script or an ingest pipeline
+type reindexTransform struct {
+	Script   *transformScript `json:"script,omitempty"`
+	Pipeline json.RawMessage  `json:"pipeline,omitempty"`
+
+	pipelineID string
+}
+
+type transformScript struct {
+	Source string                 `json:"source"`
+	Lang   string                 `json:"lang,omitempty"`
+	Params map[string]interface{} `json:"params,omitempty"`
+}
+
+// loadTransform reads a transform file, which holds either {"script": {...}} or {"pipeline": {...}}
+func loadTransform(transformFile string) (*reindexTransform, error) {
+	b, err := ioutil.ReadFile(transformFile)
+	if err != nil {
+		return nil, err
+	}
+
+	transform := &reindexTransform{}
+	if err := json.Unmarshal(b, transform); err != nil {
+		return nil, fmt.Errorf("transform %s is not valid JSON: %w", transformFile, err)
+	}
+
+	hasPipeline := len(transform.Pipeline) > 0 && string(transform.Pipeline) != "null"
+	switch {
+	case transform.Script != nil && hasPipeline:
+		return nil, fmt.Errorf("transform %s must have either a script or a pipeline, not both", transformFile)
+	case transform.Script != nil:
+		if len(transform.Script.Source) == 0 {
+			return nil, fmt.Errorf("transform %s has a script without source", transformFile)
+		}
+	case hasPipeline:
+	default:
+		return nil, fmt.Errorf("transform %s must have a script or a pipeline", transformFile)
+	}
+
+	return transform, nil
+}
+
+// kind describes the transform for the migration plan
+func (t *reindexTransform) kind() string {
+	if t.Script != nil {
+		return "script"
+	}
+	return "pipeline"
+}
+
+// apply adds the script or pipeline of the transform to a reindex request
+func (t *reindexTransform) apply(reindexService *elastic.ReindexService, destination *elastic.ReindexDestination) {
+	if t == nil {
+		return
+	}
+
+	if t.Script != nil {
+		lang := t.Script.Lang
+		if len(lang) == 0 {
+			lang = "painless"
+		}
+		script := elastic.NewScript(t.Script.Source).Lang(lang)
+		if len(t.Script.Params) > 0 {
+			script = script.Params(t.Script.Params)
+		}
+		reindexService.Script(script)
+	}
+
+	if len(t.pipelineID) > 0 {
+		destination.Pipeline(t.pipelineID)
+	}
+}
+
+// createTransformPipeline creates the ingest pipeline of the transform, named after the new index, if it has one
+func (es *esService) createTransformPipeline(client *elastic.Client, transform *reindexTransform, indexName string) error {
+	if transform == nil || transform.Script != nil {
+		return nil
+	}
+
+	pipelineID := fmt.Sprintf("%s-transform", indexName)
+	log.WithField("pipeline", pipelineID).Info("creating transform pipeline")
+
+	_, err := client.IngestPutPipeline(pipelineID).BodyString(string(transform.Pipeline)).Do(context.Background())
+	if err != nil {
+		return err
+	}
+
+	transform.pipelineID = pipelineID
+	return nil
+}
+
+// deleteTransformPipeline removes the ingest pipeline of the transform once the reindex no longer needs it
+func (es *esService) deleteTransformPipeline(client *elastic.Client, transform *reindexTransform) {
+	if transform == nil || len(transform.pipelineID) == 0 {
+		return
+	}
+
+	_, err := client.IngestDeletePipeline(transform.pipelineID).Do(context.Background())
+	if err != nil && !elastic.IsStatusCode(err, http.StatusNotFound) {
+		log.WithError(err).WithField("pipeline", transform.pipelineID).Warn("unable to delete transform pipeline")
+		return
+	}
+	transform.pipelineID = ""
+}
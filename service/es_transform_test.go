@@ -0,0 +1,46 @@
+package service
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadTransformScript(t *testing.T) {
+	transform, err := loadTransform("test/transform-script.json")
+	require.NoError(t, err, "expected no error for loading transform")
+
+	assert.Equal(t, "script", transform.kind(), "transform kind")
+	assert.Equal(t, "ctx._source.remove(params.field)", transform.Script.Source, "script source")
+	assert.Equal(t, "aliases", transform.Script.Params["field"], "script params")
+}
+
+func TestLoadTransformPipeline(t *testing.T) {
+	transform, err := loadTransform("test/transform-pipeline.json")
+	require.NoError(t, err, "expected no error for loading transform")
+
+	assert.Equal(t, "pipeline", transform.kind(), "transform kind")
+	assert.Nil(t, transform.Script, "script")
+	assert.NotEmpty(t, transform.Pipeline, "pipeline definition")
+}
+
+func TestLoadTransformInvalid(t *testing.T) {
+	tests := map[string]string{
+		"not json":    `{"script": `,
+		"empty":       `{}`,
+		"both":        `{"script": {"source": "ctx._source.x = 1"}, "pipeline": {"processors": []}}`,
+		"no source":   `{"script": {"lang": "painless"}}`,
+		"null script": `{"pipeline": null}`,
+	}
+
+	for name, content := range tests {
+		transformFile := filepath.Join(t.TempDir(), "transform.json")
+		require.NoError(t, os.WriteFile(transformFile, []byte(content), 0644), "expected no error for writing transform")
+
+		_, err := loadTransform(transformFile)
+		assert.Error(t, err, "expected error for %s transform", name)
+	}
+}
@@ -0,0 +1,163 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+
+	fthealth "github.com/Financial-Times/go-fthealth/v1_1"
+	log "github.com/Financial-Times/go-logger"
+	"github.com/google/uuid"
+	"github.com/olivere/elastic/v7"
+)
+
+var ErrValidationFailed = errors.New("Mapping or alias filter validation failed")
+
+// validationIndexPrefix names the throwaway indices the mapping is created in, which must not match <alias>-*
+// so that they are never taken for a version of the index
+const validationIndexPrefix = "elasticsearch-reindexer-validation-"
+
+// validateFiles checks the mapping and alias filter read from their files before the migration changes anything:
+// the mapping, with the settings, must be accepted by the cluster when creating a throwaway index, and the alias filter must be a valid query on it
+func (es *esService) validateFiles(client *elastic.Client, mapping string, aliasFilter string) (err error) {
+	defer func() {
+		es.setValidationResult(err)
+	}()
+
+	_, mappingFile := es.migrationTarget()
+	indexName := validationIndexPrefix + uuid.NewString()
+	_, err = client.CreateIndex(indexName).BodyString(mapping).Do(context.Background())
+	if err != nil {
+		if len(es.settingsFile) > 0 {
+			return fmt.Errorf("%w: mapping %s with settings %s was rejected: %s", ErrValidationFailed, mappingFile, es.settingsFile, err)
+		}
+		return fmt.Errorf("%w: mapping %s was rejected: %s", ErrValidationFailed, mappingFile, err)
+	}
+	defer func() {
+		if _, err := client.DeleteIndex(indexName).Do(context.Background()); err != nil {
+			log.WithError(err).WithField("index", indexName).Warn("unable to delete mapping validation index")
+		}
+	}()
+
+	if len(aliasFilter) == 0 {
+		return nil
+	}
+
+	resp, err := client.PerformRequest(context.Background(), elastic.PerformRequestOptions{
+		Method: "POST",
+		Path:   fmt.Sprintf("/%s/_validate/query", indexName),
+		Params: map[string][]string{"explain": {"true"}},
+		Body:   map[string]interface{}{"query": json.RawMessage(aliasFilter)},
+	})
+	if err != nil {
+		return fmt.Errorf("%w: alias filter %s was rejected: %s", ErrValidationFailed, es.aliasFilterFile, err)
+	}
+
+	var validation struct {
+		Valid        bool `json:"valid"`
+		Explanations []struct {
+			Error string `json:"error,omitempty"`
+		} `json:"explanations,omitempty"`
+	}
+	if err := json.Unmarshal(resp.Body, &validation); err != nil {
+		return fmt.Errorf("decoding alias filter validation: %w", err)
+	}
+	if !validation.Valid {
+		reason := "invalid query"
+		if len(validation.Explanations) > 0 && len(validation.Explanations[0].Error) > 0 {
+			reason = validation.Explanations[0].Error
+		}
+		return fmt.Errorf("%w: alias filter %s is not a valid query: %s", ErrValidationFailed, es.aliasFilterFile, reason)
+	}
+	return nil
+}
+
+// validateUpToDateFiles validates the files of an index which is already up to date, for the health check only:
+// they are not used until a later migration, which fails if they are still invalid then
+func (es *esService) validateUpToDateFiles(client *elastic.Client) {
+	mapping, aliasFilter, err := es.readValidatedFiles()
+	if err == nil {
+		err = es.validateFiles(client, mapping, aliasFilter)
+	} else {
+		es.setValidationResult(err)
+	}
+	if err != nil {
+		log.WithError(err).Warn("mapping or alias filter file of the up-to-date index is not valid")
+	}
+}
+
+// readValidatedFiles reads the mapping, settings and alias filter files, which must be valid JSON objects, returning the index creation
+// body and the alias filter. There is no alias filter without a file.
+func (es *esService) readValidatedFiles() (string, string, error) {
+	body, err := es.readIndexBody()
+	if err != nil {
+		return "", "", err
+	}
+
+	if len(es.aliasFilterFile) == 0 {
+		return body, "", nil
+	}
+
+	aliasFilter, err := ioutil.ReadFile(es.aliasFilterFile)
+	if err != nil {
+		return "", "", fmt.Errorf("%w: %s", ErrValidationFailed, err)
+	}
+	var object map[string]interface{}
+	if err := json.Unmarshal(aliasFilter, &object); err != nil {
+		return "", "", fmt.Errorf("%w: alias filter %s is not a valid JSON object: %s", ErrValidationFailed, es.aliasFilterFile, err)
+	}
+	return body, string(aliasFilter), nil
+}
+
+// readIndexBody reads the mapping file of the migration, with the settings of the settings file merged into it
+func (es *esService) readIndexBody() (string, error) {
+	_, mappingFile := es.migrationTarget()
+	mapping, err := ioutil.ReadFile(mappingFile)
+	if err != nil {
+		return "", fmt.Errorf("%w: %s", ErrValidationFailed, err)
+	}
+	var object map[string]interface{}
+	if err := json.Unmarshal(mapping, &object); err != nil {
+		return "", fmt.Errorf("%w: mapping %s is not a valid JSON object: %s", ErrValidationFailed, mappingFile, err)
+	}
+
+	settings, err := es.readSettings()
+	if err != nil {
+		return "", err
+	}
+	return indexBody(string(mapping), settings)
+}
+
+func (es *esService) setValidationResult(err error) {
+	es.Lock()
+	defer es.Unlock()
+
+	es.validated = true
+	es.validationErr = err
+}
+
+func (es *esService) FilesValidCheck() fthealth.Check {
+	return fthealth.Check{
+		BusinessImpact:   "The index cannot be migrated to the new mapping version.",
+		Name:             "Check the mapping and alias filter files are valid",
+		PanicGuide:       es.panicGuideUrl,
+		Severity:         2,
+		TechnicalSummary: "The mapping file is rejected by Elasticsearch, or the alias filter file is not a valid query.",
+		Checker:          es.filesValidChecker,
+	}
+}
+
+func (es *esService) filesValidChecker() (string, error) {
+	es.RLock()
+	defer es.RUnlock()
+
+	if !es.validated {
+		return "The mapping and alias filter files have not been validated yet", nil
+	}
+	if es.validationErr != nil {
+		return "The mapping or alias filter file is not valid", es.validationErr
+	}
+	return "The mapping and alias filter files are valid", nil
+}
@@ -0,0 +1,58 @@
+package service
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadValidatedFiles(t *testing.T) {
+	es := &esService{mappingFile: "test/new-mapping.json", aliasFilterFile: "test/alias-filter.json"}
+	mapping, aliasFilter, err := es.readValidatedFiles()
+	require.NoError(t, err, "expected no error for valid files")
+	assert.Contains(t, mapping, "mentionsCompletion", "mapping")
+	assert.NotEmpty(t, aliasFilter, "alias filter")
+
+	es.aliasFilterFile = ""
+	_, aliasFilter, err = es.readValidatedFiles()
+	require.NoError(t, err, "expected no error without alias filter")
+	assert.Empty(t, aliasFilter, "alias filter")
+}
+
+func TestReadValidatedFilesInvalid(t *testing.T) {
+	dir := t.TempDir()
+	invalid := filepath.Join(dir, "invalid.json")
+	require.NoError(t, os.WriteFile(invalid, []byte(`{"mappings": {`), 0600), "expected no error for writing file")
+	array := filepath.Join(dir, "array.json")
+	require.NoError(t, os.WriteFile(array, []byte(`[{"term": {"type": "topics"}}]`), 0600), "expected no error for writing file")
+
+	files := map[string]*esService{
+		"invalid mapping":      {mappingFile: invalid},
+		"missing mapping":      {mappingFile: filepath.Join(dir, "no-such-file.json")},
+		"invalid alias filter": {mappingFile: "test/new-mapping.json", aliasFilterFile: invalid},
+		"alias filter array":   {mappingFile: "test/new-mapping.json", aliasFilterFile: array},
+	}
+	for name, es := range files {
+		_, _, err := es.readValidatedFiles()
+		assert.ErrorIs(t, err, ErrValidationFailed, "expected validation error for %s", name)
+	}
+}
+
+func TestFilesValidChecker(t *testing.T) {
+	es := &esService{}
+	_, err := es.filesValidChecker()
+	assert.NoError(t, err, "expected no error before validation")
+
+	es.setValidationResult(nil)
+	_, err = es.filesValidChecker()
+	assert.NoError(t, err, "expected no error for valid files")
+
+	invalid := errors.New("mapping was rejected")
+	es.setValidationResult(invalid)
+	_, err = es.filesValidChecker()
+	assert.ErrorIs(t, err, invalid, "expected validation error")
+}
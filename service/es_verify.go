@@ -0,0 +1,307 @@
+package service
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	log "github.com/Financial-Times/go-logger"
+	"github.com/olivere/elastic/v7"
+)
+
+var ErrVerificationFailed = errors.New("Verification of the new index failed")
+
+// how the sampled documents are compared
+const (
+	compareSource      = "source"
+	compareTransformed = "transformed"
+	compareIDs         = "ids"
+)
+
+// how the document counts are compared
+const (
+	countExact   = "exact"
+	countAtLeast = "at-least"
+	countSkipped = "skipped"
+)
+
+// maxReportedMismatches limits the IDs of mismatched documents kept in the verification result
+const maxReportedMismatches = 10
+
+// VerificationResult is what the verification of the new index found, before the aliases are moved to it
+type VerificationResult struct {
+	SourceCount int64 `json:"sourceCount"`
+	TargetCount int64 `json:"targetCount"`
+	// CountCheck is exact when the new index must have as many documents as the source index, at-least when documents deleted
+	// from the source index while it accepted writes may be left in the new index, and skipped when the source index still accepts writes
+	CountCheck string `json:"countCheck"`
+	Sampled    int    `json:"sampled"`
+	// Compared is source when the _source of the sampled documents is compared, transformed when the source documents
+	// are run through the transform pipeline first, and ids when a transform script only allows checking they were copied
+	Compared      string   `json:"compared"`
+	Mismatches    int      `json:"mismatches"`
+	MismatchRate  float64  `json:"mismatchRate"`
+	MismatchedIDs []string `json:"mismatchedIds,omitempty"`
+	// Skipped is why the new index was not verified, if it was not
+	Skipped string `json:"skipped,omitempty"`
+}
+
+// verificationCountCheck returns how the document counts of the new and source indices can be compared. Deletes are not copied
+// by catch-up passes, and the final catch-up pass of a migration which waits to be promoted only runs after the verification.
+func (es *esService) verificationCountCheck(state *migrationState) string {
+	switch {
+	case es.options.ZeroDowntime && es.catchUpOnPromotion():
+		return countSkipped
+	case es.options.ZeroDowntime || state.Released:
+		return countAtLeast
+	default:
+		return countExact
+	}
+}
+
+// verifyMigration checks the document counts of the new and source indices as countCheck says, and that a random sample of
+// the source documents was copied unchanged, or as the transform changes them. It fails if the rate of mismatched
+// documents in the sample is above the configured maximum.
+func (es *esService) verifyMigration(client *elastic.Client, source *elastic.Client, sourceIndexName string, newIndexName string, transform *reindexTransform, countCheck string) error {
+	result := &VerificationResult{CountCheck: countCheck, Compared: compareSource}
+	defer es.setMigrationVerification(result)
+
+	_, err := source.Refresh(sourceIndexName).Do(context.Background())
+	if err != nil {
+		return err
+	}
+	result.SourceCount, err = elastic.NewCountService(source).Index(sourceIndexName).Do(context.Background())
+	if err != nil {
+		return err
+	}
+	result.TargetCount, err = elastic.NewCountService(client).Index(newIndexName).Do(context.Background())
+	if err != nil {
+		return err
+	}
+	missing := result.TargetCount < result.SourceCount
+	if (countCheck == countExact && (missing || result.TargetCount > result.SourceCount)) || (countCheck == countAtLeast && missing) {
+		return fmt.Errorf("%w: %s has %d documents, but %s has %d", ErrVerificationFailed, newIndexName, result.TargetCount, sourceIndexName, result.SourceCount)
+	}
+
+	sample, err := es.sampleDocuments(source, sourceIndexName, es.options.VerifySampleSize)
+	if err != nil {
+		return err
+	}
+	result.Sampled = len(sample)
+	if result.Sampled == 0 {
+		return nil
+	}
+
+	expected := sample
+	switch {
+	case transform == nil:
+	case transform.Script != nil:
+		result.Compared = compareIDs
+		log.Warn("the transform script cannot be run outside a reindex, so only the IDs of the sampled documents are verified")
+	default:
+		result.Compared = compareTransformed
+		expected, err = es.simulatePipeline(client, transform, sourceIndexName, sample)
+		if err != nil {
+			return err
+		}
+	}
+
+	ids := make([]string, 0, len(sample))
+	for id := range sample {
+		ids = append(ids, id)
+	}
+	actual, err := es.getDocuments(client, newIndexName, ids)
+	if err != nil {
+		return err
+	}
+
+	mismatched, err := compareDocuments(expected, actual, result.Compared != compareIDs)
+	if err != nil {
+		return err
+	}
+	result.Mismatches = len(mismatched)
+	result.MismatchRate = float64(len(mismatched)) / float64(result.Sampled)
+	if len(mismatched) > maxReportedMismatches {
+		mismatched = mismatched[:maxReportedMismatches]
+	}
+	result.MismatchedIDs = mismatched
+
+	log.WithFields(map[string]interface{}{"index": newIndexName, "documents": result.TargetCount, "sampled": result.Sampled, "compared": result.Compared, "mismatches": result.Mismatches}).Info("new index verified")
+	if result.MismatchRate > es.options.VerifyMaxMismatchRate {
+		return fmt.Errorf("%w: %d of %d sampled documents differ from %s (%v), above the maximum mismatch rate of %v",
+			ErrVerificationFailed, result.Mismatches, result.Sampled, sourceIndexName, result.MismatchedIDs, es.options.VerifyMaxMismatchRate)
+	}
+	return nil
+}
+
+// sampleDocuments returns the _source of up to size random documents of the index, by ID
+func (es *esService) sampleDocuments(client *elastic.Client, indexName string, size int) (map[string]json.RawMessage, error) {
+	resp, err := client.PerformRequest(context.Background(), elastic.PerformRequestOptions{
+		Method: "POST",
+		Path:   fmt.Sprintf("/%s/_search", indexName),
+		Body: map[string]interface{}{
+			"size": size,
+			"query": map[string]interface{}{
+				"function_score": map[string]interface{}{
+					"query":        map[string]interface{}{"match_all": map[string]interface{}{}},
+					"random_score": map[string]interface{}{"seed": time.Now().UnixNano(), "field": "_seq_no"},
+				},
+			},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var result struct {
+		Hits struct {
+			Hits []struct {
+				ID     string          `json:"_id"`
+				Source json.RawMessage `json:"_source"`
+			} `json:"hits"`
+		} `json:"hits"`
+	}
+	if err := json.Unmarshal(resp.Body, &result); err != nil {
+		return nil, fmt.Errorf("decoding sample of index %s: %w", indexName, err)
+	}
+
+	sample := make(map[string]json.RawMessage)
+	for _, hit := range result.Hits.Hits {
+		sample[hit.ID] = hit.Source
+	}
+	return sample, nil
+}
+
+// simulatePipeline runs the documents through the ingest pipeline of the transform, without indexing them.
+// Documents dropped by the pipeline have a nil _source, as they are expected to be missing from the new index.
+func (es *esService) simulatePipeline(client *elastic.Client, transform *reindexTransform, indexName string, documents map[string]json.RawMessage) (map[string]json.RawMessage, error) {
+	ids := make([]string, 0, len(documents))
+	docs := make([]map[string]interface{}, 0, len(documents))
+	for id, source := range documents {
+		ids = append(ids, id)
+		docs = append(docs, map[string]interface{}{"_index": indexName, "_id": id, "_source": source})
+	}
+
+	resp, err := client.PerformRequest(context.Background(), elastic.PerformRequestOptions{
+		Method: "POST",
+		Path:   "/_ingest/pipeline/_simulate",
+		Body:   map[string]interface{}{"pipeline": transform.Pipeline, "docs": docs},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var result struct {
+		Docs []struct {
+			Doc *struct {
+				Source json.RawMessage `json:"_source"`
+			} `json:"doc"`
+			Error *taskError `json:"error,omitempty"`
+		} `json:"docs"`
+	}
+	if err := json.Unmarshal(resp.Body, &result); err != nil {
+		return nil, fmt.Errorf("decoding simulated transform: %w", err)
+	}
+	if len(result.Docs) != len(ids) {
+		return nil, fmt.Errorf("transform simulation returned %d documents for %d", len(result.Docs), len(ids))
+	}
+
+	transformed := make(map[string]json.RawMessage)
+	for i, doc := range result.Docs {
+		switch {
+		case doc.Error != nil:
+			return nil, fmt.Errorf("transform of document %s failed: %s", ids[i], doc.Error)
+		case doc.Doc == nil:
+			transformed[ids[i]] = nil
+		default:
+			transformed[ids[i]] = doc.Doc.Source
+		}
+	}
+	return transformed, nil
+}
+
+// getDocuments returns the _source of the documents of the index with the IDs, leaving out those which are not found
+func (es *esService) getDocuments(client *elastic.Client, indexName string, ids []string) (map[string]json.RawMessage, error) {
+	resp, err := client.PerformRequest(context.Background(), elastic.PerformRequestOptions{
+		Method: "POST",
+		Path:   fmt.Sprintf("/%s/_mget", indexName),
+		Body:   map[string]interface{}{"ids": ids},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var result struct {
+		Docs []struct {
+			ID     string          `json:"_id"`
+			Found  bool            `json:"found"`
+			Source json.RawMessage `json:"_source"`
+		} `json:"docs"`
+	}
+	if err := json.Unmarshal(resp.Body, &result); err != nil {
+		return nil, fmt.Errorf("decoding documents of index %s: %w", indexName, err)
+	}
+
+	documents := make(map[string]json.RawMessage)
+	for _, doc := range result.Docs {
+		if doc.Found {
+			documents[doc.ID] = doc.Source
+		}
+	}
+	return documents, nil
+}
+
+// compareDocuments returns the sorted IDs of the expected documents which are missing from the actual ones, or found although
+// the transform drops them, or, if compareSources is set, whose _source hashes differ
+func compareDocuments(expected map[string]json.RawMessage, actual map[string]json.RawMessage, compareSources bool) ([]string, error) {
+	var mismatched []string
+	for id, expectedSource := range expected {
+		actualSource, found := actual[id]
+		if expectedSource == nil || !found {
+			if expectedSource != nil || found {
+				mismatched = append(mismatched, id)
+			}
+			continue
+		}
+		if !compareSources {
+			continue
+		}
+
+		expectedHash, err := sourceHash(expectedSource)
+		if err != nil {
+			return nil, fmt.Errorf("hashing source document %s: %w", id, err)
+		}
+		actualHash, err := sourceHash(actualSource)
+		if err != nil {
+			return nil, fmt.Errorf("hashing new document %s: %w", id, err)
+		}
+		if expectedHash != actualHash {
+			mismatched = append(mismatched, id)
+		}
+	}
+
+	sort.Strings(mismatched)
+	return mismatched, nil
+}
+
+// sourceHash hashes a _source in a canonical form, so that the order of its fields and its formatting do not matter
+func sourceHash(source json.RawMessage) (string, error) {
+	var doc interface{}
+	if err := json.Unmarshal(source, &doc); err != nil {
+		return "", err
+	}
+
+	// maps are marshalled with sorted keys
+	canonical, err := json.Marshal(doc)
+	if err != nil {
+		return "", err
+	}
+
+	hash := sha256.Sum256(canonical)
+	return hex.EncodeToString(hash[:]), nil
+}
@@ -0,0 +1,63 @@
+package service
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSourceHash(t *testing.T) {
+	hash, err := sourceHash(json.RawMessage(`{"id": "1", "types": ["a", "b"], "score": 1.0}`))
+	require.NoError(t, err, "expected no error for hashing source")
+
+	reordered, err := sourceHash(json.RawMessage(`{"score":1,"types":["a","b"],"id":"1"}`))
+	require.NoError(t, err, "expected no error for hashing source")
+	assert.Equal(t, hash, reordered, "field order and formatting do not change the hash")
+
+	changed, err := sourceHash(json.RawMessage(`{"id": "1", "types": ["b", "a"], "score": 1.0}`))
+	require.NoError(t, err, "expected no error for hashing source")
+	assert.NotEqual(t, hash, changed, "array order changes the hash")
+
+	_, err = sourceHash(json.RawMessage(`{"id": `))
+	assert.Error(t, err, "expected error for invalid source")
+}
+
+func TestCompareDocuments(t *testing.T) {
+	expected := map[string]json.RawMessage{
+		"same":    json.RawMessage(`{"id": "same", "label": "a"}`),
+		"changed": json.RawMessage(`{"id": "changed", "label": "a"}`),
+		"missing": json.RawMessage(`{"id": "missing"}`),
+		"dropped": nil,
+		"kept":    nil,
+	}
+	actual := map[string]json.RawMessage{
+		"same":    json.RawMessage(`{"label": "a", "id": "same"}`),
+		"changed": json.RawMessage(`{"id": "changed", "label": "b"}`),
+		"kept":    json.RawMessage(`{"id": "kept"}`),
+	}
+
+	mismatched, err := compareDocuments(expected, actual, true)
+	require.NoError(t, err, "expected no error for comparing documents")
+	assert.Equal(t, []string{"changed", "kept", "missing"}, mismatched, "mismatched documents")
+
+	mismatched, err = compareDocuments(expected, actual, false)
+	require.NoError(t, err, "expected no error for comparing document IDs")
+	assert.Equal(t, []string{"kept", "missing"}, mismatched, "mismatched document IDs")
+}
+
+func TestVerificationCountCheck(t *testing.T) {
+	es := &esService{aliasName: "concepts"}
+	assert.Equal(t, countExact, es.verificationCountCheck(&migrationState{}), "count check of a migration which blocks writes")
+	assert.Equal(t, countAtLeast, es.verificationCountCheck(&migrationState{Released: true}), "count check of a resumed migration which allowed writes while waiting to be promoted")
+
+	es.options = MigrationOptions{ZeroDowntime: true}
+	assert.Equal(t, countAtLeast, es.verificationCountCheck(&migrationState{}), "count check of a zero-downtime migration")
+
+	es.options = MigrationOptions{CanaryAliasSuffix: "-next"}
+	assert.Equal(t, countExact, es.verificationCountCheck(&migrationState{}), "count check of a migration which blocks writes until it waits to be promoted")
+
+	es.options = MigrationOptions{ZeroDowntime: true, CanaryAliasSuffix: "-next"}
+	assert.Equal(t, countSkipped, es.verificationCountCheck(&migrationState{}), "count check of a zero-downtime migration which waits to be promoted")
+}
@@ -0,0 +1,330 @@
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	log "github.com/Financial-Times/go-logger"
+	"github.com/husobee/vestigo"
+)
+
+type EsAdminService interface {
+	EsRollbackService
+	EsPlanService
+	EsMappingDiffService
+	EsThrottleService
+	EsMigrationService
+	EsCancelService
+	EsRetentionService
+	EsSnapshotService
+	EsPromoteService
+}
+
+type AdminHandler struct {
+	service  EsAdminService
+	services map[string]EsAdminService
+}
+
+func NewAdminHandler(service EsAdminService) *AdminHandler {
+	return &AdminHandler{service: service}
+}
+
+// NewManagedAdminHandler handles requests for several indices, selected by the alias query parameter
+func NewManagedAdminHandler(services map[string]EsAdminService) *AdminHandler {
+	return &AdminHandler{services: services}
+}
+
+// serviceFor returns the service of the index a request is for, which only needs to be given when several indices are managed
+func (h *AdminHandler) serviceFor(r *http.Request) (EsAdminService, error) {
+	if h.services == nil {
+		return h.service, nil
+	}
+
+	alias := r.URL.Query().Get("alias")
+	if len(alias) == 0 {
+		if len(h.services) == 1 {
+			for _, service := range h.services {
+				return service, nil
+			}
+		}
+		return nil, ErrAliasRequired
+	}
+
+	service, found := h.services[alias]
+	if !found {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownAlias, alias)
+	}
+	return service, nil
+}
+
+func (h *AdminHandler) Plan(w http.ResponseWriter, r *http.Request) {
+	service, err := h.serviceFor(r)
+	if err != nil {
+		writeJSONMessage(w, errorStatus(err), err.Error())
+		return
+	}
+
+	plan, err := service.PlanMigration()
+	if err != nil {
+		log.WithError(err).Error("unable to plan index migration")
+		writeJSONMessage(w, errorStatus(err), err.Error())
+		return
+	}
+
+	if r.URL.Query().Get("format") == "text" {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte(plan.String()))
+		return
+	}
+
+	writeJSON(w, http.StatusOK, plan)
+}
+
+func (h *AdminHandler) MappingDiff(w http.ResponseWriter, r *http.Request) {
+	service, err := h.serviceFor(r)
+	if err != nil {
+		writeJSONMessage(w, errorStatus(err), err.Error())
+		return
+	}
+
+	diff, err := service.DiffMapping()
+	if err != nil {
+		log.WithError(err).Error("unable to compare the live mapping with the mapping file")
+		writeJSONMessage(w, errorStatus(err), err.Error())
+		return
+	}
+
+	writeJSON(w, http.StatusOK, diff)
+}
+
+func (h *AdminHandler) Rollback(w http.ResponseWriter, r *http.Request) {
+	service, err := h.serviceFor(r)
+	if err != nil {
+		writeJSONMessage(w, errorStatus(err), err.Error())
+		return
+	}
+
+	result, err := service.RollbackIndex()
+	if err != nil {
+		log.WithError(err).Error("index rollback failed")
+		writeJSONMessage(w, errorStatus(err), err.Error())
+		return
+	}
+
+	writeJSON(w, http.StatusOK, result)
+}
+
+// RestoreSnapshot restores the index of a snapshot taken before a migration and moves the aliases back to it,
+// by default from the snapshot taken by the migration to the current index
+func (h *AdminHandler) RestoreSnapshot(w http.ResponseWriter, r *http.Request) {
+	service, err := h.serviceFor(r)
+	if err != nil {
+		writeJSONMessage(w, errorStatus(err), err.Error())
+		return
+	}
+
+	result, err := service.RestoreSnapshot(r.URL.Query().Get("snapshot"))
+	if err != nil {
+		log.WithError(err).Error("snapshot restore failed")
+		writeJSONMessage(w, errorStatus(err), err.Error())
+		return
+	}
+
+	writeJSON(w, http.StatusOK, result)
+}
+
+// Rethrottle changes the requests_per_second throttle of the running reindex task
+func (h *AdminHandler) Rethrottle(w http.ResponseWriter, r *http.Request) {
+	requestsPerSecond, err := strconv.ParseFloat(r.URL.Query().Get("requests_per_second"), 64)
+	if err != nil {
+		writeJSONMessage(w, http.StatusBadRequest, ErrInvalidThrottle.Error())
+		return
+	}
+
+	service, err := h.serviceFor(r)
+	if err != nil {
+		writeJSONMessage(w, errorStatus(err), err.Error())
+		return
+	}
+
+	result, err := service.RethrottleReindex(requestsPerSecond)
+	if err != nil {
+		log.WithError(err).Error("unable to rethrottle reindex")
+		writeJSONMessage(w, errorStatus(err), err.Error())
+		return
+	}
+
+	writeJSON(w, http.StatusOK, result)
+}
+
+// StartMigration starts a migration to the mapping version in the request body, with the bundled or an uploaded mapping
+func (h *AdminHandler) StartMigration(w http.ResponseWriter, r *http.Request) {
+	service, err := h.serviceFor(r)
+	if err != nil {
+		writeJSONMessage(w, errorStatus(err), err.Error())
+		return
+	}
+
+	var request MigrationRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		writeJSONMessage(w, http.StatusBadRequest, fmt.Sprintf("Invalid migration request: %s", err))
+		return
+	}
+
+	migration, err := service.StartMigration(request)
+	if err != nil {
+		log.WithError(err).Error("unable to start index migration")
+		writeJSONMessage(w, errorStatus(err), err.Error())
+		return
+	}
+
+	w.Header().Set("Location", migrationLocation(r, migration))
+	writeJSON(w, http.StatusAccepted, migration)
+}
+
+func (h *AdminHandler) GetMigration(w http.ResponseWriter, r *http.Request) {
+	service, err := h.serviceFor(r)
+	if err != nil {
+		writeJSONMessage(w, errorStatus(err), err.Error())
+		return
+	}
+
+	migration, err := service.GetMigration(vestigo.Param(r, "id"))
+	if err != nil {
+		writeJSONMessage(w, errorStatus(err), err.Error())
+		return
+	}
+
+	writeJSON(w, http.StatusOK, migration)
+}
+
+func (h *AdminHandler) CurrentMigration(w http.ResponseWriter, r *http.Request) {
+	service, err := h.serviceFor(r)
+	if err != nil {
+		writeJSONMessage(w, errorStatus(err), err.Error())
+		return
+	}
+
+	migration, err := service.CurrentMigration()
+	if err != nil {
+		writeJSONMessage(w, errorStatus(err), err.Error())
+		return
+	}
+
+	writeJSON(w, http.StatusOK, migration)
+}
+
+// ListMigrations returns the migration history of the index, most recent first, limited to size migrations
+func (h *AdminHandler) ListMigrations(w http.ResponseWriter, r *http.Request) {
+	service, err := h.serviceFor(r)
+	if err != nil {
+		writeJSONMessage(w, errorStatus(err), err.Error())
+		return
+	}
+
+	size := defaultMigrationsListSize
+	if value := r.URL.Query().Get("size"); len(value) > 0 {
+		size, err = strconv.Atoi(value)
+		if err != nil || size <= 0 {
+			writeJSONMessage(w, http.StatusBadRequest, fmt.Sprintf("Invalid size parameter: %s", value))
+			return
+		}
+	}
+
+	migrations, err := service.ListMigrations(size)
+	if err != nil {
+		log.WithError(err).Error("unable to list index migrations")
+		writeJSONMessage(w, errorStatus(err), err.Error())
+		return
+	}
+
+	writeJSON(w, http.StatusOK, migrations)
+}
+
+// CancelMigration cancels the running migration, deleting its new index if deleteTarget=true
+func (h *AdminHandler) CancelMigration(w http.ResponseWriter, r *http.Request) {
+	service, err := h.serviceFor(r)
+	if err != nil {
+		writeJSONMessage(w, errorStatus(err), err.Error())
+		return
+	}
+
+	deleteTarget := false
+	if value := r.URL.Query().Get("deleteTarget"); len(value) > 0 {
+		deleteTarget, err = strconv.ParseBool(value)
+		if err != nil {
+			writeJSONMessage(w, http.StatusBadRequest, fmt.Sprintf("Invalid deleteTarget parameter: %s", value))
+			return
+		}
+	}
+
+	migration, err := service.CancelMigration(deleteTarget)
+	if err != nil {
+		log.WithError(err).Error("unable to cancel index migration")
+		writeJSONMessage(w, errorStatus(err), err.Error())
+		return
+	}
+
+	w.Header().Set("Location", migrationLocation(r, migration))
+	writeJSON(w, http.StatusAccepted, migration)
+}
+
+// PromoteMigration approves the migration waiting to be promoted, which then moves the aliases to its new index
+func (h *AdminHandler) PromoteMigration(w http.ResponseWriter, r *http.Request) {
+	service, err := h.serviceFor(r)
+	if err != nil {
+		writeJSONMessage(w, errorStatus(err), err.Error())
+		return
+	}
+
+	migration, err := service.PromoteMigration()
+	if err != nil {
+		log.WithError(err).Error("unable to promote index migration")
+		writeJSONMessage(w, errorStatus(err), err.Error())
+		return
+	}
+
+	w.Header().Set("Location", migrationLocation(r, migration))
+	writeJSON(w, http.StatusAccepted, migration)
+}
+
+// migrationLocation is the URL of a migration, for the same index as the request
+func migrationLocation(r *http.Request, migration *Migration) string {
+	location := "/migrations/" + migration.ID
+	if alias := r.URL.Query().Get("alias"); len(alias) > 0 {
+		location += "?alias=" + url.QueryEscape(alias)
+	}
+	return location
+}
+
+func errorStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrNoElasticClient):
+		return http.StatusServiceUnavailable
+	case errors.Is(err, ErrMigrationRunning), errors.Is(err, ErrMigrationAliasing), errors.Is(err, ErrSnapshotIndexOpen), errors.Is(err, ErrNotReadyToPromote), errors.Is(err, ErrMigrationLocked):
+		return http.StatusConflict
+	case errors.Is(err, ErrNoPreviousIndex), errors.Is(err, ErrNoReindexRunning), errors.Is(err, ErrMigrationNotFound), errors.Is(err, ErrNoMigrationRunning), errors.Is(err, ErrUnknownAlias), errors.Is(err, ErrNoSnapshot):
+		return http.StatusNotFound
+	case errors.Is(err, ErrNoIndexVersion), errors.Is(err, ErrInvalidThrottle), errors.Is(err, ErrInvalidMapping), errors.Is(err, ErrInvalidVersion), errors.Is(err, ErrAliasRequired), errors.Is(err, ErrNoSnapshotRepository), errors.Is(err, ErrSnapshotOnSource):
+		return http.StatusBadRequest
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+func writeJSONMessage(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, map[string]string{"message": msg})
+}
+
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		log.WithError(err).Error("unable to write response body")
+	}
+}
@@ -0,0 +1,190 @@
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"sync"
+
+	fthealth "github.com/Financial-Times/go-fthealth/v1_1"
+	log "github.com/Financial-Times/go-logger"
+	"github.com/Financial-Times/service-status-go/gtg"
+	"github.com/olivere/elastic/v7"
+)
+
+var (
+	ErrAliasRequired = errors.New("An alias must be given when the service manages several indices")
+	ErrUnknownAlias  = errors.New("Alias is not managed by the service")
+)
+
+// Manifest lists the indices managed by a single service
+type Manifest struct {
+	// Concurrency is the number of indices migrated at the same time, 1 to migrate them one after the other
+	Concurrency int            `json:"concurrency,omitempty"`
+	Indices     []ManagedIndex `json:"indices"`
+}
+
+// ManagedIndex is an index behind an alias, which is migrated to the mapping version of its mapping file
+type ManagedIndex struct {
+	Alias           string `json:"alias"`
+	Version         string `json:"version"`
+	MappingFile     string `json:"mapping"`
+	AliasFilterFile string `json:"aliasFilter,omitempty"`
+	SettingsFile    string `json:"settings,omitempty"`
+	// Aliases are moved along with the alias, without its filter
+	Aliases []string `json:"aliases,omitempty"`
+}
+
+// LoadManifest reads a manifest file, in which the mapping, alias filter and settings files are relative to the manifest
+func LoadManifest(manifestFile string) (*Manifest, error) {
+	b, err := ioutil.ReadFile(manifestFile)
+	if err != nil {
+		return nil, err
+	}
+
+	manifest := &Manifest{}
+	if err := json.Unmarshal(b, manifest); err != nil {
+		return nil, fmt.Errorf("decoding manifest %s: %w", manifestFile, err)
+	}
+
+	if len(manifest.Indices) == 0 {
+		return nil, fmt.Errorf("manifest %s lists no indices", manifestFile)
+	}
+	if manifest.Concurrency <= 0 {
+		manifest.Concurrency = 1
+	}
+
+	dir := filepath.Dir(manifestFile)
+	aliases := make(map[string]bool)
+	for i := range manifest.Indices {
+		index := &manifest.Indices[i]
+		if len(index.Alias) == 0 || len(index.Version) == 0 || len(index.MappingFile) == 0 {
+			return nil, fmt.Errorf("manifest %s: index %d must have an alias, a version and a mapping", manifestFile, i)
+		}
+		if aliases[index.Alias] {
+			return nil, fmt.Errorf("manifest %s lists alias %s more than once", manifestFile, index.Alias)
+		}
+		aliases[index.Alias] = true
+
+		index.MappingFile = relativeTo(dir, index.MappingFile)
+		if len(index.AliasFilterFile) > 0 {
+			index.AliasFilterFile = relativeTo(dir, index.AliasFilterFile)
+		}
+		if len(index.SettingsFile) > 0 {
+			index.SettingsFile = relativeTo(dir, index.SettingsFile)
+		}
+	}
+
+	return manifest, nil
+}
+
+// Index returns the manifest entry for an alias
+func (m *Manifest) Index(alias string) (ManagedIndex, error) {
+	for _, index := range m.Indices {
+		if index.Alias == alias {
+			return index, nil
+		}
+	}
+	return ManagedIndex{}, fmt.Errorf("%w: %s", ErrUnknownAlias, alias)
+}
+
+func relativeTo(dir string, path string) string {
+	if filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(dir, path)
+}
+
+// ManagedIndices migrates the indices of a manifest, and reports their health
+type ManagedIndices struct {
+	concurrency int
+	services    []*esService
+}
+
+// NewManagedIndices migrates every index of the manifest to its version on connection to the cluster
+func NewManagedIndices(ch chan *elastic.Client, manifest *Manifest, panicGuideUrl string, options MigrationOptions) *ManagedIndices {
+	m := &ManagedIndices{concurrency: manifest.Concurrency}
+	for _, index := range manifest.Indices {
+		m.services = append(m.services, newManagedEsService(index, panicGuideUrl, options))
+	}
+
+	go func() {
+		for ec := range ch {
+			m.connect(ec)
+		}
+	}()
+	return m
+}
+
+// NewManagedCommandService returns a service for one-off CLI commands on an index of a manifest
+func NewManagedCommandService(ec *elastic.Client, index ManagedIndex, options MigrationOptions) *esService {
+	es := newManagedEsService(index, "", options)
+	es.elasticClient = ec
+	es.migrationCheck = true
+	return es
+}
+
+func newManagedEsService(index ManagedIndex, panicGuideUrl string, options MigrationOptions) *esService {
+	es := newEsService(index.Alias, index.MappingFile, index.AliasFilterFile, index.SettingsFile, index.Version, panicGuideUrl, "", options)
+	es.extraAliases = index.Aliases
+	return es
+}
+
+// connect migrates the indices in the order of the manifest, running at most the configured number of migrations at the same time
+func (m *ManagedIndices) connect(ec *elastic.Client) {
+	// the health checks of the indices waiting for their turn connect to the cluster straight away
+	for _, es := range m.services {
+		es.setElasticClient(ec)
+	}
+
+	slots := make(chan struct{}, m.concurrency)
+	var wg sync.WaitGroup
+	for _, es := range m.services {
+		slots <- struct{}{}
+		wg.Add(1)
+		go func(es *esService) {
+			defer wg.Done()
+			defer func() { <-slots }()
+
+			log.WithField("alias", es.aliasName).Info("migrating managed index")
+			es.connect(ec)
+		}(es)
+	}
+	wg.Wait()
+}
+
+// AdminServices returns the service of each index, by alias
+func (m *ManagedIndices) AdminServices() map[string]EsAdminService {
+	services := make(map[string]EsAdminService)
+	for _, es := range m.services {
+		services[es.aliasName] = es
+	}
+	return services
+}
+
+func (m *ManagedIndices) GTG() gtg.Status {
+	return m.services[0].GTG()
+}
+
+// HealthChecks are the checks of the cluster, then the checks of each index named after its alias
+func (m *ManagedIndices) HealthChecks() []fthealth.Check {
+	checks := []fthealth.Check{
+		m.services[0].ConnectivityHealthyCheck(),
+		m.services[0].ClusterIsHealthyCheck(),
+	}
+
+	for _, es := range m.services {
+		for _, check := range []fthealth.Check{es.IndexMappingsCheck(), es.MappingDiffCheck(), es.FilesValidCheck()} {
+			check.Name = fmt.Sprintf("%s (%s)", check.Name, es.aliasName)
+			checks = append(checks, check)
+		}
+	}
+	return checks
+}
+
+func (m *ManagedIndices) MetricsHandler() http.Handler {
+	return metricsHandler(m.services[0], m.services...)
+}
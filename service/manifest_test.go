@@ -0,0 +1,117 @@
+package service
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadManifest(t *testing.T) {
+	manifest, err := LoadManifest("test/manifest.json")
+	require.NoError(t, err, "expected no error for loading manifest")
+
+	assert.Equal(t, 2, manifest.Concurrency, "concurrency")
+	require.Len(t, manifest.Indices, 2, "indices")
+
+	concepts := manifest.Indices[0]
+	assert.Equal(t, "concepts", concepts.Alias, "alias")
+	assert.Equal(t, "1.0.0", concepts.Version, "version")
+	assert.Equal(t, filepath.Join("test", "new-mapping.json"), concepts.MappingFile, "mapping file relative to the manifest")
+	assert.Equal(t, filepath.Join("test", "alias-filter.json"), concepts.AliasFilterFile, "alias filter file relative to the manifest")
+	assert.Equal(t, filepath.Join("test", "settings.json"), concepts.SettingsFile, "settings file relative to the manifest")
+	assert.Equal(t, []string{"all-concepts"}, concepts.Aliases, "extra aliases")
+
+	content, err := manifest.Index("content")
+	require.NoError(t, err, "expected no error for a managed alias")
+	assert.Empty(t, content.AliasFilterFile, "alias filter file")
+	assert.Empty(t, content.SettingsFile, "settings file")
+
+	_, err = manifest.Index("people")
+	assert.ErrorIs(t, err, ErrUnknownAlias, "expected error for an alias missing from the manifest")
+}
+
+func TestLoadManifestInvalid(t *testing.T) {
+	manifests := map[string]string{
+		"no indices":      `{"concurrency": 2, "indices": []}`,
+		"missing version": `{"indices": [{"alias": "concepts", "mapping": "mapping.json"}]}`,
+		"duplicate alias": `{"indices": [{"alias": "concepts", "version": "1.0.0", "mapping": "a.json"}, {"alias": "concepts", "version": "1.0.0", "mapping": "b.json"}]}`,
+		"invalid JSON":    `{"indices": `,
+	}
+
+	dir := t.TempDir()
+	for name, body := range manifests {
+		manifestFile := filepath.Join(dir, "manifest.json")
+		require.NoError(t, os.WriteFile(manifestFile, []byte(body), 0600), "expected no error for writing manifest")
+
+		_, err := LoadManifest(manifestFile)
+		assert.Error(t, err, "expected error for manifest with %s", name)
+	}
+}
+
+func TestLoadManifestDefaultConcurrency(t *testing.T) {
+	manifestFile := filepath.Join(t.TempDir(), "manifest.json")
+	body := `{"indices": [{"alias": "concepts", "version": "1.0.0", "mapping": "/mappings/concepts.json"}]}`
+	require.NoError(t, os.WriteFile(manifestFile, []byte(body), 0600), "expected no error for writing manifest")
+
+	manifest, err := LoadManifest(manifestFile)
+	require.NoError(t, err, "expected no error for loading manifest")
+	assert.Equal(t, 1, manifest.Concurrency, "indices are migrated one after the other by default")
+	assert.Equal(t, "/mappings/concepts.json", manifest.Indices[0].MappingFile, "absolute mapping file")
+}
+
+func TestManagedIndicesHealthChecks(t *testing.T) {
+	manifest, err := LoadManifest("test/manifest.json")
+	require.NoError(t, err, "expected no error for loading manifest")
+
+	m := &ManagedIndices{concurrency: manifest.Concurrency}
+	for _, index := range manifest.Indices {
+		m.services = append(m.services, newManagedEsService(index, "", MigrationOptions{}))
+	}
+
+	var names []string
+	for _, check := range m.HealthChecks() {
+		names = append(names, check.Name)
+	}
+	assert.Equal(t, []string{
+		"Check connectivity to the Elasticsearch cluster",
+		"Check Elasticsearch cluster health",
+		"Check Elasticsearch mappings version (concepts)",
+		"Check live Elasticsearch mapping against the mapping file (concepts)",
+		"Check the mapping and alias filter files are valid (concepts)",
+		"Check Elasticsearch mappings version (content)",
+		"Check live Elasticsearch mapping against the mapping file (content)",
+		"Check the mapping and alias filter files are valid (content)",
+	}, names, "health checks")
+
+	assert.Equal(t, []string{"all-concepts"}, m.services[0].unfilteredAliases(), "unfiltered aliases of the first index")
+	assert.Empty(t, m.services[1].unfilteredAliases(), "unfiltered aliases of the second index")
+}
+
+func TestManagedAdminHandler(t *testing.T) {
+	concepts := newManagedEsService(ManagedIndex{Alias: "concepts"}, "", MigrationOptions{})
+	content := newManagedEsService(ManagedIndex{Alias: "content"}, "", MigrationOptions{})
+	content.newMigration("2.1.0", "")
+
+	handler := NewManagedAdminHandler(map[string]EsAdminService{"concepts": concepts, "content": content})
+
+	statuses := map[string]int{
+		"/migrations/current?alias=content": http.StatusOK,
+		"/migrations/current":               http.StatusBadRequest,
+		"/migrations/current?alias=people":  http.StatusNotFound,
+	}
+	for url, expected := range statuses {
+		w := httptest.NewRecorder()
+		handler.CurrentMigration(w, httptest.NewRequest(http.MethodGet, url, nil))
+		assert.Equal(t, expected, w.Code, "status for %s", url)
+	}
+
+	single := NewManagedAdminHandler(map[string]EsAdminService{"content": content})
+	w := httptest.NewRecorder()
+	single.CurrentMigration(w, httptest.NewRequest(http.MethodGet, "/migrations/current", nil))
+	assert.Equal(t, http.StatusOK, w.Code, "the alias is optional with a single index")
+}
@@ -0,0 +1,516 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	fthealth "github.com/Financial-Times/go-fthealth/v1_1"
+	log "github.com/Financial-Times/go-logger"
+	"github.com/olivere/elastic/v7"
+)
+
+// defaultAnalyzers are the analyzers of the field types which are analysed, when the mapping does not set one.
+// Elasticsearch reports the analyzer of a completion field even if it was not set, but not the one of a text field.
+var defaultAnalyzers = map[string]string{
+	"text":               "default",
+	"search_as_you_type": "default",
+	"completion":         "simple",
+}
+
+// analysisComponents are the kinds of definitions under the index.analysis settings which are compared by the diff
+var analysisComponents = []string{"analyzer", "normalizer", "tokenizer", "filter", "char_filter"}
+
+// MappingDiff is a field-level comparison of a live index against a mapping file
+type MappingDiff struct {
+	Index           string           `json:"index"`
+	MappingFile     string           `json:"mappingFile"`
+	Added           []FieldChange    `json:"added,omitempty"`
+	Removed         []FieldChange    `json:"removed,omitempty"`
+	TypeChanged     []FieldChange    `json:"typeChanged,omitempty"`
+	AnalyzerChanged []FieldChange    `json:"analyzerChanged,omitempty"`
+	AnalysisChanged []AnalysisChange `json:"analysisChanged,omitempty"`
+	SettingsChanged []FieldChange    `json:"settingsChanged,omitempty"`
+	// DynamicFields are in the live index only, under an object which the mapping file lets documents add fields to.
+	// They are reported, but do not make the mapping differ from the file.
+	DynamicFields []FieldChange `json:"dynamicFields,omitempty"`
+}
+
+// FieldChange describes a single field, using dotted paths for object properties and multi-fields
+type FieldChange struct {
+	Field string `json:"field"`
+	Old   string `json:"old,omitempty"`
+	New   string `json:"new,omitempty"`
+}
+
+// AnalysisChange describes an analysis component such as analyzer.my_analyzer which was added, removed or changed
+type AnalysisChange struct {
+	Component string `json:"component"`
+	Change    string `json:"change"`
+}
+
+type EsMappingDiffService interface {
+	DiffMapping() (*MappingDiff, error)
+}
+
+// indexDefinition is the normalised form of an index's mapping and analysis settings
+type indexDefinition struct {
+	fields   map[string]fieldDefinition
+	dynamic  string
+	analysis map[string]interface{}
+	settings map[string]interface{}
+}
+
+type fieldDefinition struct {
+	Type           string
+	Analyzer       string
+	SearchAnalyzer string
+	// Dynamic is the dynamic mapping parameter which applies to the properties of an object, set on it or inherited
+	Dynamic string
+}
+
+func (f fieldDefinition) analyzers() string {
+	if f.SearchAnalyzer == f.Analyzer {
+		return f.Analyzer
+	}
+	return fmt.Sprintf("%s (search %s)", f.Analyzer, f.SearchAnalyzer)
+}
+
+// DiffMapping compares the mapping and settings of the index behind the alias with the mapping and settings files
+func (es *esService) DiffMapping() (*MappingDiff, error) {
+	client := es.esClient()
+	if client == nil {
+		return nil, ErrNoElasticClient
+	}
+
+	_, currentIndexName, _, err := es.checkIndexAliases(client, es.aliasName)
+	if err != nil {
+		return nil, err
+	}
+	if len(currentIndexName) == 0 {
+		return nil, fmt.Errorf("alias %s does not point to any index", es.aliasName)
+	}
+
+	body, err := es.readIndexBody()
+	if err != nil {
+		return nil, err
+	}
+
+	return es.diffMapping(client, currentIndexName, []byte(body))
+}
+
+func (es *esService) diffMapping(client *elastic.Client, indexName string, mapping []byte) (*MappingDiff, error) {
+	live, err := es.liveIndexDefinition(client, indexName)
+	if err != nil {
+		return nil, err
+	}
+
+	_, mappingFile := es.migrationTarget()
+	wanted, err := parseIndexDefinition(mapping)
+	if err != nil {
+		return nil, fmt.Errorf("parsing mapping file %s: %w", mappingFile, err)
+	}
+
+	diff := compareIndexDefinitions(live, wanted)
+	diff.Index = indexName
+	diff.MappingFile = mappingFile
+	return diff, nil
+}
+
+func (es *esService) liveIndexDefinition(client *elastic.Client, indexName string) (indexDefinition, error) {
+	mappings, err := client.GetMapping().Index(indexName).Do(context.Background())
+	if err != nil {
+		return indexDefinition{}, err
+	}
+
+	settings, err := client.IndexGetSettings(indexName).Do(context.Background())
+	if err != nil {
+		return indexDefinition{}, err
+	}
+
+	index, _ := mappings[indexName].(map[string]interface{})
+	fields, dynamic := normaliseFields(index["mappings"])
+	def := indexDefinition{
+		fields:   fields,
+		dynamic:  dynamic,
+		analysis: map[string]interface{}{},
+		settings: map[string]interface{}{},
+	}
+	if s, found := settings[indexName]; found {
+		def.analysis = normaliseAnalysis(s.Settings)
+		def.settings = normaliseSettings(s.Settings)
+	}
+	return def, nil
+}
+
+// parseIndexDefinition reads an index creation body with optional "settings" and "mappings" sections
+func parseIndexDefinition(body []byte) (indexDefinition, error) {
+	var index struct {
+		Settings map[string]interface{} `json:"settings"`
+		Mappings interface{}            `json:"mappings"`
+	}
+	if err := json.Unmarshal(body, &index); err != nil {
+		return indexDefinition{}, err
+	}
+
+	fields, dynamic := normaliseFields(index.Mappings)
+	return indexDefinition{
+		fields:   fields,
+		dynamic:  dynamic,
+		analysis: normaliseAnalysis(index.Settings),
+		settings: normaliseSettings(index.Settings),
+	}, nil
+}
+
+// normaliseFields flattens the mapping properties, including those of a legacy single mapping type, into dotted field paths,
+// and returns the dynamic mapping parameter of the root object
+func normaliseFields(mappings interface{}) (map[string]fieldDefinition, string) {
+	fields := make(map[string]fieldDefinition)
+
+	m, _ := mappings.(map[string]interface{})
+	properties, found := m["properties"].(map[string]interface{})
+	if !found && len(m) == 1 {
+		for _, typeMapping := range m {
+			m, _ = typeMapping.(map[string]interface{})
+			properties, _ = m["properties"].(map[string]interface{})
+		}
+	}
+
+	dynamic := stringValue(m["dynamic"])
+	flattenFields("", properties, dynamic, fields)
+	return fields, dynamic
+}
+
+func flattenFields(prefix string, properties map[string]interface{}, dynamic string, fields map[string]fieldDefinition) {
+	for name, v := range properties {
+		path := name
+		if len(prefix) > 0 {
+			path = prefix + "." + name
+		}
+
+		def, _ := v.(map[string]interface{})
+		field := fieldDefinition{
+			Type:           stringValue(def["type"]),
+			Analyzer:       stringValue(def["analyzer"]),
+			SearchAnalyzer: stringValue(def["search_analyzer"]),
+			Dynamic:        dynamic,
+		}
+		if len(field.Type) == 0 {
+			field.Type = "object"
+		}
+		if len(field.Analyzer) == 0 {
+			field.Analyzer = defaultAnalyzers[field.Type]
+		}
+		if len(field.SearchAnalyzer) == 0 {
+			field.SearchAnalyzer = field.Analyzer
+		}
+		if d, found := def["dynamic"]; found {
+			field.Dynamic = stringValue(d)
+		}
+		fields[path] = field
+
+		if nested, ok := def["properties"].(map[string]interface{}); ok {
+			flattenFields(path, nested, field.Dynamic, fields)
+		}
+		if multiFields, ok := def["fields"].(map[string]interface{}); ok {
+			flattenFields(path, multiFields, field.Dynamic, fields)
+		}
+	}
+}
+
+// normaliseAnalysis extracts the analysis components from index settings, whether nested or flat ("index.analysis...")
+// and whether or not they are under "index", with every scalar value turned into a string as Elasticsearch returns them
+func normaliseAnalysis(settings map[string]interface{}) map[string]interface{} {
+	expanded := expandSettings(settings)
+	if index, ok := expanded["index"].(map[string]interface{}); ok {
+		expanded = index
+	}
+
+	analysisSettings, _ := expanded["analysis"].(map[string]interface{})
+	analysis := make(map[string]interface{})
+	for _, kind := range analysisComponents {
+		components, _ := analysisSettings[kind].(map[string]interface{})
+		for name, def := range components {
+			analysis[kind+"."+name] = normaliseSettingValue(def)
+		}
+	}
+	return analysis
+}
+
+// normaliseSettings flattens the index settings other than analysis into dotted keys without the "index." prefix
+func normaliseSettings(settings map[string]interface{}) map[string]interface{} {
+	expanded := expandSettings(settings)
+	if index, ok := expanded["index"].(map[string]interface{}); ok {
+		for key, value := range expanded {
+			if key != "index" {
+				index[key] = value
+			}
+		}
+		expanded = index
+	}
+
+	flat := make(map[string]interface{})
+	flattenSettings("", expanded, flat)
+	return flat
+}
+
+func flattenSettings(prefix string, settings map[string]interface{}, flat map[string]interface{}) {
+	for key, value := range settings {
+		if len(prefix) == 0 && key == "analysis" {
+			continue
+		}
+
+		path := key
+		if len(prefix) > 0 {
+			path = prefix + "." + key
+		}
+
+		if nested, ok := value.(map[string]interface{}); ok {
+			flattenSettings(path, nested, flat)
+			continue
+		}
+		flat[path] = normaliseSettingValue(value)
+	}
+}
+
+// expandSettings turns dotted setting keys into nested objects
+func expandSettings(settings map[string]interface{}) map[string]interface{} {
+	expanded := make(map[string]interface{})
+	for key, value := range settings {
+		if nested, ok := value.(map[string]interface{}); ok {
+			value = expandSettings(nested)
+		}
+
+		parts := strings.Split(key, ".")
+		target := expanded
+		for _, part := range parts[:len(parts)-1] {
+			next, ok := target[part].(map[string]interface{})
+			if !ok {
+				next = make(map[string]interface{})
+				target[part] = next
+			}
+			target = next
+		}
+
+		last := parts[len(parts)-1]
+		if existing, ok := target[last].(map[string]interface{}); ok {
+			if nested, ok := value.(map[string]interface{}); ok {
+				for k, v := range nested {
+					existing[k] = v
+				}
+				continue
+			}
+		}
+		target[last] = value
+	}
+	return expanded
+}
+
+func normaliseSettingValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for key, nested := range expandSettings(v) {
+			m[key] = normaliseSettingValue(nested)
+		}
+		return m
+	case []interface{}:
+		s := make([]interface{}, len(v))
+		for i, nested := range v {
+			s[i] = normaliseSettingValue(nested)
+		}
+		return s
+	case nil:
+		return nil
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+func stringValue(v interface{}) string {
+	if v == nil {
+		return ""
+	}
+	return fmt.Sprint(v)
+}
+
+func compareIndexDefinitions(live, wanted indexDefinition) *MappingDiff {
+	diff := &MappingDiff{}
+
+	for path, field := range wanted.fields {
+		old, found := live.fields[path]
+		switch {
+		case !found:
+			diff.Added = append(diff.Added, FieldChange{Field: path, New: field.Type})
+		case old.Type != field.Type:
+			diff.TypeChanged = append(diff.TypeChanged, FieldChange{Field: path, Old: old.Type, New: field.Type})
+		case old.analyzers() != field.analyzers():
+			diff.AnalyzerChanged = append(diff.AnalyzerChanged, FieldChange{Field: path, Old: old.analyzers(), New: field.analyzers()})
+		}
+	}
+	for path, field := range live.fields {
+		if _, found := wanted.fields[path]; found {
+			continue
+		}
+		if wanted.allowsDynamicField(path) {
+			diff.DynamicFields = append(diff.DynamicFields, FieldChange{Field: path, Old: field.Type})
+		} else {
+			diff.Removed = append(diff.Removed, FieldChange{Field: path, Old: field.Type})
+		}
+	}
+
+	for component, def := range wanted.analysis {
+		old, found := live.analysis[component]
+		switch {
+		case !found:
+			diff.AnalysisChanged = append(diff.AnalysisChanged, AnalysisChange{Component: component, Change: "added"})
+		case !reflect.DeepEqual(old, def):
+			diff.AnalysisChanged = append(diff.AnalysisChanged, AnalysisChange{Component: component, Change: "changed"})
+		}
+	}
+	for component := range live.analysis {
+		if _, found := wanted.analysis[component]; !found {
+			diff.AnalysisChanged = append(diff.AnalysisChanged, AnalysisChange{Component: component, Change: "removed"})
+		}
+	}
+
+	// only settings present in the file are compared, as the live index also reports generated ones such as its uuid
+	for key, value := range wanted.settings {
+		if old := live.settings[key]; !reflect.DeepEqual(old, value) {
+			diff.SettingsChanged = append(diff.SettingsChanged, FieldChange{Field: key, Old: stringValue(old), New: stringValue(value)})
+		}
+	}
+
+	for _, changes := range [][]FieldChange{diff.Added, diff.Removed, diff.TypeChanged, diff.AnalyzerChanged, diff.SettingsChanged, diff.DynamicFields} {
+		sort.Slice(changes, func(i, j int) bool { return changes[i].Field < changes[j].Field })
+	}
+	sort.Slice(diff.AnalysisChanged, func(i, j int) bool {
+		return diff.AnalysisChanged[i].Component < diff.AnalysisChanged[j].Component
+	})
+
+	return diff
+}
+
+// allowsDynamicField reports whether documents may add a field at the path under this mapping: the closest object
+// of the mapping which the path is under must let them add fields, which Elasticsearch does by default.
+// A field under a field which is not an object can only be a multi-field, which documents cannot add.
+func (d indexDefinition) allowsDynamicField(path string) bool {
+	dynamic := d.dynamic
+	for i := strings.LastIndex(path, "."); i > 0; i = strings.LastIndex(path[:i], ".") {
+		if parent, found := d.fields[path[:i]]; found {
+			if parent.Type != "object" && parent.Type != "nested" {
+				return false
+			}
+			dynamic = parent.Dynamic
+			break
+		}
+	}
+	return len(dynamic) == 0 || dynamic == "true"
+}
+
+// Empty reports whether the live index matches the mapping file
+func (d *MappingDiff) Empty() bool {
+	return len(d.Added) == 0 && d.AdditiveOnly()
+}
+
+// AdditiveOnly reports whether the mapping file only adds fields to the live index, without changing its analysis or settings
+func (d *MappingDiff) AdditiveOnly() bool {
+	return len(d.Removed) == 0 && len(d.TypeChanged) == 0 && len(d.AnalyzerChanged) == 0 &&
+		len(d.AnalysisChanged) == 0 && len(d.SettingsChanged) == 0
+}
+
+// String summarises the diff on a single line, suitable for logs and health checks
+func (d *MappingDiff) String() string {
+	if d.Empty() {
+		if len(d.DynamicFields) > 0 {
+			return fmt.Sprintf("mapping of index %s matches %s, with dynamically added %s", d.Index, d.MappingFile, joinFieldChanges(d.DynamicFields, func(c FieldChange) string { return c.Field }))
+		}
+		return fmt.Sprintf("mapping of index %s matches %s", d.Index, d.MappingFile)
+	}
+
+	var parts []string
+	if len(d.Added) > 0 {
+		parts = append(parts, fmt.Sprintf("added %s", joinFieldChanges(d.Added, func(c FieldChange) string { return fmt.Sprintf("%s (%s)", c.Field, c.New) })))
+	}
+	if len(d.Removed) > 0 {
+		parts = append(parts, fmt.Sprintf("removed %s", joinFieldChanges(d.Removed, func(c FieldChange) string { return c.Field })))
+	}
+	if len(d.TypeChanged) > 0 {
+		parts = append(parts, fmt.Sprintf("type changed %s", joinFieldChanges(d.TypeChanged, func(c FieldChange) string {
+			return fmt.Sprintf("%s (%s -> %s)", c.Field, c.Old, c.New)
+		})))
+	}
+	if len(d.AnalyzerChanged) > 0 {
+		parts = append(parts, fmt.Sprintf("analyzer changed %s", joinFieldChanges(d.AnalyzerChanged, func(c FieldChange) string {
+			return fmt.Sprintf("%s (%s -> %s)", c.Field, c.Old, c.New)
+		})))
+	}
+	if len(d.AnalysisChanged) > 0 {
+		var components []string
+		for _, c := range d.AnalysisChanged {
+			components = append(components, fmt.Sprintf("%s (%s)", c.Component, c.Change))
+		}
+		parts = append(parts, fmt.Sprintf("analysis %s", strings.Join(components, ", ")))
+	}
+	if len(d.SettingsChanged) > 0 {
+		parts = append(parts, fmt.Sprintf("settings changed %s", joinFieldChanges(d.SettingsChanged, func(c FieldChange) string {
+			return fmt.Sprintf("%s (%s -> %s)", c.Field, orNone(c.Old), c.New)
+		})))
+	}
+
+	if len(d.DynamicFields) > 0 {
+		parts = append(parts, fmt.Sprintf("dynamically added %s", joinFieldChanges(d.DynamicFields, func(c FieldChange) string { return c.Field })))
+	}
+
+	return fmt.Sprintf("mapping of index %s differs from %s: %s", d.Index, d.MappingFile, strings.Join(parts, "; "))
+}
+
+func joinFieldChanges(changes []FieldChange, format func(FieldChange) string) string {
+	s := make([]string, len(changes))
+	for i, c := range changes {
+		s[i] = format(c)
+	}
+	return strings.Join(s, ", ")
+}
+
+func (es *esService) MappingDiffCheck() fthealth.Check {
+	return fthealth.Check{
+		BusinessImpact:   "Search results may not be as expected for the data set.",
+		Name:             "Check live Elasticsearch mapping against the mapping file",
+		PanicGuide:       es.panicGuideUrl,
+		Severity:         3,
+		TechnicalSummary: "The mapping of the aliased index differs from the mapping file, so some fields may not be indexed or analysed as expected.",
+		Checker:          es.mappingDiffChecker,
+	}
+}
+
+func (es *esService) mappingDiffChecker() (string, error) {
+	diff, err := es.DiffMapping()
+	if err != nil {
+		return "Could not compare the live mapping with the mapping file", err
+	}
+
+	es.RLock()
+	migrated := es.migrationCheck
+	es.RUnlock()
+	if !diff.Empty() && migrated {
+		return diff.String(), errors.New(diff.String())
+	}
+	return diff.String(), nil
+}
+
+// logMappingDiff logs how the mapping file differs from the current index, without failing the migration if it can't
+func (es *esService) logMappingDiff(client *elastic.Client, indexName string, mapping string) *MappingDiff {
+	diff, err := es.diffMapping(client, indexName, []byte(mapping))
+	if err != nil {
+		log.WithError(err).WithField("index", indexName).Warn("unable to compare the current mapping with the mapping file")
+		return nil
+	}
+
+	log.WithFields(map[string]interface{}{"index": indexName, "mappingFile": diff.MappingFile}).Info(diff.String())
+	return diff
+}
@@ -0,0 +1,165 @@
+package service
+
+import (
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func readIndexDefinition(t *testing.T, file string) indexDefinition {
+	body, err := ioutil.ReadFile(file)
+	require.NoError(t, err, "expected no error for reading mapping file")
+
+	def, err := parseIndexDefinition(body)
+	require.NoError(t, err, "expected no error for parsing mapping file")
+	return def
+}
+
+func TestCompareIndexDefinitionsAddedField(t *testing.T) {
+	live := readIndexDefinition(t, "test/old-mapping.json")
+	wanted := readIndexDefinition(t, "test/new-mapping.json")
+
+	diff := compareIndexDefinitions(live, wanted)
+
+	assert.Equal(t, []FieldChange{{Field: "prefLabel.mentionsCompletion", New: "completion"}, {Field: "prefLabel.raw", New: "keyword"}}, diff.Added, "added fields")
+	assert.Empty(t, diff.Removed, "removed fields")
+	assert.Empty(t, diff.TypeChanged, "type changes")
+	assert.Empty(t, diff.AnalyzerChanged, "analyzer changes")
+	assert.False(t, diff.Empty(), "expected a diff")
+}
+
+func TestCompareIndexDefinitionsRemovedField(t *testing.T) {
+	live := readIndexDefinition(t, "test/new-mapping.json")
+	wanted := readIndexDefinition(t, "test/old-mapping.json")
+
+	diff := compareIndexDefinitions(live, wanted)
+
+	assert.Empty(t, diff.Added, "added fields")
+	assert.Equal(t, []FieldChange{{Field: "prefLabel.mentionsCompletion", Old: "completion"}, {Field: "prefLabel.raw", Old: "keyword"}}, diff.Removed, "removed fields")
+}
+
+func TestCompareIndexDefinitionsUnchanged(t *testing.T) {
+	live := readIndexDefinition(t, "test/new-mapping.json")
+	wanted := readIndexDefinition(t, "test/new-mapping.json")
+
+	diff := compareIndexDefinitions(live, wanted)
+
+	assert.True(t, diff.Empty(), "expected no diff")
+	assert.Contains(t, diff.String(), "matches", "diff summary")
+}
+
+func TestCompareIndexDefinitionsTypeAndAnalyzerChanges(t *testing.T) {
+	live, err := parseIndexDefinition([]byte(`{
+		"settings": {"index": {"analysis": {"analyzer": {"lower": {"type": "custom", "tokenizer": "keyword", "filter": ["lowercase"]}}}}},
+		"mappings": {"properties": {
+			"id": {"type": "keyword"},
+			"prefLabel": {"type": "text"},
+			"aliases": {"type": "text", "analyzer": "lower"}
+		}}
+	}`))
+	require.NoError(t, err, "expected no error for parsing live definition")
+
+	wanted, err := parseIndexDefinition([]byte(`{
+		"settings": {"index.analysis.analyzer.lower.type": "custom", "index.analysis.analyzer.lower.tokenizer": "standard", "index.analysis.analyzer.lower.filter": ["lowercase"]},
+		"mappings": {"properties": {
+			"id": {"type": "text"},
+			"prefLabel": {"type": "text", "analyzer": "english"},
+			"aliases": {"type": "text", "analyzer": "lower"}
+		}}
+	}`))
+	require.NoError(t, err, "expected no error for parsing wanted definition")
+
+	diff := compareIndexDefinitions(live, wanted)
+
+	assert.Equal(t, []FieldChange{{Field: "id", Old: "keyword", New: "text"}}, diff.TypeChanged, "type changes")
+	assert.Equal(t, []FieldChange{{Field: "prefLabel", Old: "default", New: "english"}}, diff.AnalyzerChanged, "analyzer changes")
+	assert.Equal(t, []AnalysisChange{{Component: "analyzer.lower", Change: "changed"}}, diff.AnalysisChanged, "analysis changes")
+}
+
+func TestNormaliseAnalysisStringifiesValues(t *testing.T) {
+	fromFile := normaliseAnalysis(map[string]interface{}{
+		"analysis": map[string]interface{}{
+			"filter": map[string]interface{}{
+				"short": map[string]interface{}{"type": "length", "max": float64(10)},
+			},
+		},
+	})
+	fromCluster := normaliseAnalysis(map[string]interface{}{
+		"index": map[string]interface{}{
+			"analysis": map[string]interface{}{
+				"filter": map[string]interface{}{
+					"short": map[string]interface{}{"type": "length", "max": "10"},
+				},
+			},
+		},
+	})
+
+	assert.Equal(t, fromCluster, fromFile, "normalised analysis settings")
+}
+
+func TestCompareIndexDefinitionsCompletionField(t *testing.T) {
+	// the cluster reports the default analyzers of a completion field, which the mapping file leaves out
+	live, err := parseIndexDefinition([]byte(`{"mappings": {"properties": {
+		"prefLabel": {"type": "text", "fields": {"mentionsCompletion": {"type": "completion", "analyzer": "simple", "search_analyzer": "simple", "preserve_separators": true}}}
+	}}}`))
+	require.NoError(t, err, "expected no error for parsing live definition")
+	wanted, err := parseIndexDefinition([]byte(`{"mappings": {"properties": {
+		"prefLabel": {"type": "text", "fields": {"mentionsCompletion": {"type": "completion"}}}
+	}}}`))
+	require.NoError(t, err, "expected no error for parsing wanted definition")
+
+	diff := compareIndexDefinitions(live, wanted)
+	assert.Empty(t, diff.AnalyzerChanged, "analyzer changes")
+	assert.True(t, diff.Empty(), "expected no diff")
+
+	wanted, err = parseIndexDefinition([]byte(`{"mappings": {"properties": {
+		"prefLabel": {"type": "text", "fields": {"mentionsCompletion": {"type": "completion", "analyzer": "standard"}}}
+	}}}`))
+	require.NoError(t, err, "expected no error for parsing wanted definition")
+
+	diff = compareIndexDefinitions(live, wanted)
+	assert.Equal(t, []FieldChange{{Field: "prefLabel.mentionsCompletion", Old: "simple", New: "standard"}}, diff.AnalyzerChanged, "analyzer changes")
+}
+
+func TestCompareIndexDefinitionsDynamicFields(t *testing.T) {
+	live, err := parseIndexDefinition([]byte(`{"mappings": {"properties": {
+		"id": {"type": "keyword"},
+		"extra": {"type": "text", "fields": {"keyword": {"type": "keyword", "ignore_above": 256}}},
+		"metadata": {"properties": {"source": {"type": "keyword"}, "added": {"type": "long"}}},
+		"strict": {"properties": {"source": {"type": "keyword"}, "added": {"type": "long"}}},
+		"prefLabel": {"type": "text", "fields": {"raw": {"type": "keyword"}}}
+	}}}`))
+	require.NoError(t, err, "expected no error for parsing live definition")
+	wanted, err := parseIndexDefinition([]byte(`{"mappings": {"properties": {
+		"id": {"type": "keyword"},
+		"metadata": {"properties": {"source": {"type": "keyword"}}},
+		"strict": {"dynamic": "strict", "properties": {"source": {"type": "keyword"}}},
+		"prefLabel": {"type": "text"}
+	}}}`))
+	require.NoError(t, err, "expected no error for parsing wanted definition")
+
+	diff := compareIndexDefinitions(live, wanted)
+	assert.Equal(t, []FieldChange{{Field: "extra", Old: "text"}, {Field: "extra.keyword", Old: "keyword"}, {Field: "metadata.added", Old: "long"}}, diff.DynamicFields, "dynamically added fields")
+	assert.Equal(t, []FieldChange{{Field: "prefLabel.raw", Old: "keyword"}, {Field: "strict.added", Old: "long"}}, diff.Removed, "removed fields")
+
+	wanted, err = parseIndexDefinition([]byte(`{"mappings": {"dynamic": false, "properties": {
+		"id": {"type": "keyword"},
+		"metadata": {"properties": {"source": {"type": "keyword"}}},
+		"strict": {"dynamic": true, "properties": {"source": {"type": "keyword"}}},
+		"prefLabel": {"type": "text", "fields": {"raw": {"type": "keyword"}}}
+	}}}`))
+	require.NoError(t, err, "expected no error for parsing wanted definition")
+
+	diff = compareIndexDefinitions(live, wanted)
+	assert.Equal(t, []FieldChange{{Field: "strict.added", Old: "long"}}, diff.DynamicFields, "dynamically added fields")
+	assert.Equal(t, []FieldChange{{Field: "extra", Old: "text"}, {Field: "extra.keyword", Old: "keyword"}, {Field: "metadata.added", Old: "long"}}, diff.Removed, "removed fields under objects which inherit the dynamic mapping parameter")
+}
+
+func TestMappingDiffWithDynamicFieldsIsEmpty(t *testing.T) {
+	diff := &MappingDiff{Index: "concepts-1.0.0", MappingFile: "mapping.json", DynamicFields: []FieldChange{{Field: "extra", Old: "text"}}}
+
+	assert.True(t, diff.Empty(), "expected dynamically added fields not to make a diff")
+	assert.Contains(t, diff.String(), "dynamically added extra", "diff summary")
+}